@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Carts not written for CART_TTL_DAYS days are abandoned and get deleted.
+// MySQL and memory carts are deleted by a sweeper goroutine in every task;
+// DynamoDB deletes them itself through the table's TTL attribute. Either way
+// a cart can outlive its expires_at a little, until the next sweep or until
+// DynamoDB gets to it, and any write in that grace period keeps it.
+// Wishlists and saved-for-later lists never expire.
+const (
+	defaultCartSweepInterval = time.Hour
+
+	// cartSweepBatchSize bounds the carts deleted per statement, so a sweep
+	// never holds locks on many carts at once
+	cartSweepBatchSize = 500
+)
+
+// cartTTL is how long a cart may go without a write; 0 means carts never expire
+var cartTTL time.Duration
+
+// cartTTLFromEnv reads CART_TTL_DAYS, a whole number of days. Unset or 0
+// disables expiry.
+func cartTTLFromEnv() time.Duration {
+	value := os.Getenv("CART_TTL_DAYS")
+	if value == "" {
+		return 0
+	}
+	days, err := strconv.Atoi(value)
+	if err != nil || days < 0 {
+		log.Printf("Warning: invalid CART_TTL_DAYS %q, using 0 (carts never expire)", value)
+		return 0
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// cartSweepIntervalFromEnv reads CART_SWEEP_INTERVAL (a Go duration such as "1h")
+func cartSweepIntervalFromEnv() time.Duration {
+	value := os.Getenv("CART_SWEEP_INTERVAL")
+	if value == "" {
+		return defaultCartSweepInterval
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval <= 0 {
+		log.Printf("Warning: invalid CART_SWEEP_INTERVAL %q, using %s", value, defaultCartSweepInterval)
+		return defaultCartSweepInterval
+	}
+	return interval
+}
+
+// computeExpiry sets ExpiresAt from UpdatedAt, when lists of the cart's
+// type expire at all
+func (cart *ShoppingCart) computeExpiry() {
+	if cartTTL <= 0 || !cart.Type.expires() {
+		return
+	}
+	updated, err := time.Parse(time.RFC3339, cart.UpdatedAt)
+	if err != nil {
+		return
+	}
+	cart.ExpiresAt = updated.Add(cartTTL).UTC().Format(time.RFC3339)
+}
+
+// idleCartSweeper is implemented by cart stores whose expired carts the
+// application has to delete itself
+type idleCartSweeper interface {
+	// DeleteIdleCarts deletes up to limit carts last written before cutoff,
+	// with their items, and returns how many it deleted
+	DeleteIdleCarts(ctx context.Context, cutoff time.Time, limit int) (int, error)
+}
+
+// CartExpiryStats is what GET /metrics/carts reports about cart expiry in
+// this task. Carts DynamoDB expires are not counted here; the table's
+// TimeToLiveDeletedItemCount metric in CloudWatch has them.
+type CartExpiryStats struct {
+	TTLDays          int    `json:"cart_ttl_days"`
+	Mode             string `json:"mode"` // "disabled", "sweeper" or "dynamodb_ttl"
+	ExpiredCarts     int64  `json:"expired_carts_total"`
+	Sweeps           int64  `json:"sweeps_total"`
+	LastSweepAt      string `json:"last_sweep_at,omitempty"`
+	LastSweepExpired int    `json:"last_sweep_expired"`
+	LastSweepError   string `json:"last_sweep_error,omitempty"`
+}
+
+// cartExpiryStats is updated by the sweeper and read by the metrics endpoint
+var cartExpiryStats = struct {
+	sync.Mutex
+	CartExpiryStats
+}{CartExpiryStats: CartExpiryStats{Mode: "disabled"}}
+
+// setCartExpiryMode records how this task expires carts, for the metrics
+func setCartExpiryMode(mode string) {
+	cartExpiryStats.Lock()
+	defer cartExpiryStats.Unlock()
+	cartExpiryStats.TTLDays = int(cartTTL / (24 * time.Hour))
+	cartExpiryStats.Mode = mode
+}
+
+// cartExpirySnapshot copies the current stats
+func cartExpirySnapshot() CartExpiryStats {
+	cartExpiryStats.Lock()
+	defer cartExpiryStats.Unlock()
+	return cartExpiryStats.CartExpiryStats
+}
+
+// sweepIdleCarts deletes carts idle for longer than ttl every interval,
+// until ctx is cancelled. Every task sweeps; deleting a cart twice is a no-op.
+func sweepIdleCarts(ctx context.Context, sweeper idleCartSweeper, ttl, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		sweepIdleCartsOnce(ctx, sweeper, ttl)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sweepIdleCartsOnce deletes batches of idle carts until a batch comes back short
+func sweepIdleCartsOnce(ctx context.Context, sweeper idleCartSweeper, ttl time.Duration) {
+	cutoff := time.Now().Add(-ttl)
+	expired := 0
+	var sweepErr error
+	for {
+		n, err := sweeper.DeleteIdleCarts(ctx, cutoff, cartSweepBatchSize)
+		expired += n
+		if err != nil {
+			sweepErr = err
+			break
+		}
+		if n < cartSweepBatchSize {
+			break
+		}
+	}
+
+	if sweepErr != nil {
+		log.Printf("Error sweeping idle carts: %v", sweepErr)
+	} else if expired > 0 {
+		log.Printf("Deleted %d carts idle since before %s", expired, cutoff.UTC().Format(time.RFC3339))
+	}
+
+	cartExpiryStats.Lock()
+	defer cartExpiryStats.Unlock()
+	cartExpiryStats.ExpiredCarts += int64(expired)
+	cartExpiryStats.Sweeps++
+	cartExpiryStats.LastSweepAt = time.Now().UTC().Format(time.RFC3339)
+	cartExpiryStats.LastSweepExpired = expired
+	cartExpiryStats.LastSweepError = ""
+	if sweepErr != nil {
+		cartExpiryStats.LastSweepError = sweepErr.Error()
+	}
+}
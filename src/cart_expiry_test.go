@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCartTTLFromEnv(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"0", 0},
+		{"30", 30 * 24 * time.Hour},
+		{"-1", 0},
+		{"2w", 0},
+	}
+	for _, tt := range tests {
+		t.Setenv("CART_TTL_DAYS", tt.value)
+		if got := cartTTLFromEnv(); got != tt.want {
+			t.Errorf("CART_TTL_DAYS=%q: got %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
+
+// batchSweeper hands out the results of successive DeleteIdleCarts calls
+type batchSweeper struct {
+	batches []int
+	err     error
+	calls   int
+}
+
+func (s *batchSweeper) DeleteIdleCarts(ctx context.Context, cutoff time.Time, limit int) (int, error) {
+	if s.calls == len(s.batches) {
+		return 0, s.err
+	}
+	n := s.batches[s.calls]
+	s.calls++
+	return n, nil
+}
+
+func TestSweepIdleCartsOnce(t *testing.T) {
+	before := cartExpirySnapshot()
+
+	// Full batches mean more carts may be waiting
+	sweeper := &batchSweeper{batches: []int{cartSweepBatchSize, cartSweepBatchSize, 7}}
+	sweepIdleCartsOnce(context.Background(), sweeper, time.Hour)
+	stats := cartExpirySnapshot()
+	if sweeper.calls != 3 || stats.LastSweepExpired != 2*cartSweepBatchSize+7 ||
+		stats.ExpiredCarts-before.ExpiredCarts != 2*cartSweepBatchSize+7 || stats.Sweeps-before.Sweeps != 1 {
+		t.Errorf("after sweep: %d calls, stats %+v", sweeper.calls, stats)
+	}
+
+	failing := &batchSweeper{batches: []int{cartSweepBatchSize}, err: errors.New("deadlock")}
+	sweepIdleCartsOnce(context.Background(), failing, time.Hour)
+	if stats := cartExpirySnapshot(); stats.LastSweepError != "deadlock" || stats.LastSweepExpired != cartSweepBatchSize {
+		t.Errorf("after failed sweep: stats %+v, want the error and the carts deleted before it", stats)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+// ListType names one of a customer's lists. A customer has at most one list
+// of each type, and each list has its own ID. The cart is the default list;
+// /shopping-carts/:id addresses it, and it is the only list a guest has.
+type ListType string
+
+const (
+	ListCart     ListType = "cart"
+	ListWishlist ListType = "wishlist"
+	ListSaved    ListType = "saved"
+)
+
+// cartKey identifies one of a customer's lists
+type cartKey struct {
+	customerID int
+	list       ListType
+}
+
+// parseListType checks a list type name
+func parseListType(value string) (ListType, bool) {
+	switch list := ListType(value); list {
+	case ListCart, ListWishlist, ListSaved:
+		return list, true
+	}
+	return "", false
+}
+
+// reservesStock reports whether lines of the list hold stock. Only the cart
+// is headed for checkout; wishlists and saved items reserve nothing.
+func (list ListType) reservesStock() bool {
+	return list == ListCart
+}
+
+// expires reports whether an abandoned list of this type is deleted after
+// CART_TTL_DAYS. Wishlists and saved items are kept until the customer
+// deletes them.
+func (list ListType) expires() bool {
+	return list == ListCart
+}
+
+// quantityOf returns the quantity of a product in the list, and whether the
+// list holds the product at all
+func (cart *ShoppingCart) quantityOf(productID int) (int, bool) {
+	for _, item := range cart.Items {
+		if item.ProductID == productID {
+			return item.Quantity, true
+		}
+	}
+	return 0, false
+}
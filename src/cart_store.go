@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+)
+
+// Errors returned by CartStore implementations. Handlers map these to
+// HTTP status codes so every backend answers the same way.
+var (
+	ErrCartNotFound    = errors.New("shopping cart not found")
+	ErrProductNotFound = errors.New("product not found")
+	ErrItemNotFound    = errors.New("item not found in shopping cart")
+	ErrInvalidQuantity = errors.New("quantity cannot go below zero")
+	// ErrConcurrentModification means a write kept losing races with other
+	// writers of the same cart and gave up after bounded retries
+	ErrConcurrentModification = errors.New("shopping cart was modified concurrently")
+	// ErrCartTooLarge means a checkout or merge touches more lines than one
+	// DynamoDB transaction can commit
+	ErrCartTooLarge = errors.New("shopping cart has too many lines for one transaction")
+)
+
+// CartStore is the persistence layer behind the shopping cart and list
+// endpoints. Lists are addressed by customer ID, matching the {id} path
+// parameter, and list type; the cart is the customer's default list.
+type CartStore interface {
+	// CreateCart returns the customer's list of the given type, creating it
+	// if needed. created reports whether a new list was inserted.
+	CreateCart(ctx context.Context, customerID int, list ListType) (cart *ShoppingCart, created bool, err error)
+
+	// GetCartByCustomer returns one of the customer's lists with all of its items.
+	GetCartByCustomer(ctx context.Context, customerID int, list ListType) (*ShoppingCart, error)
+
+	// ListCarts returns every list the customer has, with items, ordered by ID
+	ListCarts(ctx context.Context, customerID int) ([]ShoppingCart, error)
+
+	// UpsertItem sets the quantity of a product in one of the customer's lists.
+	// created reports whether the product was not in the list before.
+	UpsertItem(ctx context.Context, customerID int, list ListType, productID, quantity int) (item *CartItem, created bool, err error)
+
+	// UpdateItemQuantity changes the quantity of a product already in the list.
+	// A resulting quantity of zero removes the line; the returned item then
+	// has Quantity 0.
+	UpdateItemQuantity(ctx context.Context, customerID int, list ListType, productID int, update QuantityUpdate) (*CartItem, error)
+
+	// RemoveItem takes a product out of one of the customer's lists
+	RemoveItem(ctx context.Context, customerID int, list ListType, productID int) error
+
+	// ClearCart removes every item but keeps the list itself
+	ClearCart(ctx context.Context, customerID int, list ListType) error
+
+	// DeleteCart removes the list and all of its items
+	DeleteCart(ctx context.Context, customerID int, list ListType) error
+
+	// MoveItem atomically moves a product's line from one of the customer's
+	// lists to another, adding its quantity to a line already there. Both
+	// lists must exist. It returns the line as it is in the target list.
+	MoveItem(ctx context.Context, customerID int, from, to ListType, productID int) (*CartItem, error)
+
+	// CreateGuestCart creates a cart for a shopper who is not logged in. It
+	// belongs to a new guest customer ID, which is negative so it never
+	// collides with a real customer; token is the only way to reach it.
+	CreateGuestCart(ctx context.Context) (cart *ShoppingCart, token string, err error)
+
+	// GuestCustomerID resolves a guest cart token to its guest customer ID,
+	// or returns ErrCartNotFound
+	GuestCustomerID(ctx context.Context, token string) (int, error)
+
+	// MergeCarts atomically moves every line of the guest's cart into the
+	// customer's cart and deletes the guest cart and its token. Products in
+	// both carts are combined by rule. Both carts must exist.
+	MergeCarts(ctx context.Context, guestID, customerID int, rule MergeRule) error
+}
+
+// QuantityUpdate describes a PATCH to a cart line. Exactly one of
+// Quantity (absolute) and Delta (relative) is set.
+type QuantityUpdate struct {
+	Quantity *int `json:"quantity"`
+	Delta    *int `json:"delta"`
+}
+
+// apply returns the new quantity for a line that currently holds current
+func (u QuantityUpdate) apply(current int) (int, error) {
+	next := current
+	if u.Quantity != nil {
+		next = *u.Quantity
+	} else if u.Delta != nil {
+		next = current + *u.Delta
+	}
+	if next < 0 {
+		return 0, ErrInvalidQuantity
+	}
+	return next, nil
+}
+
+// computeTotals sums the cart's lines into Subtotal, ItemCount and
+// TotalWeight. Every backend returns the current unit price and weight per
+// line, so the totals come out the same whichever store the cart is in.
+// A cart whose lines are priced in different currencies has no meaningful
+// subtotal; it is left at 0 with Currency empty.
+func (cart *ShoppingCart) computeTotals() {
+	cart.Subtotal, cart.Currency, cart.ItemCount, cart.TotalWeight = 0, "", 0, 0
+	mixed := false
+	for _, item := range cart.Items {
+		cart.ItemCount += item.Quantity
+		cart.TotalWeight += item.Weight * float64(item.Quantity)
+		cart.Subtotal += item.UnitPrice * int64(item.Quantity)
+		if cart.Currency == "" {
+			cart.Currency = item.Currency
+		} else if item.Currency != cart.Currency {
+			mixed = true
+		}
+	}
+	if mixed {
+		log.Printf("Cart %d mixes currencies, leaving its subtotal out", cart.ID)
+		cart.Subtotal, cart.Currency = 0, ""
+	}
+	// Weights are FLOAT columns; keep float noise out of the total
+	cart.TotalWeight = math.Round(cart.TotalWeight*1000) / 1000
+}
+
+// markPriceChanges flags the lines whose product price moved since it was
+// added, so checkout can warn the customer before charging the new price
+func (cart *ShoppingCart) markPriceChanges() {
+	for i := range cart.Items {
+		item := &cart.Items[i]
+		item.PriceChanged = item.UnitPriceAtAdd != nil && *item.UnitPriceAtAdd != item.UnitPrice
+	}
+}
+
+// fillFromCatalog sets a line's unit price, currency and weight from the
+// catalog cache. Lines whose product has left the catalog keep the values
+// they were stored with.
+func (item *CartItem) fillFromCatalog() {
+	if value, ok := syncProducts.Load(item.ProductID); ok {
+		product := value.(Item)
+		item.UnitPrice = product.Price
+		item.Currency = product.Currency
+		item.Weight = product.Weight
+	}
+}
+
+// cartStore is the backend selected in main by DATABASE_TYPE
+var cartStore CartStore
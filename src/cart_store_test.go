@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestQuantityUpdateApply(t *testing.T) {
+	intPtr := func(n int) *int { return &n }
+	tests := []struct {
+		name    string
+		update  QuantityUpdate
+		current int
+		want    int
+		wantErr error
+	}{
+		{"absolute", QuantityUpdate{Quantity: intPtr(7)}, 3, 7, nil},
+		{"absolute zero", QuantityUpdate{Quantity: intPtr(0)}, 3, 0, nil},
+		{"absolute negative", QuantityUpdate{Quantity: intPtr(-1)}, 3, 0, ErrInvalidQuantity},
+		{"delta up", QuantityUpdate{Delta: intPtr(2)}, 3, 5, nil},
+		{"delta down to zero", QuantityUpdate{Delta: intPtr(-3)}, 3, 0, nil},
+		{"delta below zero", QuantityUpdate{Delta: intPtr(-4)}, 3, 0, ErrInvalidQuantity},
+		{"neither", QuantityUpdate{}, 3, 3, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.update.apply(tt.current)
+			if got != tt.want || !errors.Is(err, tt.wantErr) {
+				t.Errorf("apply(%d) = %d, %v; want %d, %v", tt.current, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestComputeTotals(t *testing.T) {
+	tests := []struct {
+		name         string
+		items        []CartItem
+		wantSubtotal int64
+		wantCurrency string
+		wantCount    int
+		wantWeight   float64
+	}{
+		{"empty", nil, 0, "", 0, 0},
+		{
+			"one currency",
+			[]CartItem{
+				{Quantity: 2, UnitPrice: 1099, Currency: "USD", Weight: 0.1},
+				{Quantity: 1, UnitPrice: 500, Currency: "USD", Weight: 1.25},
+			},
+			2698, "USD", 3, 1.45,
+		},
+		{
+			"mixed currencies",
+			[]CartItem{
+				{Quantity: 1, UnitPrice: 1099, Currency: "USD", Weight: 2},
+				{Quantity: 3, UnitPrice: 800, Currency: "EUR", Weight: 1},
+			},
+			0, "", 4, 5,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cart := ShoppingCart{Items: tt.items}
+			cart.computeTotals()
+			if cart.Subtotal != tt.wantSubtotal || cart.Currency != tt.wantCurrency ||
+				cart.ItemCount != tt.wantCount || cart.TotalWeight != tt.wantWeight {
+				t.Errorf("totals = %d %q, %d items, %v weight; want %d %q, %d items, %v weight",
+					cart.Subtotal, cart.Currency, cart.ItemCount, cart.TotalWeight,
+					tt.wantSubtotal, tt.wantCurrency, tt.wantCount, tt.wantWeight)
+			}
+		})
+	}
+}
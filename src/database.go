@@ -1,13 +1,15 @@
 package main
 
 import (
+    "context"
     "database/sql"
+    "errors"
     "fmt"
     "log"
     "os"
     "strings"
     
-    _ "github.com/go-sql-driver/mysql"
+    "github.com/go-sql-driver/mysql"
 )
 
 // Global database connection pool
@@ -89,6 +91,11 @@ func runSchemaFromFile(filename string) error {
         // Execute the statement
         log.Printf("Executing statement %d...", i+1)
         _, err := DB.Exec(stmt)
+        if isAlreadyApplied(err) {
+            // ALTER TABLE has no IF NOT EXISTS, so re-runs hit this every start
+            log.Printf("Statement %d already applied, skipping", i+1)
+            continue
+        }
         if err != nil {
             return fmt.Errorf("error executing statement %d: %w\nStatement: %s", i+1, err, stmt)
         }
@@ -139,6 +146,27 @@ func removeComments(sql string) string {
     return result
 }
 
+// isDuplicateKey reports whether err is MySQL's duplicate entry error (1062)
+func isDuplicateKey(err error) bool {
+    var mysqlErr *mysql.MySQLError
+    return errors.As(err, &mysqlErr) && mysqlErr.Number == 1062
+}
+
+// isAlreadyApplied reports whether err is MySQL's duplicate column (1060),
+// duplicate key name (1061) or missing key to drop (1091) error, raised when
+// a schema change is re-run
+func isAlreadyApplied(err error) bool {
+    var mysqlErr *mysql.MySQLError
+    return errors.As(err, &mysqlErr) && (mysqlErr.Number == 1060 || mysqlErr.Number == 1061 || mysqlErr.Number == 1091)
+}
+
+// isForeignKeyViolation reports whether err is MySQL's "row is referenced"
+// error (1451), raised when ON DELETE RESTRICT blocks a delete
+func isForeignKeyViolation(err error) bool {
+    var mysqlErr *mysql.MySQLError
+    return errors.As(err, &mysqlErr) && mysqlErr.Number == 1451
+}
+
 // CloseDatabase closes the database connection
 func CloseDatabase() error {
     if DB != nil {
@@ -150,18 +178,32 @@ func CloseDatabase() error {
 
 
 
-// Alternative: Batch insert for much better performance with large datasets
+// seedProductsBatch inserts products into an empty products table in batches.
+// It is the explicit seeding step (SEED_PRODUCTS=true); a table that already
+// has products is left alone.
 func seedProductsBatch(products map[int]Item) error {
-	// Get lock (only one task can seed)
-    _, err := DB.Exec("SELECT GET_LOCK('seed_lock', 30)")
+    ctx := context.Background()
+
+    // GET_LOCK belongs to a session, so hold one connection until we are done
+    conn, err := DB.Conn(ctx)
     if err != nil {
         return err
     }
-    defer DB.Exec("SELECT RELEASE_LOCK('seed_lock')")
+    defer conn.Close()
+
+	// Get lock (only one task can seed)
+    var locked sql.NullInt64
+    if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK('seed_lock', 30)").Scan(&locked); err != nil {
+        return err
+    }
+    if locked.Int64 != 1 {
+        return fmt.Errorf("timed out waiting for seed_lock")
+    }
+    defer conn.ExecContext(ctx, "SELECT RELEASE_LOCK('seed_lock')")
     
     // Check if products already exist
     var count int
-    e := DB.QueryRow("SELECT COUNT(*) FROM products").Scan(&count)
+    e := conn.QueryRowContext(ctx, "SELECT COUNT(*) FROM products").Scan(&count)
     if e != nil {
         return e
     }
@@ -176,7 +218,7 @@ func seedProductsBatch(products map[int]Item) error {
     // Batch size
     batchSize := 1000
     
-    values := make([]interface{}, 0, batchSize*10) // 10 fields per product
+    values := make([]interface{}, 0, batchSize*productSeedFields)
     insertedCount := 0
     
     for id := 1; id <= len(products); id++ {
@@ -196,15 +238,17 @@ func seedProductsBatch(products map[int]Item) error {
             item.Category,
             item.Description,
             item.Brand,
+            item.Price,
+            item.Currency,
         )
         
         // Execute batch when we reach batchSize
-        if len(values) >= batchSize*10 {
-            if err := executeBatchInsert(values, len(values)/10); err != nil {
+        if len(values) >= batchSize*productSeedFields {
+            if err := executeBatchInsert(values, len(values)/productSeedFields); err != nil {
                 log.Printf("Error in batch insert: %v", err)
                 return err
             }
-            insertedCount += len(values) / 10
+            insertedCount += len(values) / productSeedFields
             log.Printf("Inserted %d products...", insertedCount)
             values = values[:0] // Clear slice
         }
@@ -212,26 +256,97 @@ func seedProductsBatch(products map[int]Item) error {
     
     // Insert remaining products
     if len(values) > 0 {
-        if err := executeBatchInsert(values, len(values)/10); err != nil {
+        if err := executeBatchInsert(values, len(values)/productSeedFields); err != nil {
             log.Printf("Error in final batch insert: %v", err)
             return err
         }
-        insertedCount += len(values) / 10
+        insertedCount += len(values) / productSeedFields
     }
     
     log.Printf("Seeding complete: %d products inserted", insertedCount)
     return nil
 }
 
+// backfillProductPrices prices the products that have none: rows from
+// tables created before products had prices, whose price column was added
+// as NULL. Each gets the price GenerateProducts gives its ID under seed, the
+// same price a freshly seeded catalog has. It runs before the catalog is
+// loaded, under seed_lock, so no task serves a product without a price.
+func backfillProductPrices(seed int64) error {
+    ctx := context.Background()
+
+    conn, err := DB.Conn(ctx)
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+
+    var locked sql.NullInt64
+    if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK('seed_lock', 30)").Scan(&locked); err != nil {
+        return err
+    }
+    if locked.Int64 != 1 {
+        return fmt.Errorf("timed out waiting for seed_lock")
+    }
+    defer conn.ExecContext(ctx, "SELECT RELEASE_LOCK('seed_lock')")
+
+    rows, err := conn.QueryContext(ctx, "SELECT id FROM products WHERE price IS NULL ORDER BY id")
+    if err != nil {
+        return err
+    }
+    var ids []int
+    for rows.Next() {
+        var id int
+        if err := rows.Scan(&id); err != nil {
+            rows.Close()
+            return err
+        }
+        ids = append(ids, id)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return err
+    }
+    if len(ids) == 0 {
+        return nil
+    }
+
+    log.Printf("Backfilling prices of %d products...", len(ids))
+    generated := GenerateProducts(ids[len(ids)-1], seed)
+    const batchSize = 1000
+    for start := 0; start < len(ids); start += batchSize {
+        batch := ids[start:min(start+batchSize, len(ids))]
+        tx, err := conn.BeginTx(ctx, nil)
+        if err != nil {
+            return err
+        }
+        for _, id := range batch {
+            _, err := tx.ExecContext(ctx, "UPDATE products SET price = ? WHERE id = ? AND price IS NULL", generated[id].Price, id)
+            if err != nil {
+                tx.Rollback()
+                return err
+            }
+        }
+        if err := tx.Commit(); err != nil {
+            return err
+        }
+    }
+    log.Printf("Backfill complete: %d products priced", len(ids))
+    return nil
+}
+
+// productSeedFields is the number of columns executeBatchInsert writes per product
+const productSeedFields = 12
+
 // executeBatchInsert performs a bulk insert
 func executeBatchInsert(values []interface{}, numRows int) error {
     // Build query with correct number of placeholders
     valueStrings := make([]string, 0, numRows)
     for i := 0; i < numRows; i++ {
-        valueStrings = append(valueStrings, "(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+        valueStrings = append(valueStrings, "(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
     }
     
-    query := `INSERT INTO products (id, sku, manufacturer, category_id, weight, some_other_id, name, category, description, brand) VALUES `
+    query := `INSERT INTO products (id, sku, manufacturer, category_id, weight, some_other_id, name, category, description, brand, price, currency) VALUES `
     query += strings.Join(valueStrings, ",")
     
     _, err := DB.Exec(query, values...)
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -21,6 +22,10 @@ var DynamoDBTableName string
 // GSI name for customer_id lookups
 const CustomerIDIndexName = "customer_id-index"
 
+// GSI name for finding the cart lines of a product. Only ITEM# rows carry
+// product_id at the top level, so the index holds nothing else.
+const ProductIDIndexName = "product_id-index"
+
 // InitDynamoDB initializes the DynamoDB client using AWS SDK v2
 func InitDynamoDB() error {
 	region := os.Getenv("AWS_REGION")
@@ -44,7 +49,7 @@ func InitDynamoDB() error {
 	if serviceName == "" {
 		serviceName = "cs6650l2" // Default service name
 	}
-	DynamoDBTableName = fmt.Sprintf("%s-shopping-carts", serviceName)
+	DynamoDBTableName = fmt.Sprintf("%s-carts", serviceName)
 
 	log.Printf("DynamoDB client initialized for table: %s (region: %s)", DynamoDBTableName, region)
 
@@ -86,3 +91,25 @@ func isResourceNotFound(err error) bool {
 	return false
 }
 
+// isWriteConflict reports whether a write, or any write of a transaction, was
+// rejected by its ConditionExpression or lost a race with another transaction
+func isWriteConflict(err error) bool {
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return true
+	}
+	var conflictErr *types.TransactionConflictException
+	if errors.As(err, &conflictErr) {
+		return true
+	}
+	var canceledErr *types.TransactionCanceledException
+	if errors.As(err, &canceledErr) {
+		for _, reason := range canceledErr.CancellationReasons {
+			switch aws.ToString(reason.Code) {
+			case "ConditionalCheckFailed", "TransactionConflict":
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Carts expire through the table's TTL attribute, expires_at (epoch seconds,
+// the same attribute idempotency rows use). Every cart write sets the META
+// row's expires_at to cartTTL from now. The cart's other rows, its lines and
+// the customer guard, would otherwise expire with the write that last touched
+// them, so they are given a later expiry instead: cartTTL past the META row's,
+// recorded on META as rows_expire_at. Whenever a write finds rows_expire_at
+// closer than the META row's new expiry, it pushes every row out again. Lines
+// of a live cart so outlast it, and an abandoned cart's rows follow its META
+// row within another cartTTL. Lists other than carts get no expiry at all.
+
+// cartMetaExpiry is the expires_at of a META row written at now, or 0 when
+// lists of the type do not expire
+func cartMetaExpiry(list ListType, now time.Time) int64 {
+	if cartTTL <= 0 || !list.expires() {
+		return 0
+	}
+	return now.Add(cartTTL).Unix()
+}
+
+// cartRowExpiry is the expires_at of line and guard rows written at now
+func cartRowExpiry(list ListType, now time.Time) int64 {
+	if cartTTL <= 0 || !list.expires() {
+		return 0
+	}
+	return now.Add(2 * cartTTL).Unix()
+}
+
+// rowExpiryStale reports whether a list whose rows expire at rowsExpireAt
+// needs them pushed out after a write at now. Turning expiry off makes every
+// cart with expiring rows stale, so the next write clears them.
+func rowExpiryStale(list ListType, rowsExpireAt int64, now time.Time) bool {
+	if cartTTL <= 0 || !list.expires() {
+		return rowsExpireAt != 0
+	}
+	return rowsExpireAt < cartMetaExpiry(list, now)
+}
+
+// withExpiry extends a SET update expression to also set expires_at, or to
+// remove it when expiresAt is 0
+func withExpiry(set string, expiresAt int64, values map[string]types.AttributeValue) string {
+	if expiresAt == 0 {
+		return strings.TrimSpace(set + " REMOVE expires_at")
+	}
+	values[":expires_at"] = attrInt64(expiresAt)
+	if set == "" {
+		return "SET expires_at = :expires_at"
+	}
+	return set + ", expires_at = :expires_at"
+}
+
+// stampRowExpiry sets the expiry of the line rows a cart write puts
+func stampRowExpiry(writes []types.TransactWriteItem, expiresAt int64) {
+	for _, write := range writes {
+		if write.Put == nil || !strings.HasPrefix(attrString(write.Put.Item, "sk"), cartItemSortPrefix) {
+			continue
+		}
+		if expiresAt == 0 {
+			delete(write.Put.Item, "expires_at")
+		} else {
+			write.Put.Item["expires_at"] = attrInt64(expiresAt)
+		}
+	}
+}
+
+// refreshRowExpiry moves the expiry of every line row and the guard of a
+// cart, and the token row of a guest cart, to cartRowExpiry from now. Each
+// transaction is conditioned on the cart version, so a line added or removed
+// meanwhile fails the refresh rather than being missed; the version itself
+// is not bumped, so a refresh never makes a cart write retry. rows_expire_at
+// is only recorded by the last transaction, once every row has been pushed
+// out.
+func (s *dynamoCartStore) refreshRowExpiry(ctx context.Context, pk string) error {
+	meta, items, err := s.queryCartPartition(ctx, pk)
+	if err != nil {
+		return err
+	}
+	version := dynamoCartVersionFromMeta(meta)
+	expiresAt := cartRowExpiry(version.list, time.Now())
+
+	writes := make([]types.TransactWriteItem, 0, len(items)+1)
+	for _, row := range items {
+		values := map[string]types.AttributeValue{}
+		update := &types.Update{
+			TableName:           aws.String(s.table),
+			Key:                 s.key(pk, attrString(row, "sk")),
+			UpdateExpression:    aws.String(withExpiry("", expiresAt, values)),
+			ConditionExpression: aws.String("attribute_exists(pk)"),
+		}
+		if len(values) > 0 {
+			update.ExpressionAttributeValues = values
+		}
+		writes = append(writes, types.TransactWriteItem{Update: update})
+	}
+
+	// The guard is rewritten whole, which also restores one lost to an
+	// earlier expiry while the cart lived on
+	guardValues := map[string]types.AttributeValue{":pk": &types.AttributeValueMemberS{Value: pk}}
+	writes = append(writes, types.TransactWriteItem{Update: &types.Update{
+		TableName:                 aws.String(s.table),
+		Key:                       s.key(customerGuardKey(attrIntValue(meta, "customer_id")), listGuardSortKey(version.list)),
+		UpdateExpression:          aws.String(withExpiry("SET cart_pk = :pk", expiresAt, guardValues)),
+		ConditionExpression:       aws.String("attribute_not_exists(pk) OR cart_pk = :pk"),
+		ExpressionAttributeValues: guardValues,
+	}})
+	if update := s.guestTokenUpdate(meta, expiresAt); update != nil {
+		writes = append(writes, types.TransactWriteItem{Update: update})
+	}
+
+	for len(writes) > 0 {
+		n := min(len(writes), maxTransactItems-1)
+		var metaOp types.TransactWriteItem
+		condition, values := versionCondition(version.version)
+		if n < len(writes) {
+			metaOp.ConditionCheck = &types.ConditionCheck{
+				TableName:                 aws.String(s.table),
+				Key:                       s.key(pk, cartMetaSortKey),
+				ConditionExpression:       aws.String(condition),
+				ExpressionAttributeValues: values,
+			}
+		} else {
+			update := "REMOVE rows_expire_at"
+			if expiresAt != 0 {
+				update = "SET rows_expire_at = :rows_expire_at"
+				if values == nil {
+					values = map[string]types.AttributeValue{}
+				}
+				values[":rows_expire_at"] = attrInt64(expiresAt)
+			}
+			metaOp.Update = &types.Update{
+				TableName:                 aws.String(s.table),
+				Key:                       s.key(pk, cartMetaSortKey),
+				UpdateExpression:          aws.String(update),
+				ConditionExpression:       aws.String(condition),
+				ExpressionAttributeValues: values,
+			}
+		}
+
+		chunk := append([]types.TransactWriteItem{metaOp}, writes[:n]...)
+		if _, err := s.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: chunk}); err != nil {
+			return fmt.Errorf("refreshing expiry of cart %s: %w", pk, err)
+		}
+		writes = writes[n:]
+	}
+	return nil
+}
+
+// dropStaleGuard deletes a customer's guard row if the cart it points at is
+// gone, which happens when the cart's META row expired first. It reports
+// whether it deleted the guard.
+func (s *dynamoCartStore) dropStaleGuard(ctx context.Context, customerID int, list ListType) (bool, error) {
+	guard, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(s.table),
+		Key:            s.key(customerGuardKey(customerID), listGuardSortKey(list)),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return false, fmt.Errorf("reading customer guard: %w", err)
+	}
+	if guard.Item == nil {
+		return false, nil
+	}
+	pk := attrString(guard.Item, "cart_pk")
+	meta, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(s.table),
+		Key:            s.key(pk, cartMetaSortKey),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return false, fmt.Errorf("reading cart header: %w", err)
+	}
+	if meta.Item != nil {
+		return false, nil
+	}
+
+	_, err = s.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:           aws.String(s.table),
+		Key:                 s.key(customerGuardKey(customerID), listGuardSortKey(list)),
+		ConditionExpression: aws.String("cart_pk = :pk"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pk": &types.AttributeValueMemberS{Value: pk},
+		},
+	})
+	if isWriteConflict(err) {
+		// Someone else replaced the guard already
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("deleting stale customer guard: %w", err)
+	}
+	return true, nil
+}
@@ -0,0 +1,884 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
+)
+
+// Single-table layout: every list is one partition (pk = CART#<cart_id>)
+// holding a META row with the list header and one ITEM#<product_id> row per
+// line. Only META rows carry customer_id, so customer_id-index stays sparse.
+// META records the list's type as list_type; rows without one are carts.
+const (
+	cartPartitionPrefix = "CART#"
+	cartMetaSortKey     = "META"
+	cartItemSortPrefix  = "ITEM#"
+
+	// A guard row (pk = CUSTOMER#<customer_id>, sk = CART) points at the
+	// customer's cart and makes the cart unique per customer. Every other
+	// list type has its own guard, sk = LIST#<type>.
+	customerGuardPrefix  = "CUSTOMER#"
+	customerGuardSortKey = "CART"
+	listGuardSortPrefix  = "LIST#"
+
+	// maxTransactItems is DynamoDB's limit on operations per TransactWriteItems
+	maxTransactItems = 100
+)
+
+// dynamoCartStore keeps carts in the single-table layout described above
+type dynamoCartStore struct {
+	client *dynamodb.Client
+	table  string
+}
+
+// NewDynamoDBCartStore returns a CartStore backed by the carts table
+func NewDynamoDBCartStore(client *dynamodb.Client, table string) CartStore {
+	return &dynamoCartStore{client: client, table: table}
+}
+
+func (s *dynamoCartStore) CreateCart(ctx context.Context, customerID int, list ListType) (*ShoppingCart, bool, error) {
+	// Check if the list already exists for this customer
+	existing, err := s.cartFromGuard(ctx, customerID, list)
+	if err == nil {
+		return existing, false, nil
+	}
+	if !errors.Is(err, ErrCartNotFound) {
+		return nil, false, err
+	}
+
+	cart, err := s.insertCart(ctx, customerID, list, "")
+	if isWriteConflict(err) {
+		// Another request created this customer's list first; return that one
+		cart, err := s.cartFromGuard(ctx, customerID, list)
+		if errors.Is(err, ErrCartNotFound) {
+			// Or the guard belongs to a cart that expired before it did
+			dropped, dropErr := s.dropStaleGuard(ctx, customerID, list)
+			if dropErr != nil {
+				return nil, false, dropErr
+			}
+			if dropped {
+				return s.CreateCart(ctx, customerID, list)
+			}
+		}
+		return cart, false, err
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("creating shopping cart: %w", err)
+	}
+	return cart, true, nil
+}
+
+// insertCart writes the header and guard of a new, empty list, plus the
+// token row of a guest cart when guestToken is set. A write conflict means
+// the customer already has a list of the type.
+func (s *dynamoCartStore) insertCart(ctx context.Context, customerID int, list ListType, guestToken string) (*ShoppingCart, error) {
+	// Generate UUID for the cart partition
+	pk := cartPartitionPrefix + uuid.New().String()
+	// Numeric ID returned by the API, unique and increasing across tasks
+	cartIDInt, err := nextID(ctx, s.client, s.table, cartCounter)
+	if err != nil {
+		return nil, err
+	}
+
+	// The GSI can't enforce one list of a type per customer, so the header
+	// is written together with a guard row keyed by customer ID and type. Of
+	// two concurrent creates only one transaction can insert the guard.
+	created := time.Now()
+	now := created.Format(time.RFC3339)
+	guard := map[string]types.AttributeValue{
+		"pk":      &types.AttributeValueMemberS{Value: customerGuardKey(customerID)},
+		"sk":      &types.AttributeValueMemberS{Value: listGuardSortKey(list)},
+		"cart_pk": &types.AttributeValueMemberS{Value: pk},
+	}
+	meta := map[string]types.AttributeValue{
+		"pk":          &types.AttributeValueMemberS{Value: pk},
+		"sk":          &types.AttributeValueMemberS{Value: cartMetaSortKey},
+		"cart_id":     &types.AttributeValueMemberS{Value: strings.TrimPrefix(pk, cartPartitionPrefix)},
+		"numeric_id":  attrInt(cartIDInt),
+		"customer_id": attrInt(customerID),
+		"list_type":   &types.AttributeValueMemberS{Value: string(list)},
+		"version":     attrInt(1),
+		"created_at":  &types.AttributeValueMemberS{Value: now},
+		"updated_at":  &types.AttributeValueMemberS{Value: now},
+	}
+	rows := []map[string]types.AttributeValue{guard}
+	if guestToken != "" {
+		// META remembers the token, so the token row's expiry is kept up
+		// with the cart's other rows
+		meta["guest_token"] = &types.AttributeValueMemberS{Value: guestToken}
+		rows = append(rows, map[string]types.AttributeValue{
+			"pk":       &types.AttributeValueMemberS{Value: guestTokenKey(guestToken)},
+			"sk":       &types.AttributeValueMemberS{Value: guestTokenSortKey},
+			"guest_id": attrInt(customerID),
+		})
+	}
+	if expiresAt := cartRowExpiry(list, created); expiresAt != 0 {
+		for _, row := range rows {
+			row["expires_at"] = attrInt64(expiresAt)
+		}
+		meta["expires_at"] = attrInt64(cartMetaExpiry(list, created))
+		meta["rows_expire_at"] = attrInt64(expiresAt)
+	}
+	rows = append(rows, meta)
+
+	writes := make([]types.TransactWriteItem, len(rows))
+	for i, row := range rows {
+		writes[i] = types.TransactWriteItem{Put: &types.Put{
+			TableName:           aws.String(s.table),
+			Item:                row,
+			ConditionExpression: aws.String("attribute_not_exists(pk)"),
+		}}
+	}
+	if _, err := s.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: writes}); err != nil {
+		return nil, err
+	}
+
+	return &ShoppingCart{
+		ID:         cartIDInt,
+		CustomerID: customerID,
+		Type:       list,
+		Items:      []CartItem{},
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}, nil
+}
+
+// cartFromGuard reads the header of a customer's list through the guard row,
+// with consistent reads so a list created a moment ago is always found
+func (s *dynamoCartStore) cartFromGuard(ctx context.Context, customerID int, list ListType) (*ShoppingCart, error) {
+	pk, err := s.cartPartitionForCustomer(ctx, customerID, list)
+	if err != nil {
+		return nil, err
+	}
+
+	meta, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(s.table),
+		Key:            s.key(pk, cartMetaSortKey),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading cart header: %w", err)
+	}
+	if meta.Item == nil {
+		return nil, ErrCartNotFound
+	}
+	cart := dynamoCartFromMeta(meta.Item)
+	return &cart, nil
+}
+
+func (s *dynamoCartStore) GetCartByCustomer(ctx context.Context, customerID int, list ListType) (*ShoppingCart, error) {
+	pk, err := s.cartPartitionForCustomer(ctx, customerID, list)
+	if err != nil {
+		return nil, err
+	}
+	return s.readCart(ctx, pk)
+}
+
+func (s *dynamoCartStore) ListCarts(ctx context.Context, customerID int) ([]ShoppingCart, error) {
+	metas, err := s.queryListsByCustomer(ctx, customerID)
+	if err != nil {
+		return nil, fmt.Errorf("querying lists: %w", err)
+	}
+
+	carts := []ShoppingCart{}
+	for _, meta := range metas {
+		cart, err := s.readCart(ctx, attrString(meta, "pk"))
+		if errors.Is(err, ErrCartNotFound) {
+			// Deleted since the index was read
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		carts = append(carts, *cart)
+	}
+	sort.Slice(carts, func(i, j int) bool { return carts[i].ID < carts[j].ID })
+	return carts, nil
+}
+
+// readCart reads a whole list with its lines
+func (s *dynamoCartStore) readCart(ctx context.Context, pk string) (*ShoppingCart, error) {
+	meta, items, err := s.queryCartPartition(ctx, pk)
+	if err != nil {
+		return nil, err
+	}
+
+	cart := dynamoCartFromMeta(meta)
+	for _, row := range items {
+		// Rows hold the price from when the line was added; report the
+		// current one next to it, like the MySQL join does
+		item := dynamoCartItemFromMap(row)
+		item.fillFromCatalog()
+		cart.Items = append(cart.Items, item)
+	}
+	// Newest first, like the MySQL query
+	sort.Slice(cart.Items, func(i, j int) bool {
+		return cart.Items[i].ID > cart.Items[j].ID
+	})
+	return &cart, nil
+}
+
+func (s *dynamoCartStore) UpsertItem(ctx context.Context, customerID int, list ListType, productID, quantity int) (*CartItem, bool, error) {
+	pk, err := s.cartPartitionForCustomer(ctx, customerID, list)
+	if err != nil {
+		return nil, false, err
+	}
+
+	product, err := lookupProduct(ctx, productID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var newItem map[string]types.AttributeValue
+	var created bool
+	_, err = s.versionedWrite(ctx, pk, func(now string) (*dynamoCartVersion, []types.TransactWriteItem, error) {
+		version, existing, err := s.getMetaAndItem(ctx, pk, productID)
+		if err != nil {
+			return nil, nil, err
+		}
+		created = existing == nil
+
+		newItem = map[string]types.AttributeValue{
+			"pk":           &types.AttributeValueMemberS{Value: pk},
+			"sk":           &types.AttributeValueMemberS{Value: cartItemSortKey(productID)},
+			"product_id":   attrInt(productID),
+			"quantity":     attrInt(quantity),
+			"manufacturer": &types.AttributeValueMemberS{Value: product.Manufacturer},
+			"category":     &types.AttributeValueMemberS{Value: product.Category},
+			"currency":     &types.AttributeValueMemberS{Value: product.Currency},
+			"weight":       attrFloat(product.Weight),
+			"updated_at":   &types.AttributeValueMemberS{Value: now},
+			// Adding a product again records its current price
+			"unit_price_at_add": attrInt64(product.Price),
+		}
+		writes := []types.TransactWriteItem{{
+			Put: &types.Put{TableName: aws.String(s.table), Item: newItem},
+		}}
+		if created {
+			// New item - take the next line ID from the cart header
+			version.nextItemID++
+			newItem["id"] = attrInt(version.nextItemID)
+			newItem["created_at"] = &types.AttributeValueMemberS{Value: now}
+
+			// A product being deleted gets no new lines
+			retired, err := s.productRetired(ctx, productID)
+			if err != nil {
+				return nil, nil, err
+			}
+			if retired {
+				return nil, nil, ErrProductNotFound
+			}
+			writes = append(writes, s.notRetiredCheck(productID))
+		} else {
+			// Preserve existing id and created_at
+			newItem["id"] = existing["id"]
+			newItem["created_at"] = existing["created_at"]
+		}
+
+		return version, writes, nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	responseItem := dynamoCartItemFromMap(newItem)
+	return &responseItem, created, nil
+}
+
+func (s *dynamoCartStore) UpdateItemQuantity(ctx context.Context, customerID int, list ListType, productID int, update QuantityUpdate) (*CartItem, error) {
+	pk, err := s.cartPartitionForCustomer(ctx, customerID, list)
+	if err != nil {
+		return nil, err
+	}
+
+	var updated map[string]types.AttributeValue
+	_, err = s.versionedWrite(ctx, pk, func(now string) (*dynamoCartVersion, []types.TransactWriteItem, error) {
+		version, existing, err := s.getMetaAndItem(ctx, pk, productID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if existing == nil {
+			return nil, nil, ErrItemNotFound
+		}
+
+		next, err := update.apply(attrIntValue(existing, "quantity"))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		updated = existing
+		updated["quantity"] = attrInt(next)
+		updated["updated_at"] = &types.AttributeValueMemberS{Value: now}
+
+		if next == 0 {
+			return version, []types.TransactWriteItem{s.deleteRow(pk, cartItemSortKey(productID))}, nil
+		}
+		return version, []types.TransactWriteItem{{
+			Put: &types.Put{TableName: aws.String(s.table), Item: updated},
+		}}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	item := dynamoCartItemFromMap(updated)
+	item.fillFromCatalog()
+	return &item, nil
+}
+
+func (s *dynamoCartStore) RemoveItem(ctx context.Context, customerID int, list ListType, productID int) error {
+	pk, err := s.cartPartitionForCustomer(ctx, customerID, list)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.versionedWrite(ctx, pk, func(now string) (*dynamoCartVersion, []types.TransactWriteItem, error) {
+		version, existing, err := s.getMetaAndItem(ctx, pk, productID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if existing == nil {
+			return nil, nil, ErrItemNotFound
+		}
+		return version, []types.TransactWriteItem{s.deleteRow(pk, cartItemSortKey(productID))}, nil
+	})
+	return err
+}
+
+func (s *dynamoCartStore) ClearCart(ctx context.Context, customerID int, list ListType) error {
+	pk, err := s.cartPartitionForCustomer(ctx, customerID, list)
+	if err != nil {
+		return err
+	}
+	_, err = s.clearPartition(ctx, pk)
+	return err
+}
+
+func (s *dynamoCartStore) DeleteCart(ctx context.Context, customerID int, list ListType) error {
+	pk, err := s.cartPartitionForCustomer(ctx, customerID, list)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		// Remove the ITEM# rows first, then the META row, as long as no
+		// other writer touched the cart in between
+		version, err := s.clearPartition(ctx, pk)
+		if err != nil {
+			return err
+		}
+
+		// Drop the customer guard with the header so the customer can start a new list
+		_, err = s.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+			TransactItems: []types.TransactWriteItem{
+				{Delete: &types.Delete{
+					TableName:           aws.String(s.table),
+					Key:                 s.key(pk, cartMetaSortKey),
+					ConditionExpression: aws.String("version = :version"),
+					ExpressionAttributeValues: map[string]types.AttributeValue{
+						":version": attrInt(version),
+					},
+				}},
+				{Delete: &types.Delete{
+					TableName:           aws.String(s.table),
+					Key:                 s.key(customerGuardKey(customerID), listGuardSortKey(list)),
+					ConditionExpression: aws.String("attribute_not_exists(pk) OR cart_pk = :pk"),
+					ExpressionAttributeValues: map[string]types.AttributeValue{
+						":pk": &types.AttributeValueMemberS{Value: pk},
+					},
+				}},
+			},
+		})
+		if err == nil {
+			return nil
+		}
+		if !isWriteConflict(err) {
+			return fmt.Errorf("deleting cart: %w", err)
+		}
+		if err := s.backoff(ctx, pk, attempt); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *dynamoCartStore) MoveItem(ctx context.Context, customerID int, from, to ListType, productID int) (*CartItem, error) {
+	fromPK, err := s.cartPartitionForCustomer(ctx, customerID, from)
+	if err != nil {
+		return nil, err
+	}
+	toPK, err := s.cartPartitionForCustomer(ctx, customerID, to)
+	if err != nil {
+		return nil, err
+	}
+
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		now := start.Format(time.RFC3339)
+		fromVersion, line, err := s.getMetaAndItem(ctx, fromPK, productID)
+		if err != nil {
+			return nil, err
+		}
+		if line == nil {
+			return nil, ErrItemNotFound
+		}
+		toVersion, existing, err := s.getMetaAndItem(ctx, toPK, productID)
+		if err != nil {
+			return nil, err
+		}
+
+		// Both headers are conditioned on the versions read, so the move
+		// fails as a whole if either list changed in between
+		row := mergeRow(toPK, toVersion, existing, line, MergeSum, now)
+		writes := []types.TransactWriteItem{
+			{Put: &types.Put{TableName: aws.String(s.table), Item: row}},
+			s.deleteRow(fromPK, cartItemSortKey(productID)),
+		}
+		stampRowExpiry(writes, cartRowExpiry(to, start))
+		writes = append(writes,
+			s.metaUpdate(fromPK, fromVersion.version, fromVersion, now),
+			s.metaUpdate(toPK, toVersion.version, toVersion, now))
+
+		_, err = s.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: writes})
+		if err == nil {
+			for pk, version := range map[string]*dynamoCartVersion{fromPK: fromVersion, toPK: toVersion} {
+				if rowExpiryStale(version.list, version.rowsExpireAt, start) {
+					if err := s.refreshRowExpiry(ctx, pk); err != nil {
+						log.Printf("Error refreshing cart row expiry: %v", err)
+					}
+				}
+			}
+			item := dynamoCartItemFromMap(row)
+			item.fillFromCatalog()
+			return &item, nil
+		}
+		if !isWriteConflict(err) {
+			return nil, fmt.Errorf("moving cart item: %w", err)
+		}
+		if err := s.backoff(ctx, toPK, attempt); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// mergeRow builds the row a line from another list becomes in the list at
+// pk. If that list already has a line for the product, existing, the two are
+// combined by rule; otherwise the line moves over and takes the list's next
+// line ID from version.
+func mergeRow(pk string, version *dynamoCartVersion, existing, line map[string]types.AttributeValue,
+	rule MergeRule, now string) map[string]types.AttributeValue {
+	var row map[string]types.AttributeValue
+	if existing != nil {
+		merged := rule.merge(dynamoCartItemFromMap(existing), dynamoCartItemFromMap(line))
+		row = maps.Clone(existing)
+		row["quantity"] = attrInt(merged.Quantity)
+		delete(row, "unit_price_at_add")
+		if merged.UnitPriceAtAdd != nil {
+			row["unit_price_at_add"] = attrInt64(*merged.UnitPriceAtAdd)
+		}
+	} else {
+		row = maps.Clone(line)
+		row["pk"] = &types.AttributeValueMemberS{Value: pk}
+		version.nextItemID++
+		row["id"] = attrInt(version.nextItemID)
+	}
+	row["updated_at"] = &types.AttributeValueMemberS{Value: now}
+	return row
+}
+
+// clearPartition deletes every ITEM# row of a cart and returns the cart
+// version it left behind
+func (s *dynamoCartStore) clearPartition(ctx context.Context, pk string) (int, error) {
+	return s.versionedWrite(ctx, pk, func(now string) (*dynamoCartVersion, []types.TransactWriteItem, error) {
+		meta, items, err := s.queryCartPartition(ctx, pk)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		writes := make([]types.TransactWriteItem, 0, len(items))
+		for _, row := range items {
+			writes = append(writes, s.deleteRow(pk, attrString(row, "sk")))
+		}
+		return dynamoCartVersionFromMeta(meta), writes, nil
+	})
+}
+
+// dynamoCartVersion is the optimistic concurrency state of a cart's META row
+type dynamoCartVersion struct {
+	version    int
+	nextItemID int
+	// list decides whether the cart's rows expire
+	list ListType
+	// rowsExpireAt is the expires_at of the cart's line and guard rows, in
+	// epoch seconds, 0 when they do not expire
+	rowsExpireAt int64
+}
+
+// maxCartWriteAttempts bounds how often versionedWrite retries after losing a
+// race with another writer of the same cart
+const maxCartWriteAttempts = 5
+
+// versionedWrite runs a read-modify-write cycle on one cart. prepare reads
+// whatever it needs and returns the cart version it saw plus the row writes
+// to apply. They are committed together with a META update conditioned on
+// that version, so concurrent writers never overwrite each other's changes;
+// on a conflict the cycle is retried on fresh data. prepare may be called
+// more than once. The cart version after the write is returned.
+func (s *dynamoCartStore) versionedWrite(ctx context.Context, pk string,
+	prepare func(now string) (*dynamoCartVersion, []types.TransactWriteItem, error)) (int, error) {
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		now := start.Format(time.RFC3339)
+		version, writes, err := prepare(now)
+		if err != nil {
+			return 0, err
+		}
+		stampRowExpiry(writes, cartRowExpiry(version.list, start))
+
+		newVersion, err := s.commitVersioned(ctx, pk, version, writes, now)
+		if err == nil {
+			// The write went through either way; a failed refresh is
+			// tried again by the cart's next write
+			if rowExpiryStale(version.list, version.rowsExpireAt, start) {
+				if err := s.refreshRowExpiry(ctx, pk); err != nil {
+					log.Printf("Error refreshing cart row expiry: %v", err)
+				}
+			}
+			return newVersion, nil
+		}
+		if !isWriteConflict(err) {
+			return 0, fmt.Errorf("updating cart: %w", err)
+		}
+		if err := s.backoff(ctx, pk, attempt); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// commitVersioned applies writes in transactions together with the guarded
+// META update. Carts with more lines than fit in one transaction are written
+// in chunks, each guarded by the version the previous chunk left behind.
+func (s *dynamoCartStore) commitVersioned(ctx context.Context, pk string, version *dynamoCartVersion,
+	writes []types.TransactWriteItem, now string) (int, error) {
+	expected := version.version
+	for {
+		n := min(len(writes), maxTransactItems-1)
+		chunk := append([]types.TransactWriteItem{s.metaUpdate(pk, expected, version, now)}, writes[:n]...)
+		if _, err := s.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: chunk}); err != nil {
+			return 0, err
+		}
+		expected++
+		writes = writes[n:]
+		if len(writes) == 0 {
+			return expected, nil
+		}
+	}
+}
+
+// metaUpdate bumps the cart version, guarded by the version the caller read,
+// and records the next line ID of version. Carts created before versioning
+// have no version attribute and count as 0. Every write also restarts the
+// cart's expiry.
+func (s *dynamoCartStore) metaUpdate(pk string, expectedVersion int, version *dynamoCartVersion, now string) types.TransactWriteItem {
+	condition, values := versionCondition(expectedVersion)
+	if values == nil {
+		values = map[string]types.AttributeValue{}
+	}
+	values[":updated_at"] = &types.AttributeValueMemberS{Value: now}
+	values[":next_version"] = attrInt(expectedVersion + 1)
+	values[":next_item_id"] = attrInt(version.nextItemID)
+	update := withExpiry("SET updated_at = :updated_at, version = :next_version, next_item_id = :next_item_id",
+		cartMetaExpiry(version.list, time.Now()), values)
+
+	return types.TransactWriteItem{Update: &types.Update{
+		TableName:                 aws.String(s.table),
+		Key:                       s.key(pk, cartMetaSortKey),
+		UpdateExpression:          aws.String(update),
+		ConditionExpression:       aws.String(condition),
+		ExpressionAttributeValues: values,
+	}}
+}
+
+// versionCondition requires a cart's META row to exist at the expected
+// version. The values are nil when the condition needs none.
+func versionCondition(expectedVersion int) (string, map[string]types.AttributeValue) {
+	if expectedVersion == 0 {
+		return "attribute_exists(pk) AND attribute_not_exists(version)", nil
+	}
+	return "attribute_exists(pk) AND version = :expected_version", map[string]types.AttributeValue{
+		":expected_version": attrInt(expectedVersion),
+	}
+}
+
+func (s *dynamoCartStore) deleteRow(pk, sk string) types.TransactWriteItem {
+	return types.TransactWriteItem{Delete: &types.Delete{
+		TableName: aws.String(s.table),
+		Key:       s.key(pk, sk),
+	}}
+}
+
+// backoff sleeps before the next attempt of a conflicting write, with jitter
+// so the competing writers spread out. It gives up after maxCartWriteAttempts.
+func (s *dynamoCartStore) backoff(ctx context.Context, pk string, attempt int) error {
+	if attempt >= maxCartWriteAttempts {
+		log.Printf("Giving up on cart %s after %d conflicting writes", pk, attempt)
+		return ErrConcurrentModification
+	}
+	backoff := time.Duration(attempt*attempt)*10*time.Millisecond +
+		time.Duration(rand.Intn(10))*time.Millisecond
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(backoff):
+		return nil
+	}
+}
+
+// getMetaAndItem reads a cart's version and one of its lines in a single
+// consistent round trip. The line is nil if the product is not in the cart.
+func (s *dynamoCartStore) getMetaAndItem(ctx context.Context, pk string, productID int) (*dynamoCartVersion, map[string]types.AttributeValue, error) {
+	result, err := s.client.TransactGetItems(ctx, &dynamodb.TransactGetItemsInput{
+		TransactItems: []types.TransactGetItem{
+			{Get: &types.Get{TableName: aws.String(s.table), Key: s.key(pk, cartMetaSortKey)}},
+			{Get: &types.Get{TableName: aws.String(s.table), Key: s.key(pk, cartItemSortKey(productID))}},
+		},
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("getting cart: %w", err)
+	}
+	if len(result.Responses) != 2 || result.Responses[0].Item == nil {
+		return nil, nil, ErrCartNotFound
+	}
+	return dynamoCartVersionFromMeta(result.Responses[0].Item), result.Responses[1].Item, nil
+}
+
+// queryCartPartition reads a whole cart with one consistent Query and splits
+// it into the META row and the ITEM# rows
+func (s *dynamoCartStore) queryCartPartition(ctx context.Context, pk string) (map[string]types.AttributeValue, []map[string]types.AttributeValue, error) {
+	var meta map[string]types.AttributeValue
+	var items []map[string]types.AttributeValue
+
+	paginator := dynamodb.NewQueryPaginator(s.client, &dynamodb.QueryInput{
+		TableName:              aws.String(s.table),
+		KeyConditionExpression: aws.String("pk = :pk"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pk": &types.AttributeValueMemberS{Value: pk},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("querying cart partition: %w", err)
+		}
+		for _, row := range page.Items {
+			sk := attrString(row, "sk")
+			if sk == cartMetaSortKey {
+				meta = row
+			} else if strings.HasPrefix(sk, cartItemSortPrefix) {
+				items = append(items, row)
+			}
+		}
+	}
+
+	if meta == nil {
+		return nil, nil, ErrCartNotFound
+	}
+	return meta, items, nil
+}
+
+// cartPartitionForCustomer resolves the partition key of a customer's list
+// through its guard row. Unlike customer_id-index the guard is read strongly
+// consistently, so a list is found right after it is created and a deleted
+// list is not found, nor its predecessor after a recreate. A guard left by a
+// cart that expired first resolves to a partition without META, which the
+// callers' reads report as ErrCartNotFound.
+func (s *dynamoCartStore) cartPartitionForCustomer(ctx context.Context, customerID int, list ListType) (string, error) {
+	guard, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(s.table),
+		Key:            s.key(customerGuardKey(customerID), listGuardSortKey(list)),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return "", fmt.Errorf("reading customer guard: %w", err)
+	}
+	if guard.Item == nil {
+		return "", ErrCartNotFound
+	}
+	return attrString(guard.Item, "cart_pk"), nil
+}
+
+// queryListsByCustomer finds the META rows of all of a customer's lists
+// through the GSI, for listing only: the index is eventually consistent, so
+// a list created a moment ago may be missing. A customer has one per list
+// type at most.
+func (s *dynamoCartStore) queryListsByCustomer(ctx context.Context, customerID int) ([]map[string]types.AttributeValue, error) {
+	var metas []map[string]types.AttributeValue
+	paginator := dynamodb.NewQueryPaginator(s.client, &dynamodb.QueryInput{
+		TableName:              aws.String(s.table),
+		IndexName:              aws.String(CustomerIDIndexName),
+		KeyConditionExpression: aws.String("customer_id = :customer_id"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":customer_id": attrInt(customerID),
+		},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		metas = append(metas, page.Items...)
+	}
+	return metas, nil
+}
+
+func (s *dynamoCartStore) key(pk, sk string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"pk": &types.AttributeValueMemberS{Value: pk},
+		"sk": &types.AttributeValueMemberS{Value: sk},
+	}
+}
+
+func customerGuardKey(customerID int) string {
+	return customerGuardPrefix + strconv.Itoa(customerID)
+}
+
+func listGuardSortKey(list ListType) string {
+	if list == ListCart {
+		return customerGuardSortKey
+	}
+	return listGuardSortPrefix + string(list)
+}
+
+func cartItemSortKey(productID int) string {
+	return cartItemSortPrefix + strconv.Itoa(productID)
+}
+
+// lookupProduct returns the product details copied onto cart lines,
+// preferring the in-memory catalog and falling back to MySQL
+func lookupProduct(ctx context.Context, productID int) (Item, error) {
+	if value, exists := syncProducts.Load(productID); exists {
+		return value.(Item), nil
+	}
+	if DB == nil {
+		return Item{}, ErrProductNotFound
+	}
+
+	product, err := scanProduct(DB.QueryRowContext(ctx, productColumns+` WHERE id = ? AND deleted_at IS NULL`, productID))
+	if err != nil {
+		log.Printf("Error getting product details for %d: %v", productID, err)
+		return Item{}, ErrProductNotFound
+	}
+	return product, nil
+}
+
+func dynamoCartVersionFromMeta(meta map[string]types.AttributeValue) *dynamoCartVersion {
+	return &dynamoCartVersion{
+		version:      attrIntValue(meta, "version"),
+		nextItemID:   attrIntValue(meta, "next_item_id"),
+		list:         listTypeFromMeta(meta),
+		rowsExpireAt: attrInt64Value(meta, "rows_expire_at"),
+	}
+}
+
+// listTypeFromMeta reads a META row's list type. Rows written before there
+// were other lists have none and are carts.
+func listTypeFromMeta(meta map[string]types.AttributeValue) ListType {
+	if list := attrString(meta, "list_type"); list != "" {
+		return ListType(list)
+	}
+	return ListCart
+}
+
+// dynamoCartFromMeta converts a META row into the API representation, without items
+func dynamoCartFromMeta(meta map[string]types.AttributeValue) ShoppingCart {
+	return ShoppingCart{
+		ID:         attrIntValue(meta, "numeric_id"),
+		CustomerID: attrIntValue(meta, "customer_id"),
+		Type:       listTypeFromMeta(meta),
+		CreatedAt:  attrString(meta, "created_at"),
+		UpdatedAt:  attrString(meta, "updated_at"),
+		Items:      []CartItem{},
+	}
+}
+
+// dynamoCartItemFromMap converts an ITEM# row, or an entry of the legacy cart_items list
+func dynamoCartItemFromMap(m map[string]types.AttributeValue) CartItem {
+	item := CartItem{
+		ID:           attrIntValue(m, "id"),
+		ProductID:    attrIntValue(m, "product_id"),
+		Manufacturer: attrString(m, "manufacturer"),
+		Category:     attrString(m, "category"),
+		Quantity:     attrIntValue(m, "quantity"),
+		Currency:     attrString(m, "currency"),
+		Weight:       attrFloatValue(m, "weight"),
+		CreatedAt:    attrString(m, "created_at"),
+		UpdatedAt:    attrString(m, "updated_at"),
+	}
+	// Lines written before prices were recorded have no snapshot
+	if _, ok := m["unit_price_at_add"]; ok {
+		price := attrInt64Value(m, "unit_price_at_add")
+		item.UnitPrice = price
+		item.UnitPriceAtAdd = &price
+	}
+	return item
+}
+
+func attrInt(v int) types.AttributeValue {
+	return &types.AttributeValueMemberN{Value: strconv.Itoa(v)}
+}
+
+// attrIntValue reads a numeric attribute, returning 0 when absent
+func attrIntValue(m map[string]types.AttributeValue, name string) int {
+	if member, ok := m[name].(*types.AttributeValueMemberN); ok {
+		v, _ := strconv.Atoi(member.Value)
+		return v
+	}
+	return 0
+}
+
+func attrInt64(v int64) types.AttributeValue {
+	return &types.AttributeValueMemberN{Value: strconv.FormatInt(v, 10)}
+}
+
+// attrInt64Value reads a numeric attribute as int64, returning 0 when absent
+func attrInt64Value(m map[string]types.AttributeValue, name string) int64 {
+	if member, ok := m[name].(*types.AttributeValueMemberN); ok {
+		v, _ := strconv.ParseInt(member.Value, 10, 64)
+		return v
+	}
+	return 0
+}
+
+func attrFloat(v float64) types.AttributeValue {
+	return &types.AttributeValueMemberN{Value: strconv.FormatFloat(v, 'f', -1, 64)}
+}
+
+// attrFloatValue reads a numeric attribute as float64, returning 0 when absent
+func attrFloatValue(m map[string]types.AttributeValue, name string) float64 {
+	if member, ok := m[name].(*types.AttributeValueMemberN); ok {
+		v, _ := strconv.ParseFloat(member.Value, 64)
+		return v
+	}
+	return 0
+}
+
+// attrString reads a string attribute, returning "" when absent
+func attrString(m map[string]types.AttributeValue, name string) string {
+	if member, ok := m[name].(*types.AttributeValueMemberS); ok {
+		return member.Value
+	}
+	return ""
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestDynamoCartRows(t *testing.T) {
+	if got := cartItemSortKey(42); got != "ITEM#42" {
+		t.Errorf("cartItemSortKey(42) = %q, want ITEM#42", got)
+	}
+
+	meta := map[string]types.AttributeValue{
+		"numeric_id":   attrInt(7),
+		"customer_id":  attrInt(3),
+		"version":      attrInt(4),
+		"next_item_id": attrInt(9),
+		"created_at":   &types.AttributeValueMemberS{Value: "2024-01-01T00:00:00Z"},
+	}
+	cart := dynamoCartFromMeta(meta)
+	if cart.ID != 7 || cart.CustomerID != 3 || cart.CreatedAt != "2024-01-01T00:00:00Z" || cart.UpdatedAt != "" {
+		t.Errorf("dynamoCartFromMeta = %+v", cart)
+	}
+	if cart.Items == nil {
+		t.Error("dynamoCartFromMeta left Items nil, want an empty list")
+	}
+	if v := dynamoCartVersionFromMeta(meta); v.version != 4 || v.nextItemID != 9 {
+		t.Errorf("dynamoCartVersionFromMeta = %+v, want version 4, next item 9", *v)
+	}
+
+	row := map[string]types.AttributeValue{
+		"id":           attrInt(2),
+		"product_id":   attrInt(42),
+		"quantity":     attrInt(5),
+		"manufacturer": &types.AttributeValueMemberS{Value: "Acme"},
+		"category":     &types.AttributeValueMemberS{Value: "Tools"},
+	}
+	item := dynamoCartItemFromMap(row)
+	if item.ID != 2 || item.ProductID != 42 || item.Quantity != 5 || item.Manufacturer != "Acme" || item.Category != "Tools" {
+		t.Errorf("dynamoCartItemFromMap = %+v", item)
+	}
+
+	// A wrongly typed attribute reads as absent
+	if got := attrIntValue(map[string]types.AttributeValue{"quantity": &types.AttributeValueMemberS{Value: "5"}}, "quantity"); got != 0 {
+		t.Errorf("attrIntValue of a string attribute = %d, want 0", got)
+	}
+}
+
+func TestDynamoCheckoutRefreshesRowExpiry(t *testing.T) {
+	defer func(ttl time.Duration) { cartTTL = ttl }(cartTTL)
+	cartTTL = 24 * time.Hour
+	syncProducts.Store(999998, Item{ID: 999998, Price: 500, Currency: defaultCurrency})
+	defer syncProducts.Delete(999998)
+
+	// The cart's rows expire within the hour, before the META row checkout
+	// pushes out to a day from now
+	rowsExpireAt := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	var transactions []string
+	client := newFakeDynamoClient(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		switch target := r.Header.Get("X-Amz-Target"); {
+		case strings.HasSuffix(target, ".GetItem"):
+			io.WriteString(w, `{"Item":{"pk":{"S":"CUSTOMER#5"},"sk":{"S":"CART"},"cart_pk":{"S":"CART#c"}}}`)
+		case strings.HasSuffix(target, ".Query"):
+			io.WriteString(w, `{"Items":[{"pk":{"S":"CART#c"},"sk":{"S":"META"},"numeric_id":{"N":"100000001"},"customer_id":{"N":"5"},`+
+				`"version":{"N":"3"},"next_item_id":{"N":"2"},"rows_expire_at":{"N":"`+rowsExpireAt+`"}},`+
+				`{"pk":{"S":"CART#c"},"sk":{"S":"ITEM#999998"},"id":{"N":"1"},"product_id":{"N":"999998"},"quantity":{"N":"1"}}]}`)
+		case strings.HasSuffix(target, ".TransactGetItems"):
+			// The product's stock is not tracked
+			io.WriteString(w, `{"Responses":[{},{}]}`)
+		case strings.HasSuffix(target, ".UpdateItem"):
+			io.WriteString(w, `{"Attributes":{"next_id":{"N":"7"}}}`)
+		case strings.HasSuffix(target, ".TransactWriteItems"):
+			transactions = append(transactions, string(body))
+			io.WriteString(w, `{}`)
+		default:
+			t.Errorf("unexpected call %s: %s", target, body)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+
+	store := NewDynamoDBOrderStore(client, "carts")
+	if _, err := store.Checkout(context.Background(), 5, false); err != nil {
+		t.Fatalf("Checkout: %v", err)
+	}
+	// The checkout itself, then the refresh that rewrites the guard
+	if len(transactions) != 2 || !strings.Contains(transactions[1], `"CUSTOMER#5"`) ||
+		!strings.Contains(transactions[1], "expires_at = :expires_at") {
+		t.Errorf("transactions = %v, want the checkout followed by a refresh of the guard expiry", transactions)
+	}
+}
+
+func TestDynamoCreateCartLosesRace(t *testing.T) {
+	// The index has not caught up with the other request's cart yet, so this
+	// create gets as far as the transaction and loses on the guard row
+	client := newFakeDynamoClient(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		switch target := r.Header.Get("X-Amz-Target"); {
+		case strings.HasSuffix(target, ".Query"):
+			io.WriteString(w, `{"Items":[]}`)
+		case strings.HasSuffix(target, ".UpdateItem"):
+			io.WriteString(w, `{"Attributes":{"next_id":{"N":"100000002"}}}`)
+		case strings.HasSuffix(target, ".TransactWriteItems"):
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"__type":"com.amazonaws.dynamodb.v20120810#TransactionCanceledException",`+
+				`"message":"Transaction cancelled","CancellationReasons":[{"Code":"ConditionalCheckFailed"},{"Code":"None"}]}`)
+		case strings.HasSuffix(target, ".GetItem") && strings.Contains(string(body), `"CUSTOMER#5"`):
+			io.WriteString(w, `{"Item":{"pk":{"S":"CUSTOMER#5"},"sk":{"S":"CART"},"cart_pk":{"S":"CART#first"}}}`)
+		case strings.HasSuffix(target, ".GetItem") && strings.Contains(string(body), `"CART#first"`):
+			io.WriteString(w, `{"Item":{"pk":{"S":"CART#first"},"sk":{"S":"META"},"numeric_id":{"N":"100000001"},"customer_id":{"N":"5"}}}`)
+		default:
+			t.Errorf("unexpected call %s: %s", target, body)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+
+	store := NewDynamoDBCartStore(client, "carts")
+	cart, created, err := store.CreateCart(context.Background(), 5, ListCart)
+	if err != nil {
+		t.Fatalf("CreateCart: %v", err)
+	}
+	if created || cart.ID != 100000001 || cart.CustomerID != 5 {
+		t.Errorf("CreateCart = cart %d for customer %d, created %v; want the existing cart 100000001, not created", cart.ID, cart.CustomerID, created)
+	}
+}
+
+func TestDynamoContainsProduct(t *testing.T) {
+	defer func(lag time.Duration) { productIndexLag = lag }(productIndexLag)
+	productIndexLag = 0
+
+	// product_id-index lists a line of an expired cart, one of a cart whose
+	// line is already gone, and one of a live cart
+	expired := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	carts := map[string]string{
+		"CART#expired": `{"Responses":[{"Item":{"pk":{"S":"CART#expired"},"sk":{"S":"META"},"expires_at":{"N":"` + expired + `"}}},{"Item":{"pk":{"S":"CART#expired"},"sk":{"S":"ITEM#42"}}}]}`,
+		"CART#removed": `{"Responses":[{"Item":{"pk":{"S":"CART#removed"},"sk":{"S":"META"}}},{}]}`,
+		"CART#live":    `{"Responses":[{"Item":{"pk":{"S":"CART#live"},"sk":{"S":"META"}}},{"Item":{"pk":{"S":"CART#live"},"sk":{"S":"ITEM#42"}}}]}`,
+	}
+	newStore := func(hits ...string) (*dynamoCartStore, *[]string) {
+		var calls []string
+		client := newFakeDynamoClient(t, func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			target := r.Header.Get("X-Amz-Target")
+			calls = append(calls, target[strings.LastIndex(target, ".")+1:])
+			w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+			switch {
+			case strings.HasSuffix(target, ".PutItem"), strings.HasSuffix(target, ".DeleteItem"):
+				if !strings.Contains(string(body), `"PRODUCT#42"`) {
+					t.Errorf("%s of %s, want the retirement row", target, body)
+				}
+				io.WriteString(w, `{}`)
+			case strings.HasSuffix(target, ".Query"):
+				var items []string
+				for _, pk := range hits {
+					items = append(items, `{"pk":{"S":"`+pk+`"},"sk":{"S":"ITEM#42"},"product_id":{"N":"42"}}`)
+				}
+				io.WriteString(w, `{"Items":[`+strings.Join(items, ",")+`]}`)
+			case strings.HasSuffix(target, ".TransactGetItems"):
+				for pk, response := range carts {
+					if strings.Contains(string(body), `"`+pk+`"`) {
+						io.WriteString(w, response)
+						return
+					}
+				}
+				t.Errorf("unexpected read %s", body)
+			default:
+				t.Errorf("unexpected call %s: %s", target, body)
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		})
+		return &dynamoCartStore{client: client, table: "carts"}, &calls
+	}
+
+	// Dead lines don't hold the product, and it stays retired for the delete
+	store, calls := newStore("CART#expired", "CART#removed")
+	held, release, err := store.containsProduct(context.Background(), 42)
+	if err != nil || held || release == nil {
+		t.Fatalf("containsProduct with dead lines = %v, %v; want false and a release", held, err)
+	}
+	if strings.Join(*calls, ",") != "PutItem,Query,TransactGetItems,TransactGetItems" {
+		t.Errorf("calls = %v, want the retirement written and kept", *calls)
+	}
+	// Until a failed delete releases it
+	release()
+	if last := (*calls)[len(*calls)-1]; last != "DeleteItem" {
+		t.Errorf("calls = %v, want the retirement deleted on release", *calls)
+	}
+
+	// A live line does, and the retirement is lifted again
+	store, calls = newStore("CART#expired", "CART#live")
+	if held, _, err := store.containsProduct(context.Background(), 42); err != nil || !held {
+		t.Errorf("containsProduct with a live line = %v, %v; want true", held, err)
+	}
+	if last := (*calls)[len(*calls)-1]; last != "DeleteItem" {
+		t.Errorf("calls = %v, want the retirement deleted last", *calls)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Counter rows live in the carts table next to the carts themselves. They
+// have no customer_id, so they never show up in customer_id-index.
+const (
+	counterPartitionPrefix = "COUNTER#"
+	counterSortKey         = "COUNTER"
+
+	// cartCounter allocates ShoppingCart.ID values
+	cartCounter = "cart"
+
+	// orderCounter allocates Order.ID values
+	orderCounter = "order"
+
+	// guestCounter allocates guest customer IDs, which are its values negated
+	guestCounter = "guest"
+
+	// counterBase keeps allocated IDs clear of the numeric_id values that
+	// earlier versions derived from time.Now().UnixNano() % 100000000
+	counterBase = 100000000
+)
+
+// nextID atomically allocates the next value of a named counter. Values are
+// unique and strictly increasing per counter, across all tasks.
+func nextID(ctx context.Context, client *dynamodb.Client, table, counter string) (int, error) {
+	result, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(table),
+		Key: map[string]types.AttributeValue{
+			"pk": &types.AttributeValueMemberS{Value: counterPartitionPrefix + counter},
+			"sk": &types.AttributeValueMemberS{Value: counterSortKey},
+		},
+		UpdateExpression: aws.String("SET next_id = if_not_exists(next_id, :base) + :one"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":base": attrInt(counterBase),
+			":one":  attrInt(1),
+		},
+		ReturnValues: types.ReturnValueUpdatedNew,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("allocating %s id: %w", counter, err)
+	}
+
+	member, ok := result.Attributes["next_id"].(*types.AttributeValueMemberN)
+	if !ok {
+		return 0, fmt.Errorf("allocating %s id: next_id missing from response", counter)
+	}
+	id, err := strconv.Atoi(member.Value)
+	if err != nil {
+		return 0, fmt.Errorf("allocating %s id: %w", counter, err)
+	}
+	return id, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+// newFakeDynamoClient returns a client that sends every call to handler
+// instead of AWS. handler sees the JSON request body and the X-Amz-Target
+// operation name.
+func newFakeDynamoClient(t *testing.T, handler http.HandlerFunc) *dynamodb.Client {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return dynamodb.New(dynamodb.Options{
+		Region:           "us-east-1",
+		BaseEndpoint:     aws.String(server.URL),
+		Credentials:      aws.AnonymousCredentials{},
+		RetryMaxAttempts: 1,
+	})
+}
+
+func TestNextID(t *testing.T) {
+	var request map[string]any
+	client := newFakeDynamoClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if target := r.Header.Get("X-Amz-Target"); !strings.HasSuffix(target, ".UpdateItem") {
+			t.Errorf("operation = %q, want UpdateItem", target)
+		}
+		body, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &request); err != nil {
+			t.Errorf("decoding request: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		io.WriteString(w, `{"Attributes":{"next_id":{"N":"100000001"}}}`)
+	})
+
+	id, err := nextID(context.Background(), client, "carts", cartCounter)
+	if err != nil {
+		t.Fatalf("nextID: %v", err)
+	}
+	if id != counterBase+1 {
+		t.Errorf("nextID = %d, want %d", id, counterBase+1)
+	}
+	key, _ := json.Marshal(request["Key"])
+	if want := `{"pk":{"S":"COUNTER#cart"},"sk":{"S":"COUNTER"}}`; string(key) != want {
+		t.Errorf("counter key = %s, want %s", key, want)
+	}
+}
+
+func TestNextIDMissingAttribute(t *testing.T) {
+	client := newFakeDynamoClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		io.WriteString(w, `{}`)
+	})
+	if _, err := nextID(context.Background(), client, "carts", cartCounter); err == nil {
+		t.Error("nextID without next_id in the response succeeded, want an error")
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// A guest cart is an ordinary cart whose customer is a negative guest ID.
+// The token is resolved through a token row (pk = GUEST#<token>, sk = GUEST)
+// holding guest_id, not customer_id, so it stays out of customer_id-index.
+// The cart's META row records the token as guest_token. The token row and
+// the guest's guard are both read strongly consistently, so a guest cart can
+// be used, and merged, right after it is created.
+const (
+	guestPartitionPrefix = "GUEST#"
+	guestTokenSortKey    = "GUEST"
+)
+
+func (s *dynamoCartStore) CreateGuestCart(ctx context.Context) (*ShoppingCart, string, error) {
+	token, err := newGuestToken()
+	if err != nil {
+		return nil, "", err
+	}
+	guestID, err := nextID(ctx, s.client, s.table, guestCounter)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// A fresh guest ID has no cart yet, so even a conflict is an error here
+	cart, err := s.insertCart(ctx, -guestID, ListCart, token)
+	if err != nil {
+		return nil, "", fmt.Errorf("creating guest cart: %w", err)
+	}
+	return cart, token, nil
+}
+
+func (s *dynamoCartStore) GuestCustomerID(ctx context.Context, token string) (int, error) {
+	result, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(s.table),
+		Key:            s.key(guestTokenKey(token), guestTokenSortKey),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("reading guest token: %w", err)
+	}
+	if result.Item == nil {
+		return 0, ErrCartNotFound
+	}
+	return attrIntValue(result.Item, "guest_id"), nil
+}
+
+func (s *dynamoCartStore) MergeCarts(ctx context.Context, guestID, customerID int, rule MergeRule) error {
+	guestPK, err := s.cartPartitionForCustomer(ctx, guestID, ListCart)
+	if err != nil {
+		return err
+	}
+	customerPK, err := s.cartPartitionForCustomer(ctx, customerID, ListCart)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		version, writes, err := s.prepareMerge(ctx, guestPK, customerPK, guestID, rule, start.Format(time.RFC3339))
+		if err != nil {
+			return err
+		}
+
+		_, err = s.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: writes})
+		if err == nil {
+			if rowExpiryStale(version.list, version.rowsExpireAt, start) {
+				if err := s.refreshRowExpiry(ctx, customerPK); err != nil {
+					log.Printf("Error refreshing cart row expiry: %v", err)
+				}
+			}
+			return nil
+		}
+		if !isWriteConflict(err) {
+			return fmt.Errorf("merging carts: %w", err)
+		}
+		// Either cart changed since it was read
+		if err := s.backoff(ctx, customerPK, attempt); err != nil {
+			return err
+		}
+	}
+}
+
+// prepareMerge reads both carts and builds the single transaction that moves
+// the guest's lines into the customer's partition and deletes the guest cart.
+// Both META rows are conditioned on the versions read here. It returns the
+// customer cart's version as read.
+func (s *dynamoCartStore) prepareMerge(ctx context.Context, guestPK, customerPK string, guestID int,
+	rule MergeRule, now string) (*dynamoCartVersion, []types.TransactWriteItem, error) {
+	guestMeta, guestRows, err := s.queryCartPartition(ctx, guestPK)
+	if err != nil {
+		return nil, nil, err
+	}
+	customerMeta, customerRows, err := s.queryCartPartition(ctx, customerPK)
+	if err != nil {
+		return nil, nil, err
+	}
+	version := dynamoCartVersionFromMeta(customerMeta)
+	existing := make(map[int]map[string]types.AttributeValue, len(customerRows))
+	for _, row := range customerRows {
+		existing[attrIntValue(row, "product_id")] = row
+	}
+
+	var writes []types.TransactWriteItem
+	for _, guestRow := range guestRows {
+		row := mergeRow(customerPK, version, existing[attrIntValue(guestRow, "product_id")], guestRow, rule, now)
+		writes = append(writes,
+			types.TransactWriteItem{Put: &types.Put{TableName: aws.String(s.table), Item: row}},
+			s.deleteRow(guestPK, attrString(guestRow, "sk")))
+	}
+	stampRowExpiry(writes, cartRowExpiry(version.list, time.Now()))
+
+	// Plus the customer META update and the guest cart's META, guard and
+	// token rows
+	if len(writes)+4 > maxTransactItems {
+		return nil, nil, ErrCartTooLarge
+	}
+
+	guestCondition, guestValues := versionCondition(dynamoCartVersionFromMeta(guestMeta).version)
+	writes = append(writes,
+		s.metaUpdate(customerPK, version.version, version, now),
+		types.TransactWriteItem{Delete: &types.Delete{
+			TableName:                 aws.String(s.table),
+			Key:                       s.key(guestPK, cartMetaSortKey),
+			ConditionExpression:       aws.String(guestCondition),
+			ExpressionAttributeValues: guestValues,
+		}},
+		types.TransactWriteItem{Delete: &types.Delete{
+			TableName:           aws.String(s.table),
+			Key:                 s.key(customerGuardKey(guestID), listGuardSortKey(ListCart)),
+			ConditionExpression: aws.String("attribute_not_exists(pk) OR cart_pk = :pk"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":pk": &types.AttributeValueMemberS{Value: guestPK},
+			},
+		}},
+	)
+	if token := attrString(guestMeta, "guest_token"); token != "" {
+		writes = append(writes, s.deleteRow(guestTokenKey(token), guestTokenSortKey))
+	}
+	return version, writes, nil
+}
+
+// guestTokenUpdate pushes out the expiry of a guest cart's token row along
+// with the cart's other rows. It is nil for a customer's cart.
+func (s *dynamoCartStore) guestTokenUpdate(meta map[string]types.AttributeValue, expiresAt int64) *types.Update {
+	token := attrString(meta, "guest_token")
+	if token == "" {
+		return nil
+	}
+	values := map[string]types.AttributeValue{}
+	update := &types.Update{
+		TableName:           aws.String(s.table),
+		Key:                 s.key(guestTokenKey(token), guestTokenSortKey),
+		UpdateExpression:    aws.String(withExpiry("", expiresAt, values)),
+		ConditionExpression: aws.String("attribute_exists(pk)"),
+	}
+	if len(values) > 0 {
+		update.ExpressionAttributeValues = values
+	}
+	return update
+}
+
+func guestTokenKey(token string) string {
+	return guestPartitionPrefix + token
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Idempotency rows live in the carts table as well. Like the counters they
+// have no customer_id, so they never show up in customer_id-index.
+const (
+	idempotencyPartitionPrefix = "IDEMPOTENCY#"
+	idempotencySortKey         = "IDEMPOTENCY"
+)
+
+// dynamoIdempotencyStore keeps Idempotency-Key records in the carts table.
+// expires_at is stored as epoch seconds.
+type dynamoIdempotencyStore struct {
+	client *dynamodb.Client
+	table  string
+}
+
+// NewDynamoDBIdempotencyStore returns an IdempotencyStore backed by the given table
+func NewDynamoDBIdempotencyStore(client *dynamodb.Client, table string) IdempotencyStore {
+	return &dynamoIdempotencyStore{client: client, table: table}
+}
+
+func (s *dynamoIdempotencyStore) Reserve(ctx context.Context, key, fingerprint string, lockUntil time.Time) (*IdempotencyRecord, error) {
+	for {
+		// The condition makes the put the atomic claim; expired rows can be taken over
+		_, err := s.client.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName: aws.String(s.table),
+			Item: map[string]types.AttributeValue{
+				"pk":          &types.AttributeValueMemberS{Value: idempotencyPartitionPrefix + key},
+				"sk":          &types.AttributeValueMemberS{Value: idempotencySortKey},
+				"fingerprint": &types.AttributeValueMemberS{Value: fingerprint},
+				"completed":   &types.AttributeValueMemberBOOL{Value: false},
+				"expires_at":  attrInt(int(lockUntil.Unix())),
+			},
+			ConditionExpression: aws.String("attribute_not_exists(pk) OR expires_at <= :now"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":now": attrInt(int(time.Now().Unix())),
+			},
+		})
+		if err == nil {
+			return nil, nil
+		}
+		if !isWriteConflict(err) {
+			return nil, fmt.Errorf("reserving idempotency key: %w", err)
+		}
+
+		result, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+			TableName:      aws.String(s.table),
+			Key:            s.key(key),
+			ConsistentRead: aws.Bool(true),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("reading idempotency key: %w", err)
+		}
+		if result.Item != nil {
+			return dynamoIdempotencyRecordFromMap(key, result.Item), ErrIdempotencyKeyExists
+		}
+		// Released between our put and read, so the key is free again
+	}
+}
+
+func (s *dynamoIdempotencyStore) Complete(ctx context.Context, record IdempotencyRecord) error {
+	_, err := s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(s.table),
+		Key:                 s.key(record.Key),
+		UpdateExpression:    aws.String("SET completed = :true, status_code = :status, content_type = :type, response_body = :body, expires_at = :exp"),
+		ConditionExpression: aws.String("fingerprint = :fp"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":true":   &types.AttributeValueMemberBOOL{Value: true},
+			":status": attrInt(record.StatusCode),
+			":type":   &types.AttributeValueMemberS{Value: record.ContentType},
+			":body":   &types.AttributeValueMemberB{Value: record.Body},
+			":exp":    attrInt(int(record.ExpiresAt.Unix())),
+			":fp":     &types.AttributeValueMemberS{Value: record.Fingerprint},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("storing idempotent response: %w", err)
+	}
+	return nil
+}
+
+func (s *dynamoIdempotencyStore) Release(ctx context.Context, key string) error {
+	_, err := s.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:           aws.String(s.table),
+		Key:                 s.key(key),
+		ConditionExpression: aws.String("completed = :false"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":false": &types.AttributeValueMemberBOOL{Value: false},
+		},
+	})
+	if err != nil && !isWriteConflict(err) {
+		return fmt.Errorf("releasing idempotency key: %w", err)
+	}
+	return nil
+}
+
+func (s *dynamoIdempotencyStore) key(key string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"pk": &types.AttributeValueMemberS{Value: idempotencyPartitionPrefix + key},
+		"sk": &types.AttributeValueMemberS{Value: idempotencySortKey},
+	}
+}
+
+func dynamoIdempotencyRecordFromMap(key string, m map[string]types.AttributeValue) *IdempotencyRecord {
+	record := &IdempotencyRecord{
+		Key:         key,
+		Fingerprint: attrString(m, "fingerprint"),
+		StatusCode:  attrIntValue(m, "status_code"),
+		ContentType: attrString(m, "content_type"),
+	}
+	if v, ok := m["completed"].(*types.AttributeValueMemberBOOL); ok {
+		record.Completed = v.Value
+	}
+	if v, ok := m["response_body"].(*types.AttributeValueMemberB); ok {
+		record.Body = v.Value
+	}
+	if v, ok := m["expires_at"].(*types.AttributeValueMemberN); ok {
+		if seconds, err := strconv.ParseInt(v.Value, 10, 64); err == nil {
+			record.ExpiresAt = time.Unix(seconds, 0)
+		}
+	}
+	return record
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Stock lives in the carts table too, one partition per tracked product
+// (pk = STOCK#<product_id>). The stock row (sk = STOCK) holds on_hand and
+// two counters: reserved, the units of all reservation rows, and available,
+// on_hand minus reserved. Each customer's reservation is its own row
+// (sk = RES#<customer_id>) with quantity and reserved_until in epoch seconds.
+//
+// A reservation write changes its row and the counters in one transaction,
+// conditioned on available, so concurrent adds cannot both take the last
+// units, and customers never rewrite each other's reservations. Expired rows
+// still count until reclaimExpired deletes them, which happens when a
+// product runs short. reserved_until is deliberately not the table's TTL
+// attribute: a row removed by TTL would leave its units in the counters.
+const (
+	stockPartitionPrefix  = "STOCK#"
+	stockSortKey          = "STOCK"
+	reservationSortPrefix = "RES#"
+
+	// maxStockWriteAttempts bounds how often a reservation write is retried
+	// after losing a race on the same product
+	maxStockWriteAttempts = 5
+)
+
+// dynamoInventoryStore keeps stock rows in the carts table
+type dynamoInventoryStore struct {
+	client *dynamodb.Client
+	table  string
+}
+
+// NewDynamoDBInventoryStore returns an InventoryStore backed by the given table
+func NewDynamoDBInventoryStore(client *dynamodb.Client, table string) InventoryStore {
+	return &dynamoInventoryStore{client: client, table: table}
+}
+
+// dynamoStock is a decoded stock row
+type dynamoStock struct {
+	onHand    int
+	reserved  int
+	available int
+}
+
+func (s *dynamoInventoryStore) GetStock(ctx context.Context, productID int) (*StockLevel, error) {
+	stock, reservations, err := s.query(ctx, productID)
+	if err != nil {
+		return nil, err
+	}
+	if stock == nil {
+		return nil, ErrStockNotTracked
+	}
+	// Count only the unexpired reservations, unlike the counters
+	return stockLevel(productID, stock.onHand, reservations, 0, time.Now()), nil
+}
+
+func (s *dynamoInventoryStore) SetStock(ctx context.Context, productID, onHand int) (*StockLevel, error) {
+	// available follows on_hand, keeping the units already reserved
+	_, err := s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(s.table),
+		Key:                 s.key(productID),
+		UpdateExpression:    aws.String("SET on_hand = :on_hand, available = :on_hand - reserved"),
+		ConditionExpression: aws.String("attribute_exists(pk)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":on_hand": attrInt(onHand),
+		},
+	})
+	if isWriteConflict(err) {
+		// Not tracked yet
+		item := s.key(productID)
+		item["on_hand"] = attrInt(onHand)
+		item["reserved"] = attrInt(0)
+		item["available"] = attrInt(onHand)
+		_, err = s.client.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName:           aws.String(s.table),
+			Item:                item,
+			ConditionExpression: aws.String("attribute_not_exists(pk)"),
+		})
+		if isWriteConflict(err) {
+			// Another request started tracking it first; set it over theirs
+			return s.SetStock(ctx, productID, onHand)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("setting stock: %w", err)
+	}
+	return s.GetStock(ctx, productID)
+}
+
+func (s *dynamoInventoryStore) Reserve(ctx context.Context, customerID, productID, quantity int, ttl time.Duration) (*StockLevel, error) {
+	for attempt := 1; ; attempt++ {
+		stock, own, err := s.getForUnits(ctx, productID, customerID, quantity)
+		if err != nil {
+			return nil, err
+		}
+		if stock == nil {
+			return nil, nil
+		}
+
+		held := own.units()
+		delta := quantity - held
+		if delta > stock.available {
+			return stock.level(productID, held), ErrInsufficientStock
+		}
+
+		reservedUntil := time.Now().Add(ttl)
+		err = s.transact(ctx,
+			s.counterUpdate(productID, delta),
+			s.putReservation(productID, customerID, own, quantity, reservedUntil),
+		)
+		if err == nil {
+			stock.reserved += delta
+			stock.available -= delta
+			return stock.level(productID, 0), nil
+		}
+		if !isWriteConflict(err) {
+			return nil, fmt.Errorf("reserving stock: %w", err)
+		}
+		if err := stockBackoff(ctx, productID, attempt); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (s *dynamoInventoryStore) Release(ctx context.Context, customerID int, productIDs ...int) error {
+	for _, productID := range productIDs {
+		if err := s.release(ctx, customerID, productID); err != nil {
+			return fmt.Errorf("releasing stock of product %d: %w", productID, err)
+		}
+	}
+	return nil
+}
+
+// release deletes a customer's reservation row and gives its units back
+func (s *dynamoInventoryStore) release(ctx context.Context, customerID, productID int) error {
+	for attempt := 1; ; attempt++ {
+		result, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+			TableName:      aws.String(s.table),
+			Key:            s.reservationKey(productID, customerID),
+			ConsistentRead: aws.Bool(true),
+		})
+		if err != nil {
+			return err
+		}
+		if result.Item == nil {
+			return nil
+		}
+		own := dynamoReservationFromMap(result.Item)
+
+		err = s.transact(ctx,
+			s.counterUpdate(productID, -own.Quantity),
+			s.deleteReservation(productID, customerID, own),
+		)
+		if !isWriteConflict(err) {
+			return err
+		}
+		if err := stockBackoff(ctx, productID, attempt); err != nil {
+			return err
+		}
+	}
+}
+
+// getForUnits reads a product's stock row and the customer's reservation, if
+// any, for a write that leaves the customer holding quantity units. If the
+// counters say that is too many, expired reservations are reclaimed and both
+// are read again. A nil stock row means the product is not tracked.
+func (s *dynamoInventoryStore) getForUnits(ctx context.Context, productID, customerID, quantity int) (*dynamoStock, *stockReservation, error) {
+	stock, own, err := s.get(ctx, productID, customerID)
+	if err != nil || stock == nil || quantity-own.units() <= stock.available {
+		return stock, own, err
+	}
+	reclaimed, err := s.reclaimExpired(ctx, productID, time.Now())
+	if err != nil || reclaimed == 0 {
+		return stock, own, err
+	}
+	return s.get(ctx, productID, customerID)
+}
+
+// get reads a product's stock row and the customer's reservation in one
+// consistent round trip
+func (s *dynamoInventoryStore) get(ctx context.Context, productID, customerID int) (*dynamoStock, *stockReservation, error) {
+	result, err := s.client.TransactGetItems(ctx, &dynamodb.TransactGetItemsInput{
+		TransactItems: []types.TransactGetItem{
+			{Get: &types.Get{TableName: aws.String(s.table), Key: s.key(productID)}},
+			{Get: &types.Get{TableName: aws.String(s.table), Key: s.reservationKey(productID, customerID)}},
+		},
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading stock: %w", err)
+	}
+	if len(result.Responses) != 2 || result.Responses[0].Item == nil {
+		return nil, nil, nil
+	}
+	stock := dynamoStockFromMap(result.Responses[0].Item)
+	if result.Responses[1].Item == nil {
+		return stock, nil, nil
+	}
+	own := dynamoReservationFromMap(result.Responses[1].Item)
+	return stock, &own, nil
+}
+
+// query reads a product's whole partition: the stock row and every
+// reservation by customer ID
+func (s *dynamoInventoryStore) query(ctx context.Context, productID int) (*dynamoStock, map[int]stockReservation, error) {
+	var stock *dynamoStock
+	reservations := make(map[int]stockReservation)
+	paginator := dynamodb.NewQueryPaginator(s.client, &dynamodb.QueryInput{
+		TableName:              aws.String(s.table),
+		KeyConditionExpression: aws.String("pk = :pk"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pk": &types.AttributeValueMemberS{Value: stockPartitionPrefix + strconv.Itoa(productID)},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading stock: %w", err)
+		}
+		for _, row := range page.Items {
+			sk := attrString(row, "sk")
+			if sk == stockSortKey {
+				stock = dynamoStockFromMap(row)
+				continue
+			}
+			customerID, err := strconv.Atoi(strings.TrimPrefix(sk, reservationSortPrefix))
+			if err != nil {
+				continue
+			}
+			reservations[customerID] = dynamoReservationFromMap(row)
+		}
+	}
+	return stock, reservations, nil
+}
+
+// reclaimExpired deletes a product's expired reservation rows and gives
+// their units back. It reports how many it reclaimed; rows renewed or
+// released in the meantime are left alone.
+func (s *dynamoInventoryStore) reclaimExpired(ctx context.Context, productID int, now time.Time) (int, error) {
+	_, reservations, err := s.query(ctx, productID)
+	if err != nil {
+		return 0, err
+	}
+	reclaimed := 0
+	for customerID, r := range reservations {
+		if r.ExpiresAt.After(now) {
+			continue
+		}
+		err := s.transact(ctx,
+			s.counterUpdate(productID, -r.Quantity),
+			s.deleteReservation(productID, customerID, r),
+		)
+		if isWriteConflict(err) {
+			continue
+		}
+		if err != nil {
+			return reclaimed, fmt.Errorf("reclaiming expired stock: %w", err)
+		}
+		reclaimed++
+	}
+	return reclaimed, nil
+}
+
+// counterUpdate moves delta units from available to reserved. Taking units
+// is conditioned on enough being available; giving them back is not.
+func (s *dynamoInventoryStore) counterUpdate(productID, delta int) types.TransactWriteItem {
+	condition := "attribute_exists(pk)"
+	if delta > 0 {
+		condition = "available >= :delta"
+	}
+	return types.TransactWriteItem{Update: &types.Update{
+		TableName:           aws.String(s.table),
+		Key:                 s.key(productID),
+		UpdateExpression:    aws.String("SET reserved = reserved + :delta, available = available - :delta"),
+		ConditionExpression: aws.String(condition),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":delta": attrInt(delta),
+		},
+	}}
+}
+
+// takeUpdate takes quantity ordered units off on_hand, together with the
+// held units of the customer's reservation, whose row the caller deletes.
+// It is conditioned on the units beyond held being available.
+func (s *dynamoInventoryStore) takeUpdate(productID, quantity, held int) types.TransactWriteItem {
+	extra := quantity - held
+	condition := "attribute_exists(pk)"
+	if extra > 0 {
+		condition = "available >= :extra"
+	}
+	return types.TransactWriteItem{Update: &types.Update{
+		TableName:           aws.String(s.table),
+		Key:                 s.key(productID),
+		UpdateExpression:    aws.String("SET on_hand = on_hand - :quantity, reserved = reserved - :held, available = available - :extra"),
+		ConditionExpression: aws.String(condition),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":quantity": attrInt(quantity),
+			":held":     attrInt(held),
+			":extra":    attrInt(extra),
+		},
+	}}
+}
+
+// putReservation writes a customer's reservation, if the row is still as
+// it was read (own, nil when there was none), so the counters stay in step
+func (s *dynamoInventoryStore) putReservation(productID, customerID int, own *stockReservation, quantity int, reservedUntil time.Time) types.TransactWriteItem {
+	item := s.reservationKey(productID, customerID)
+	item["quantity"] = attrInt(quantity)
+	item["reserved_until"] = attrInt64(reservedUntil.Unix())
+	put := &types.Put{
+		TableName:           aws.String(s.table),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(pk)"),
+	}
+	if own != nil {
+		put.ConditionExpression = aws.String("quantity = :quantity")
+		put.ExpressionAttributeValues = map[string]types.AttributeValue{
+			":quantity": attrInt(own.Quantity),
+		}
+	}
+	return types.TransactWriteItem{Put: put}
+}
+
+// deleteReservation deletes a customer's reservation row as it was read
+func (s *dynamoInventoryStore) deleteReservation(productID, customerID int, own stockReservation) types.TransactWriteItem {
+	return types.TransactWriteItem{Delete: &types.Delete{
+		TableName:           aws.String(s.table),
+		Key:                 s.reservationKey(productID, customerID),
+		ConditionExpression: aws.String("quantity = :quantity AND reserved_until = :reserved_until"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":quantity":       attrInt(own.Quantity),
+			":reserved_until": attrInt64(own.ExpiresAt.Unix()),
+		},
+	}}
+}
+
+// noReservation checks that a customer still holds no reservation
+func (s *dynamoInventoryStore) noReservation(productID, customerID int) types.TransactWriteItem {
+	return types.TransactWriteItem{ConditionCheck: &types.ConditionCheck{
+		TableName:           aws.String(s.table),
+		Key:                 s.reservationKey(productID, customerID),
+		ConditionExpression: aws.String("attribute_not_exists(pk)"),
+	}}
+}
+
+// transact writes items in one transaction
+func (s *dynamoInventoryStore) transact(ctx context.Context, items ...types.TransactWriteItem) error {
+	_, err := s.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+	return err
+}
+
+// stockBackoff waits before the next attempt of a conflicting stock write,
+// or gives up with ErrConcurrentModification
+func stockBackoff(ctx context.Context, productID, attempt int) error {
+	if attempt >= maxStockWriteAttempts {
+		log.Printf("Giving up on stock of product %d after %d conflicting writes", productID, attempt)
+		return ErrConcurrentModification
+	}
+	backoff := time.Duration(attempt*attempt)*10*time.Millisecond +
+		time.Duration(rand.Intn(10))*time.Millisecond
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(backoff):
+		return nil
+	}
+}
+
+func (s *dynamoInventoryStore) key(productID int) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"pk": &types.AttributeValueMemberS{Value: stockPartitionPrefix + strconv.Itoa(productID)},
+		"sk": &types.AttributeValueMemberS{Value: stockSortKey},
+	}
+}
+
+func (s *dynamoInventoryStore) reservationKey(productID, customerID int) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"pk": &types.AttributeValueMemberS{Value: stockPartitionPrefix + strconv.Itoa(productID)},
+		"sk": &types.AttributeValueMemberS{Value: reservationSortPrefix + strconv.Itoa(customerID)},
+	}
+}
+
+func dynamoStockFromMap(m map[string]types.AttributeValue) *dynamoStock {
+	return &dynamoStock{
+		onHand:    attrIntValue(m, "on_hand"),
+		reserved:  attrIntValue(m, "reserved"),
+		available: attrIntValue(m, "available"),
+	}
+}
+
+func dynamoReservationFromMap(m map[string]types.AttributeValue) stockReservation {
+	return stockReservation{
+		Quantity:  attrIntValue(m, "quantity"),
+		ExpiresAt: time.Unix(attrInt64Value(m, "reserved_until"), 0),
+	}
+}
+
+// units is the quantity a reservation holds in the counters, expired or
+// not; zero for none
+func (r *stockReservation) units() int {
+	if r == nil {
+		return 0
+	}
+	return r.Quantity
+}
+
+// level reports the stock from its counters, which may still include
+// expired reservations. The held units of the caller's own reservation
+// count as available.
+func (stock *dynamoStock) level(productID, held int) *StockLevel {
+	reserved := stock.reserved - held
+	return &StockLevel{
+		ProductID: productID,
+		Tracked:   true,
+		OnHand:    stock.onHand,
+		Reserved:  reserved,
+		Available: availableStock(stock.onHand, reserved),
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDynamoReserveWritesOwnRow(t *testing.T) {
+	var writes []map[string]map[string]any
+	client := newFakeDynamoClient(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		switch target := r.Header.Get("X-Amz-Target"); {
+		case strings.HasSuffix(target, ".TransactGetItems"):
+			io.WriteString(w, `{"Responses":[{"Item":{"pk":{"S":"STOCK#42"},"sk":{"S":"STOCK"},"on_hand":{"N":"10"},"reserved":{"N":"3"},"available":{"N":"7"}}},{}]}`)
+		case strings.HasSuffix(target, ".TransactWriteItems"):
+			var request struct {
+				TransactItems []map[string]map[string]any
+			}
+			if err := json.Unmarshal(body, &request); err != nil {
+				t.Errorf("decoding request: %v", err)
+			}
+			writes = request.TransactItems
+			io.WriteString(w, `{}`)
+		default:
+			t.Errorf("unexpected operation %q", target)
+		}
+	})
+	store := &dynamoInventoryStore{client: client, table: "carts"}
+
+	level, err := store.Reserve(context.Background(), 5, 42, 2, time.Minute)
+	if err != nil {
+		t.Fatalf("Reserve: %v", err)
+	}
+	if level.OnHand != 10 || level.Reserved != 5 || level.Available != 5 {
+		t.Errorf("level = %+v, want 10 on hand, 5 reserved, 5 available", *level)
+	}
+
+	// The counters move on the stock row; the reservation is the customer's own row
+	if len(writes) != 2 || writes[0]["Update"] == nil || writes[1]["Put"] == nil {
+		t.Fatalf("transaction = %v, want a stock Update and a reservation Put", writes)
+	}
+	update, put := writes[0]["Update"], writes[1]["Put"]
+	if update["ConditionExpression"] != "available >= :delta" {
+		t.Errorf("stock update condition = %v", update["ConditionExpression"])
+	}
+	key, _ := json.Marshal(put["Item"].(map[string]any)["sk"])
+	if string(key) != `{"S":"RES#5"}` || put["ConditionExpression"] != "attribute_not_exists(pk)" {
+		t.Errorf("reservation put = %v", put)
+	}
+}
+
+func TestDynamoReserveShortage(t *testing.T) {
+	client := newFakeDynamoClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		switch target := r.Header.Get("X-Amz-Target"); {
+		case strings.HasSuffix(target, ".TransactGetItems"):
+			io.WriteString(w, `{"Responses":[{"Item":{"pk":{"S":"STOCK#42"},"sk":{"S":"STOCK"},"on_hand":{"N":"10"},"reserved":{"N":"9"},"available":{"N":"1"}}},{"Item":{"pk":{"S":"STOCK#42"},"sk":{"S":"RES#5"},"quantity":{"N":"2"},"reserved_until":{"N":"4102444800"}}}]}`)
+		case strings.HasSuffix(target, ".Query"):
+			// Nothing has expired, so nothing can be reclaimed
+			io.WriteString(w, `{"Items":[{"pk":{"S":"STOCK#42"},"sk":{"S":"RES#5"},"quantity":{"N":"2"},"reserved_until":{"N":"4102444800"}}]}`)
+		default:
+			t.Errorf("unexpected operation %q", target)
+		}
+	})
+	store := &dynamoInventoryStore{client: client, table: "carts"}
+
+	// The customer's own 2 units count as available on top of the 1 left
+	level, err := store.Reserve(context.Background(), 5, 42, 4, time.Minute)
+	if !errors.Is(err, ErrInsufficientStock) || level == nil || level.Available != 3 {
+		t.Errorf("Reserve = %+v, %v; want 3 available and ErrInsufficientStock", level, err)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// maxBatchWriteItems is DynamoDB's limit on requests per BatchWriteItem
+const maxBatchWriteItems = 25
+
+// A finished migration leaves a marker row in the carts table, so later
+// tasks skip the scan. Like counter rows it has no customer_id.
+const (
+	migrationPartitionPrefix = "MIGRATION#"
+	migrationDoneSortKey     = "DONE"
+)
+
+// MigrateLegacyCarts copies carts from the old list-shaped table (one item
+// per cart, lines in the cart_items list attribute, keyed by cart_id) into
+// the single-table layout used by dynamoCartStore.
+//
+// ITEM# rows are written before the META row, and the META row is only
+// created if it does not exist yet, so the migration can be re-run or run
+// by several tasks at once. Legacy rows are left untouched. Once a scan has
+// finished, a marker row records it and later calls return at once.
+func MigrateLegacyCarts(ctx context.Context, client *dynamodb.Client, legacyTable, table string) error {
+	store := &dynamoCartStore{client: client, table: table}
+	marker := store.key(migrationPartitionPrefix+legacyTable, migrationDoneSortKey)
+
+	done, err := client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(table),
+		Key:            marker,
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return fmt.Errorf("reading migration marker: %w", err)
+	}
+	if done.Item != nil {
+		log.Printf("Legacy carts from %s were migrated at %s, skipping", legacyTable, attrString(done.Item, "migrated_at"))
+		return nil
+	}
+
+	migrated, skipped := 0, 0
+
+	paginator := dynamodb.NewScanPaginator(client, &dynamodb.ScanInput{
+		TableName: aws.String(legacyTable),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("scanning legacy table %s: %w", legacyTable, err)
+		}
+
+		for _, legacy := range page.Items {
+			ok, err := store.migrateLegacyCart(ctx, legacy)
+			if err != nil {
+				return err
+			}
+			if ok {
+				migrated++
+			} else {
+				skipped++
+			}
+		}
+	}
+
+	marker["migrated_at"] = &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339)}
+	marker["migrated"] = attrInt(migrated)
+	marker["skipped"] = attrInt(skipped)
+	if _, err := client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(table),
+		Item:      marker,
+	}); err != nil {
+		return fmt.Errorf("writing migration marker: %w", err)
+	}
+
+	log.Printf("Legacy cart migration complete: %d migrated, %d skipped", migrated, skipped)
+	return nil
+}
+
+// migrateLegacyCart copies one legacy cart row. It reports false if the
+// cart was skipped because the customer already has a cart in the new table.
+func (s *dynamoCartStore) migrateLegacyCart(ctx context.Context, legacy map[string]types.AttributeValue) (bool, error) {
+	cartID := attrString(legacy, "cart_id")
+	customerID := attrIntValue(legacy, "customer_id")
+	if cartID == "" {
+		log.Printf("Skipping legacy cart row without cart_id")
+		return false, nil
+	}
+	pk := cartPartitionPrefix + cartID
+
+	existing, err := s.cartPartitionForCustomer(ctx, customerID, ListCart)
+	if err != nil && !errors.Is(err, ErrCartNotFound) {
+		return false, fmt.Errorf("checking customer %d for existing cart: %w", customerID, err)
+	}
+	if err == nil {
+		if existing != pk {
+			log.Printf("Skipping legacy cart %s: customer %d already has a cart", cartID, customerID)
+		}
+		return false, nil
+	}
+
+	// Copy the lines
+	var writes []types.WriteRequest
+	nextItemID := 0
+	if itemsMember, ok := legacy["cart_items"].(*types.AttributeValueMemberL); ok {
+		for _, itemAttr := range itemsMember.Value {
+			itemMap, ok := itemAttr.(*types.AttributeValueMemberM)
+			if !ok {
+				continue
+			}
+			row := make(map[string]types.AttributeValue, len(itemMap.Value)+2)
+			for k, v := range itemMap.Value {
+				row[k] = v
+			}
+			row["pk"] = &types.AttributeValueMemberS{Value: pk}
+			row["sk"] = &types.AttributeValueMemberS{Value: cartItemSortKey(attrIntValue(itemMap.Value, "product_id"))}
+			writes = append(writes, types.WriteRequest{PutRequest: &types.PutRequest{Item: row}})
+			nextItemID = max(nextItemID, attrIntValue(itemMap.Value, "id"))
+		}
+	}
+	if err := s.batchWrite(ctx, writes); err != nil {
+		return false, fmt.Errorf("copying lines of legacy cart %s: %w", cartID, err)
+	}
+
+	// Then the header and the guard, which make the cart visible
+	meta := map[string]types.AttributeValue{
+		"pk":           &types.AttributeValueMemberS{Value: pk},
+		"sk":           &types.AttributeValueMemberS{Value: cartMetaSortKey},
+		"cart_id":      &types.AttributeValueMemberS{Value: cartID},
+		"customer_id":  attrInt(customerID),
+		"version":      attrInt(max(1, attrIntValue(legacy, "version"))),
+		"next_item_id": attrInt(nextItemID),
+	}
+	for _, name := range []string{"created_at", "updated_at"} {
+		if v, ok := legacy[name]; ok {
+			meta[name] = v
+		}
+	}
+	// Legacy numeric IDs came from UnixNano() % 1e8 and collide, so every
+	// migrated cart gets a new one. The old value is kept for reference.
+	numericID, err := nextID(ctx, s.client, s.table, cartCounter)
+	if err != nil {
+		return false, err
+	}
+	meta["numeric_id"] = attrInt(numericID)
+	if v, ok := legacy["numeric_id"]; ok {
+		meta["legacy_numeric_id"] = v
+	}
+	_, err = s.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{Put: &types.Put{
+				TableName:           aws.String(s.table),
+				Item:                meta,
+				ConditionExpression: aws.String("attribute_not_exists(pk)"),
+			}},
+			{Put: &types.Put{
+				TableName: aws.String(s.table),
+				Item: map[string]types.AttributeValue{
+					"pk":      &types.AttributeValueMemberS{Value: customerGuardKey(customerID)},
+					"sk":      &types.AttributeValueMemberS{Value: customerGuardSortKey},
+					"cart_pk": &types.AttributeValueMemberS{Value: pk},
+				},
+				ConditionExpression: aws.String("attribute_not_exists(pk)"),
+			}},
+		},
+	})
+	if isWriteConflict(err) {
+		// Another task migrated it first, or the customer already has a cart
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("writing header of legacy cart %s: %w", cartID, err)
+	}
+	return true, nil
+}
+
+// batchWrite applies writes in batches, resubmitting unprocessed requests
+func (s *dynamoCartStore) batchWrite(ctx context.Context, writes []types.WriteRequest) error {
+	for len(writes) > 0 {
+		n := min(len(writes), maxBatchWriteItems)
+		pending := writes[:n]
+		writes = writes[n:]
+
+		for attempt := 0; len(pending) > 0; attempt++ {
+			if attempt > 0 {
+				time.Sleep(time.Duration(attempt*50) * time.Millisecond)
+			}
+			result, err := s.client.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{
+				RequestItems: map[string][]types.WriteRequest{s.table: pending},
+			})
+			if err != nil {
+				return err
+			}
+			pending = result.UnprocessedItems[s.table]
+		}
+	}
+	return nil
+}
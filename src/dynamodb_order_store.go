@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Orders live in the carts table as well. Each order is written twice: once
+// under its own partition (pk = ORDER#<order_id>, sk = ORDER) for GetOrder,
+// and once into the customer's partition (pk = CUSTOMER#<customer_id>,
+// sk = ORDER#<zero-padded order_id>) so ListOrders is a single Query. The
+// customer is stored as order_customer_id, keeping orders out of
+// customer_id-index.
+const (
+	orderPartitionPrefix = "ORDER#"
+	orderSortKey         = "ORDER"
+	customerOrderPrefix  = "ORDER#"
+)
+
+// dynamoOrderStore checks out carts of the DynamoDB cart store, taking stock
+// from the DynamoDB inventory store in the same transaction
+type dynamoOrderStore struct {
+	carts     *dynamoCartStore
+	inventory *dynamoInventoryStore
+}
+
+// NewDynamoDBOrderStore returns an OrderStore backed by the carts table
+func NewDynamoDBOrderStore(client *dynamodb.Client, table string) OrderStore {
+	return &dynamoOrderStore{
+		carts:     &dynamoCartStore{client: client, table: table},
+		inventory: &dynamoInventoryStore{client: client, table: table},
+	}
+}
+
+func (s *dynamoOrderStore) Checkout(ctx context.Context, customerID int, acceptPriceChanges bool) (*Order, error) {
+	pk, err := s.carts.cartPartitionForCustomer(ctx, customerID, ListCart)
+	if err != nil {
+		return nil, err
+	}
+
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		order, version, writes, err := s.prepareCheckout(ctx, pk, customerID, acceptPriceChanges, start)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = s.carts.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: writes})
+		if err == nil {
+			// Checkout pushes the META row's expiry out like any cart
+			// write, so the guard has to follow it
+			if rowExpiryStale(version.list, version.rowsExpireAt, start) {
+				if err := s.carts.refreshRowExpiry(ctx, pk); err != nil {
+					log.Printf("Error refreshing cart row expiry: %v", err)
+				}
+			}
+			return order, nil
+		}
+		if !isWriteConflict(err) {
+			return nil, fmt.Errorf("checking out cart: %w", err)
+		}
+		// The cart or a stock row changed since it was read; the next
+		// attempt reads both again (and allocates a fresh order ID)
+		if err := s.carts.backoff(ctx, pk, attempt); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// prepareCheckout reads the cart and the stock of its lines and builds the
+// transaction that places the order, returning it with the cart version it
+// read. The META update is conditioned on that version, each stock update on the units available and each
+// reservation on its row as read, so the transaction fails as a whole if
+// anything moved in between.
+func (s *dynamoOrderStore) prepareCheckout(ctx context.Context, pk string, customerID int,
+	acceptPriceChanges bool, now time.Time) (*Order, *dynamoCartVersion, []types.TransactWriteItem, error) {
+	meta, rows, err := s.carts.queryCartPartition(ctx, pk)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	cart := dynamoCartFromMeta(meta)
+	for _, row := range rows {
+		item := dynamoCartItemFromMap(row)
+		item.fillFromCatalog()
+		cart.Items = append(cart.Items, item)
+	}
+	order, err := newOrderFromCart(&cart, acceptPriceChanges)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var writes []types.TransactWriteItem
+	for _, item := range order.Items {
+		stock, own, err := s.inventory.getForUnits(ctx, item.ProductID, customerID, item.Quantity)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if stock == nil {
+			continue
+		}
+		held := own.units()
+		if item.Quantity-held > stock.available {
+			return nil, nil, nil, &InsufficientStockError{Level: stock.level(item.ProductID, held)}
+		}
+		writes = append(writes, s.inventory.takeUpdate(item.ProductID, item.Quantity, held))
+		if own != nil {
+			writes = append(writes, s.inventory.deleteReservation(item.ProductID, customerID, *own))
+		} else {
+			writes = append(writes, s.inventory.noReservation(item.ProductID, customerID))
+		}
+	}
+	for _, row := range rows {
+		writes = append(writes, s.carts.deleteRow(pk, attrString(row, "sk")))
+	}
+	// Plus the META update and the two order rows
+	if len(writes)+3 > maxTransactItems {
+		return nil, nil, nil, ErrCartTooLarge
+	}
+
+	order.ID, err = nextID(ctx, s.carts.client, s.carts.table, orderCounter)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	order.CreatedAt = now.Format(time.RFC3339)
+
+	version := dynamoCartVersionFromMeta(meta)
+	writes = append(writes,
+		s.carts.metaUpdate(pk, version.version, version, order.CreatedAt),
+		s.putOrder(orderPartitionPrefix+strconv.Itoa(order.ID), orderSortKey, order),
+		s.putOrder(customerGuardKey(customerID), customerOrderSortKey(order.ID), order),
+	)
+	return order, version, writes, nil
+}
+
+func (s *dynamoOrderStore) GetOrder(ctx context.Context, orderID int) (*Order, error) {
+	result, err := s.carts.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(s.carts.table),
+		Key:            s.carts.key(orderPartitionPrefix+strconv.Itoa(orderID), orderSortKey),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading order: %w", err)
+	}
+	if result.Item == nil {
+		return nil, ErrOrderNotFound
+	}
+	return dynamoOrderFromMap(result.Item), nil
+}
+
+func (s *dynamoOrderStore) ListOrders(ctx context.Context, customerID int) ([]Order, error) {
+	orders := []Order{}
+	paginator := dynamodb.NewQueryPaginator(s.carts.client, &dynamodb.QueryInput{
+		TableName:              aws.String(s.carts.table),
+		KeyConditionExpression: aws.String("pk = :pk AND begins_with(sk, :prefix)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pk":     &types.AttributeValueMemberS{Value: customerGuardKey(customerID)},
+			":prefix": &types.AttributeValueMemberS{Value: customerOrderPrefix},
+		},
+		// Sort keys are zero-padded IDs, so descending order is newest first
+		ScanIndexForward: aws.Bool(false),
+		ConsistentRead:   aws.Bool(true),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("querying orders: %w", err)
+		}
+		for _, row := range page.Items {
+			orders = append(orders, *dynamoOrderFromMap(row))
+		}
+	}
+	return orders, nil
+}
+
+// putOrder writes a new order row. It must not exist yet, which can only
+// fail if the order counter was reset.
+func (s *dynamoOrderStore) putOrder(pk, sk string, order *Order) types.TransactWriteItem {
+	items := make([]types.AttributeValue, len(order.Items))
+	for i, item := range order.Items {
+		items[i] = &types.AttributeValueMemberM{Value: map[string]types.AttributeValue{
+			"product_id":   attrInt(item.ProductID),
+			"manufacturer": &types.AttributeValueMemberS{Value: item.Manufacturer},
+			"category":     &types.AttributeValueMemberS{Value: item.Category},
+			"quantity":     attrInt(item.Quantity),
+			"unit_price":   attrInt64(item.UnitPrice),
+			"weight":       attrFloat(item.Weight),
+		}}
+	}
+
+	row := s.carts.key(pk, sk)
+	row["order_id"] = attrInt(order.ID)
+	row["order_customer_id"] = attrInt(order.CustomerID)
+	row["status"] = &types.AttributeValueMemberS{Value: order.Status}
+	row["items"] = &types.AttributeValueMemberL{Value: items}
+	row["subtotal"] = attrInt64(order.Subtotal)
+	row["currency"] = &types.AttributeValueMemberS{Value: order.Currency}
+	row["item_count"] = attrInt(order.ItemCount)
+	row["total_weight"] = attrFloat(order.TotalWeight)
+	row["created_at"] = &types.AttributeValueMemberS{Value: order.CreatedAt}
+	return types.TransactWriteItem{Put: &types.Put{
+		TableName:           aws.String(s.carts.table),
+		Item:                row,
+		ConditionExpression: aws.String("attribute_not_exists(pk)"),
+	}}
+}
+
+func customerOrderSortKey(orderID int) string {
+	return fmt.Sprintf("%s%012d", customerOrderPrefix, orderID)
+}
+
+func dynamoOrderFromMap(m map[string]types.AttributeValue) *Order {
+	order := &Order{
+		ID:          attrIntValue(m, "order_id"),
+		CustomerID:  attrIntValue(m, "order_customer_id"),
+		Status:      attrString(m, "status"),
+		Items:       []OrderItem{},
+		Subtotal:    attrInt64Value(m, "subtotal"),
+		Currency:    attrString(m, "currency"),
+		ItemCount:   attrIntValue(m, "item_count"),
+		TotalWeight: attrFloatValue(m, "total_weight"),
+		CreatedAt:   attrString(m, "created_at"),
+	}
+	if list, ok := m["items"].(*types.AttributeValueMemberL); ok {
+		for _, value := range list.Value {
+			entry, ok := value.(*types.AttributeValueMemberM)
+			if !ok {
+				continue
+			}
+			order.Items = append(order.Items, OrderItem{
+				ProductID:    attrIntValue(entry.Value, "product_id"),
+				Manufacturer: attrString(entry.Value, "manufacturer"),
+				Category:     attrString(entry.Value, "category"),
+				Quantity:     attrIntValue(entry.Value, "quantity"),
+				UnitPrice:    attrInt64Value(entry.Value, "unit_price"),
+				Weight:       attrFloatValue(entry.Value, "weight"),
+			})
+		}
+	}
+	return order
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// A hard delete retires the product in the carts table before it looks for
+// lines holding it: it writes a retirement row (pk = PRODUCT#<product_id>,
+// sk = RETIRED), and adding a new line of a retired product fails, checked
+// in the add's own transaction. A line added before the row was written is
+// found through product_id-index once the index has caught up, which
+// productIndexLag waits for; an index lagging further behind can still miss
+// it. The row only has to outlast the catalog refreshes that drop a deleted
+// product from every task, so it expires after productRetirementTTL, and it
+// is deleted at once if the product turns out to be held or the delete
+// fails. Like guard rows,
+// it has neither customer_id nor product_id, so it stays out of both indexes.
+const (
+	productPartitionPrefix = "PRODUCT#"
+	productRetiredSortKey  = "RETIRED"
+
+	productRetirementTTL = 5 * time.Minute
+)
+
+// productIndexLag is how long a hard delete waits after retiring a product
+// for lines added just before to reach product_id-index
+var productIndexLag = time.Second
+
+// containsProduct reports whether any live list holds a line of the product.
+// It is asked before a hard delete, so it retires the product first, and
+// lifts the retirement again when a line is found or the check fails. When
+// the product is free, the retirement is kept for the delete; release lifts
+// it should the delete fail.
+func (s *dynamoCartStore) containsProduct(ctx context.Context, productID int) (bool, func(), error) {
+	if err := s.retireProduct(ctx, productID); err != nil {
+		return false, nil, err
+	}
+	select {
+	case <-ctx.Done():
+		s.unretireProduct(productID)
+		return false, nil, ctx.Err()
+	case <-time.After(productIndexLag):
+	}
+
+	held, err := s.findLiveLine(ctx, productID)
+	if err != nil || held {
+		s.unretireProduct(productID)
+		return held, nil, err
+	}
+	return false, func() { s.unretireProduct(productID) }, nil
+}
+
+// findLiveLine looks for lines of the product through product_id-index.
+// The index is eventually consistent and still lists lines of carts that
+// expired but whose rows are not removed yet, so every hit is confirmed by
+// a consistent read of the line and its cart's META row.
+func (s *dynamoCartStore) findLiveLine(ctx context.Context, productID int) (bool, error) {
+	paginator := dynamodb.NewQueryPaginator(s.client, &dynamodb.QueryInput{
+		TableName:              aws.String(s.table),
+		IndexName:              aws.String(ProductIDIndexName),
+		KeyConditionExpression: aws.String("product_id = :product_id"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":product_id": attrInt(productID),
+		},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return false, fmt.Errorf("querying cart lines of product %d: %w", productID, err)
+		}
+		for _, row := range page.Items {
+			live, err := s.lineIsLive(ctx, attrString(row, "pk"), productID)
+			if err != nil {
+				return false, err
+			}
+			if live {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// lineIsLive reports whether a cart still holds a line of the product and
+// has not expired. A META row past its expires_at counts as gone, since TTL
+// may take a while to remove it.
+func (s *dynamoCartStore) lineIsLive(ctx context.Context, pk string, productID int) (bool, error) {
+	result, err := s.client.TransactGetItems(ctx, &dynamodb.TransactGetItemsInput{
+		TransactItems: []types.TransactGetItem{
+			{Get: &types.Get{TableName: aws.String(s.table), Key: s.key(pk, cartMetaSortKey)}},
+			{Get: &types.Get{TableName: aws.String(s.table), Key: s.key(pk, cartItemSortKey(productID))}},
+		},
+	})
+	if err != nil {
+		return false, fmt.Errorf("reading cart line: %w", err)
+	}
+	if len(result.Responses) != 2 || result.Responses[0].Item == nil || result.Responses[1].Item == nil {
+		return false, nil
+	}
+	expiresAt := attrInt64Value(result.Responses[0].Item, "expires_at")
+	return expiresAt == 0 || expiresAt > time.Now().Unix(), nil
+}
+
+// retireProduct writes the product's retirement row
+func (s *dynamoCartStore) retireProduct(ctx context.Context, productID int) error {
+	item := s.productRetiredKey(productID)
+	item["expires_at"] = attrInt64(time.Now().Add(productRetirementTTL).Unix())
+	if _, err := s.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.table),
+		Item:      item,
+	}); err != nil {
+		return fmt.Errorf("retiring product %d: %w", productID, err)
+	}
+	return nil
+}
+
+// unretireProduct deletes the product's retirement row, so lines can be
+// added again. It uses a fresh context, as the request's may be cancelled;
+// a row it fails to delete still expires.
+func (s *dynamoCartStore) unretireProduct(productID int) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := s.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(s.table),
+		Key:       s.productRetiredKey(productID),
+	}); err != nil {
+		log.Printf("Error lifting retirement of product %d: %v", productID, err)
+	}
+}
+
+// productRetired reports whether the product has a live retirement row
+func (s *dynamoCartStore) productRetired(ctx context.Context, productID int) (bool, error) {
+	result, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(s.table),
+		Key:            s.productRetiredKey(productID),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return false, fmt.Errorf("reading retirement of product %d: %w", productID, err)
+	}
+	return result.Item != nil && attrInt64Value(result.Item, "expires_at") > time.Now().Unix(), nil
+}
+
+// notRetiredCheck makes a transaction adding a line of the product fail if
+// the product was retired since productRetired was asked
+func (s *dynamoCartStore) notRetiredCheck(productID int) types.TransactWriteItem {
+	return types.TransactWriteItem{ConditionCheck: &types.ConditionCheck{
+		TableName:           aws.String(s.table),
+		Key:                 s.productRetiredKey(productID),
+		ConditionExpression: aws.String("attribute_not_exists(pk) OR expires_at <= :now"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now": attrInt64(time.Now().Unix()),
+		},
+	}}
+}
+
+func (s *dynamoCartStore) productRetiredKey(productID int) map[string]types.AttributeValue {
+	return s.key(productPartitionPrefix+strconv.Itoa(productID), productRetiredSortKey)
+}
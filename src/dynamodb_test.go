@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestIsWriteConflict(t *testing.T) {
+	conditionFailed := &types.ConditionalCheckFailedException{}
+	canceled := func(codes ...string) error {
+		reasons := make([]types.CancellationReason, len(codes))
+		for i, code := range codes {
+			reasons[i] = types.CancellationReason{Code: aws.String(code)}
+		}
+		return &types.TransactionCanceledException{CancellationReasons: reasons}
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"condition failed", conditionFailed, true},
+		{"wrapped", fmt.Errorf("updating cart: %w", conditionFailed), true},
+		{"transaction conflict", &types.TransactionConflictException{}, true},
+		{"canceled on condition", canceled("None", "ConditionalCheckFailed"), true},
+		{"canceled on conflict", canceled("TransactionConflict"), true},
+		{"canceled on throttling", canceled("None", "ThrottlingError"), false},
+		{"other service error", &types.ResourceNotFoundException{}, false},
+		{"plain error", errors.New("timeout"), false},
+		{"nil", nil, false},
+	}
+	for _, tt := range tests {
+		if got := isWriteConflict(tt.err); got != tt.want {
+			t.Errorf("%s: isWriteConflict = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
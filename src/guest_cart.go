@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// guestTokenPrefix starts every guest cart token, so a token in the :id path
+// parameter can never be mistaken for a customer ID
+const guestTokenPrefix = "guest_"
+
+// MergeRule decides the quantity of a product that is in both carts of a merge
+type MergeRule string
+
+const (
+	// MergeSum adds the two quantities
+	MergeSum MergeRule = "sum"
+	// MergeMax keeps the larger quantity
+	MergeMax MergeRule = "max"
+	// MergePreferLatest keeps the line that was written last
+	MergePreferLatest MergeRule = "prefer_latest"
+)
+
+// cartMergeRule is the rule merges use when the request names none, set in
+// main from CART_MERGE_STRATEGY
+var cartMergeRule = MergeSum
+
+// parseMergeRule checks a merge strategy name
+func parseMergeRule(value string) (MergeRule, bool) {
+	switch rule := MergeRule(value); rule {
+	case MergeSum, MergeMax, MergePreferLatest:
+		return rule, true
+	}
+	return "", false
+}
+
+// cartMergeRuleFromEnv reads CART_MERGE_STRATEGY (sum, max or prefer_latest)
+func cartMergeRuleFromEnv() MergeRule {
+	value := os.Getenv("CART_MERGE_STRATEGY")
+	if value == "" {
+		return MergeSum
+	}
+	rule, ok := parseMergeRule(value)
+	if !ok {
+		log.Printf("Warning: invalid CART_MERGE_STRATEGY %q, using %s", value, MergeSum)
+		return MergeSum
+	}
+	return rule
+}
+
+// newGuestToken returns a random, unguessable guest cart token
+func newGuestToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return guestTokenPrefix + hex.EncodeToString(b), nil
+}
+
+// isGuestToken reports whether a path parameter is a guest cart token
+func isGuestToken(id string) bool {
+	return strings.HasPrefix(id, guestTokenPrefix)
+}
+
+// merge combines the customer's and the guest's line for the same product.
+// The result keeps the customer line's identity; its quantity and recorded
+// price come from the rule.
+func (rule MergeRule) merge(customerLine, guestLine CartItem) CartItem {
+	merged := customerLine
+	switch rule {
+	case MergeSum:
+		merged.Quantity = customerLine.Quantity + guestLine.Quantity
+	case MergeMax:
+		if guestLine.Quantity > customerLine.Quantity {
+			merged.Quantity = guestLine.Quantity
+			merged.UnitPriceAtAdd = guestLine.UnitPriceAtAdd
+		}
+	case MergePreferLatest:
+		// On a tie the guest line wins, as the session being merged in
+		customerUpdated, _ := time.Parse(time.RFC3339, customerLine.UpdatedAt)
+		guestUpdated, _ := time.Parse(time.RFC3339, guestLine.UpdatedAt)
+		if !guestUpdated.Before(customerUpdated) {
+			merged.Quantity = guestLine.Quantity
+			merged.UnitPriceAtAdd = guestLine.UnitPriceAtAdd
+		}
+	}
+	return merged
+}
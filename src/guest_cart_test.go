@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestParseMergeRule(t *testing.T) {
+	tests := []struct {
+		value  string
+		want   MergeRule
+		wantOK bool
+	}{
+		{"sum", MergeSum, true},
+		{"max", MergeMax, true},
+		{"prefer_latest", MergePreferLatest, true},
+		{"", "", false},
+		{"SUM", "", false},
+		{"latest", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := parseMergeRule(tt.value)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("parseMergeRule(%q) = %q, %v; want %q, %v", tt.value, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
@@ -1,22 +1,16 @@
 package main
 
 import (
-	"context"
-	"database/sql"
 	"errors"
 	"fmt"
+	"io"
 	"log"
-	"math/rand"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
 )
 
 // CartItem represents an item in the shopping cart
@@ -28,17 +22,37 @@ type CartItem struct {
 	Manufacturer string `json:"manufacturer"`
 	Category     string `json:"category"`
 	Quantity     int    `json:"quantity"`
-	CreatedAt    string `json:"created_at"`
-	UpdatedAt    string `json:"updated_at"`
+	// UnitPrice (minor units of Currency) and Weight are the product's
+	// current values, per unit
+	UnitPrice int64 `json:"unit_price"`
+	// UnitPriceAtAdd is the unit price when the product was last added to
+	// the cart; nil for lines added before prices were recorded.
+	// PriceChanged is set by markPriceChanges when the two differ.
+	UnitPriceAtAdd *int64  `json:"unit_price_at_add"`
+	PriceChanged   bool    `json:"price_changed"`
+	Currency       string  `json:"currency"`
+	Weight         float64 `json:"weight"`
+	CreatedAt      string  `json:"created_at"`
+	UpdatedAt      string  `json:"updated_at"`
 }
 
 // ShoppingCart represents a complete shopping cart
 type ShoppingCart struct {
 	ID         int        `json:"id"`
 	CustomerID int        `json:"customer_id"`
+	Type       ListType   `json:"type"`
 	Items      []CartItem `json:"items"`
-	CreatedAt  string     `json:"created_at"`
-	UpdatedAt  string     `json:"updated_at"`
+	// Totals over Items, filled in by computeTotals. Subtotal is in minor
+	// units of Currency.
+	Subtotal    int64   `json:"subtotal"`
+	Currency    string  `json:"currency,omitempty"`
+	ItemCount   int     `json:"item_count"`
+	TotalWeight float64 `json:"total_weight"`
+	CreatedAt   string  `json:"created_at"`
+	UpdatedAt   string  `json:"updated_at"`
+	// ExpiresAt is when the cart counts as abandoned if nothing is written
+	// to it before, set by computeExpiry when carts expire
+	ExpiresAt string `json:"expires_at,omitempty"`
 }
 
 // createShoppingCart creates a new shopping cart
@@ -48,39 +62,14 @@ func createShoppingCart(c *gin.Context) {
 		CustomerID int `json:"customer_id" binding:"required"`
 	}
 
-	if err := c.ShouldBindJSON(&input); err != nil {
+	if err := c.ShouldBindJSON(&input); err != nil || input.CustomerID < 0 {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"error": "customer_id is required",
 		})
 		return
 	}
 
-	// Check if cart already exists for this customer
-	var existingCartID int
-	checkQuery := `SELECT id FROM shopping_carts WHERE customer_id = ?`
-	err := DB.QueryRow(checkQuery, input.CustomerID).Scan(&existingCartID)
-
-	if err == nil {
-		// Cart already exists, return it
-		c.JSON(http.StatusOK, gin.H{
-			"message":     "Shopping cart already exists for this customer",
-			"id":          existingCartID,
-			"customer_id": input.CustomerID,
-		})
-		return
-	}
-
-	if err != sql.ErrNoRows {
-		log.Printf("Error checking existing cart: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Internal server error",
-		})
-		return
-	}
-
-	// Insert new shopping cart
-	query := `INSERT INTO shopping_carts (customer_id) VALUES (?)`
-	result, err := DB.Exec(query, input.CustomerID)
+	cart, created, err := cartStore.CreateCart(c.Request.Context(), input.CustomerID, ListCart)
 	if err != nil {
 		log.Printf("Error creating shopping cart: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{
@@ -89,110 +78,145 @@ func createShoppingCart(c *gin.Context) {
 		return
 	}
 
-	// Get the inserted cart ID
-	cartID, err := result.LastInsertId()
-	if err != nil {
-		log.Printf("Error getting cart ID: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Failed to retrieve cart ID",
+	if !created {
+		// Cart already exists, return it
+		c.JSON(http.StatusOK, gin.H{
+			"message":     "Shopping cart already exists for this customer",
+			"id":          cart.ID,
+			"customer_id": cart.CustomerID,
 		})
 		return
 	}
 
 	// Return the created cart
 	c.JSON(http.StatusCreated, gin.H{
-		"id":          cartID,
-		"customer_id": input.CustomerID,
-		"message":     fmt.Sprintf("shopping cart %d created for customer %d", input.CustomerID, cartID),
-		"created_at":  time.Now().Format(time.RFC3339),
+		"id":          cart.ID,
+		"customer_id": cart.CustomerID,
+		"message":     fmt.Sprintf("shopping cart %d created for customer %d", cart.ID, cart.CustomerID),
+		"created_at":  cart.CreatedAt,
 	})
 }
 
-// getShoppingCart retrieves a shopping cart with all items by customer ID
-// GET /shopping-carts/:id (where id is customer_id)
-func getShoppingCart(c *gin.Context) {
-	customerIDParam := c.Param("id")
-
-	// Convert to integer
-	customerID, err := strconv.Atoi(customerIDParam)
+// createGuestCart creates a cart for a shopper who is not logged in. The
+// returned token stands in for the customer ID in every /shopping-carts/:id
+// route.
+// POST /guest-carts
+func createGuestCart(c *gin.Context) {
+	cart, token, err := cartStore.CreateGuestCart(c.Request.Context())
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "Invalid customer ID",
+		log.Printf("Error creating guest cart: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to create guest cart",
 		})
 		return
 	}
 
-	// Get cart details by customer_id
-	var cart ShoppingCart
-	cartQuery := `SELECT id, customer_id, created_at, updated_at
-                  FROM shopping_carts WHERE customer_id = ?`
+	c.JSON(http.StatusCreated, gin.H{
+		"id":         cart.ID,
+		"token":      token,
+		"message":    fmt.Sprintf("guest shopping cart %d created", cart.ID),
+		"created_at": cart.CreatedAt,
+	})
+}
 
-	err = DB.QueryRow(cartQuery, customerID).Scan(
-		&cart.ID,
-		&cart.CustomerID,
-		&cart.CreatedAt,
-		&cart.UpdatedAt,
-	)
+// createCustomerList creates one of the customer's lists, like
+// createShoppingCart does the cart
+// POST /customers/:id/lists
+func createCustomerList(c *gin.Context) {
+	customerID, ok := customerIDParam(c)
+	if !ok {
+		return
+	}
 
-	if err == sql.ErrNoRows {
-		c.JSON(http.StatusNotFound, gin.H{
-			"error": "Shopping cart not found for this customer",
+	var input struct {
+		Type string `json:"type" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "type is required",
 		})
 		return
 	}
+	list, ok := parseListType(input.Type)
+	if !ok {
+		respondInvalidListType(c)
+		return
+	}
+	if !listAllowed(c, customerID, list) {
+		return
+	}
 
+	cart, created, err := cartStore.CreateCart(c.Request.Context(), customerID, list)
 	if err != nil {
-		log.Printf("Database error retrieving cart: %v", err)
+		log.Printf("Error creating %s list: %v", list, err)
 		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Internal server error",
+			"error": "Failed to create list",
+		})
+		return
+	}
+
+	if !created {
+		c.JSON(http.StatusOK, gin.H{
+			"message":     "List already exists for this customer",
+			"id":          cart.ID,
+			"customer_id": cart.CustomerID,
+			"type":        cart.Type,
 		})
 		return
 	}
+	c.JSON(http.StatusCreated, gin.H{
+		"id":          cart.ID,
+		"customer_id": cart.CustomerID,
+		"type":        cart.Type,
+		"message":     fmt.Sprintf("%s list %d created for customer %d", cart.Type, cart.ID, cart.CustomerID),
+		"created_at":  cart.CreatedAt,
+	})
+}
 
-	// Get cart items with product details using efficient JOINs
-	itemsQuery := `
-        SELECT 
-            sci.id,
-            sci.product_id,
-			p.manufacturer,
-			p.category,
-            sci.quantity,
-            sci.created_at,
-            sci.updated_at
-        FROM shopping_cart_items sci
-        INNER JOIN products p ON sci.product_id = p.id
-        WHERE sci.shopping_cart_id = ?
-        ORDER BY sci.created_at DESC`
+// listCustomerLists returns all of the customer's lists with their items
+// GET /customers/:id/lists
+func listCustomerLists(c *gin.Context) {
+	customerID, ok := customerIDParam(c)
+	if !ok {
+		return
+	}
 
-	rows, err := DB.Query(itemsQuery, cart.ID)
+	lists, err := cartStore.ListCarts(c.Request.Context(), customerID)
 	if err != nil {
-		log.Printf("Database error retrieving cart items: %v", err)
+		log.Printf("Error listing lists of customer %d: %v", customerID, err)
 		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Internal server error",
+			"error": "Failed to list customer lists",
 		})
 		return
 	}
-	defer rows.Close()
-
-	// Collect all items
-	cart.Items = []CartItem{}
-	for rows.Next() {
-		var item CartItem
-		err := rows.Scan(
-			&item.ID,
-			&item.ProductID,
-			&item.Manufacturer,
-			&item.Category,
-			&item.Quantity,
-			&item.CreatedAt,
-			&item.UpdatedAt,
-		)
-		if err != nil {
-			log.Printf("Error scanning cart item: %v", err)
-			continue
-		}
-		cart.Items = append(cart.Items, item)
+	for i := range lists {
+		lists[i].computeTotals()
+		lists[i].markPriceChanges()
+		lists[i].computeExpiry()
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"customer_id": customerID,
+		"lists":       lists,
+	})
+}
+
+// getShoppingCart retrieves a shopping cart with all items by customer ID
+// GET /shopping-carts/:id (where id is customer_id)
+// GET /customers/:id/lists/:type
+func getShoppingCart(c *gin.Context) {
+	customerID, list, ok := cartParams(c)
+	if !ok {
+		return
+	}
+
+	cart, err := cartStore.GetCartByCustomer(c.Request.Context(), customerID, list)
+	if err != nil {
+		respondCartError(c, err, "Internal server error")
+		return
 	}
+	cart.computeTotals()
+	cart.markPriceChanges()
+	cart.computeExpiry()
 
 	// Return the cart with all items
 	c.JSON(http.StatusOK, cart)
@@ -200,15 +224,10 @@ func getShoppingCart(c *gin.Context) {
 
 // addItemToCart adds or updates an item in the shopping cart by customer ID
 // POST /shopping-carts/:id/items (where id is customer_id)
+// POST /customers/:id/lists/:type/items
 func addItemToCart(c *gin.Context) {
-	customerIDParam := c.Param("id")
-
-	// Convert to integer
-	customerID, err := strconv.Atoi(customerIDParam)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "Invalid customer ID",
-		})
+	customerID, list, ok := cartParams(c)
+	if !ok {
 		return
 	}
 
@@ -225,612 +244,553 @@ func addItemToCart(c *gin.Context) {
 		return
 	}
 
-	// Get cart ID from customer_id
-	var cartID int
-	getCartQuery := `SELECT id FROM shopping_carts WHERE customer_id = ?`
-	err = DB.QueryRow(getCartQuery, customerID).Scan(&cartID)
-
-	if err == sql.ErrNoRows {
-		c.JSON(http.StatusNotFound, gin.H{
-			"error": "Shopping cart not found for this customer",
-		})
+	ctx := c.Request.Context()
+	previous, level, err := reserveStockForAdd(ctx, customerID, list, input.ProductID, input.Quantity)
+	if err != nil {
+		respondStockError(c, err, level, "Failed to add item to cart")
 		return
 	}
 
+	item, created, err := cartStore.UpsertItem(ctx, customerID, list, input.ProductID, input.Quantity)
 	if err != nil {
-		log.Printf("Error finding cart: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Internal server error",
-		})
+		// Hold what the line held before the write that failed, nothing
+		// for a line that was not there
+		if list.reservesStock() {
+			restoreStock(ctx, customerID, input.ProductID, previous)
+		}
+		respondCartError(c, err, "Failed to add item to cart")
 		return
 	}
 
-	// Verify product exists
-	var productExists bool
-	checkProductQuery := `SELECT EXISTS(SELECT 1 FROM products WHERE id = ?)`
-	err = DB.QueryRow(checkProductQuery, input.ProductID).Scan(&productExists)
-	if err != nil {
-		log.Printf("Error checking product existence: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Internal server error",
-		})
+	statusCode := http.StatusOK
+	if created {
+		statusCode = http.StatusCreated
+	}
+
+	c.JSON(statusCode, gin.H{
+		"message": "Item added to cart successfully",
+		"item":    item,
+	})
+}
+
+// updateCartItem changes the quantity of a product already in the cart.
+// The body sets either an absolute quantity or a relative delta; a result
+// of zero removes the product from the cart.
+// PATCH /shopping-carts/:id/items/:productId (where id is customer_id)
+// PATCH /customers/:id/lists/:type/items/:productId
+func updateCartItem(c *gin.Context) {
+	customerID, list, ok := cartParams(c)
+	if !ok {
+		return
+	}
+	productID, ok := cartProductIDParam(c)
+	if !ok {
 		return
 	}
 
-	if !productExists {
+	var input QuantityUpdate
+	if err := c.ShouldBindJSON(&input); err != nil || (input.Quantity == nil) == (input.Delta == nil) {
 		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "Product not found",
+			"error": "exactly one of quantity or delta is required",
 		})
 		return
 	}
 
-	// Insert or update cart item (MySQL handles duplicate with ON DUPLICATE KEY UPDATE)
-	insertQuery := `
-        INSERT INTO shopping_cart_items (shopping_cart_id, product_id, quantity)
-        VALUES (?, ?, ?)
-        ON DUPLICATE KEY UPDATE 
-            quantity = VALUES(quantity),
-            updated_at = CURRENT_TIMESTAMP`
-
-	result, err := DB.Exec(insertQuery, cartID, input.ProductID, input.Quantity)
+	ctx := c.Request.Context()
+	previous, level, err := reserveStockForUpdate(ctx, customerID, list, productID, input)
 	if err != nil {
-		log.Printf("Error adding item to cart: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Failed to add item to cart",
-		})
+		respondStockError(c, err, level, "Failed to update cart item")
 		return
 	}
 
-	// Check if it was an insert or update
-	rowsAffected, _ := result.RowsAffected()
-
-	// Get the item details to return
-	var item CartItem
-	itemQuery := `
-        SELECT 
-            sci.id,
-            sci.product_id,
-            p.manufacturer,
-            p.category,
-            sci.quantity,
-            sci.created_at,
-            sci.updated_at
-        FROM shopping_cart_items sci
-        INNER JOIN products p ON sci.product_id = p.id
-        WHERE sci.shopping_cart_id = ? AND sci.product_id = ?`
-
-	err = DB.QueryRow(itemQuery, cartID, input.ProductID).Scan(
-		&item.ID,
-		&item.ProductID,
-		&item.Manufacturer,
-		&item.Category,
-		&item.Quantity,
-		&item.CreatedAt,
-		&item.UpdatedAt,
-	)
-
+	item, err := cartStore.UpdateItemQuantity(ctx, customerID, list, productID, input)
 	if err != nil {
-		log.Printf("Error retrieving added item: %v", err)
-		// Still return success since item was added
+		if previous > 0 {
+			restoreStock(ctx, customerID, productID, previous)
+		}
+		respondCartError(c, err, "Failed to update cart item")
+		return
+	}
+
+	if item.Quantity == 0 {
 		c.JSON(http.StatusOK, gin.H{
-			"message":    "Item added to cart",
-			"product_id": input.ProductID,
-			"quantity":   input.Quantity,
+			"message":    "Item removed from cart",
+			"product_id": productID,
 		})
 		return
 	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Cart item updated successfully",
+		"item":    item,
+	})
+}
 
-	statusCode := http.StatusOK
-	if rowsAffected == 1 {
-		statusCode = http.StatusCreated
+// removeCartItem takes a product out of the shopping cart
+// DELETE /shopping-carts/:id/items/:productId (where id is customer_id)
+// DELETE /customers/:id/lists/:type/items/:productId
+func removeCartItem(c *gin.Context) {
+	customerID, list, ok := cartParams(c)
+	if !ok {
+		return
+	}
+	productID, ok := cartProductIDParam(c)
+	if !ok {
+		return
 	}
 
-	c.JSON(statusCode, gin.H{
-		"message": "Item added to cart successfully",
-		"item":    item,
-	})
+	ctx := c.Request.Context()
+	if err := cartStore.RemoveItem(ctx, customerID, list, productID); err != nil {
+		respondCartError(c, err, "Failed to remove item from cart")
+		return
+	}
+	if list.reservesStock() {
+		releaseStock(ctx, customerID, productID)
+	}
+	c.Status(http.StatusNoContent)
 }
 
-// ============================================================================
-// DynamoDB Handlers (separate implementations alongside MySQL handlers)
-// ============================================================================
+// moveCartItem moves a product to another of the customer's lists, which is
+// created if needed. If the product is already in that list the quantities
+// are added up. Moving into the cart reserves stock; moving out of it
+// releases the reservation.
+// POST /shopping-carts/:id/items/:productId/move (where id is customer_id)
+// POST /customers/:id/lists/:type/items/:productId/move
+func moveCartItem(c *gin.Context) {
+	customerID, from, ok := cartParams(c)
+	if !ok {
+		return
+	}
+	productID, ok := cartProductIDParam(c)
+	if !ok {
+		return
+	}
 
-// createShoppingCartDynamoDB creates a new shopping cart using DynamoDB
-// POST /shopping-carts
-func createShoppingCartDynamoDB(c *gin.Context) {
 	var input struct {
-		CustomerID int `json:"customer_id" binding:"required"`
+		To string `json:"to" binding:"required"`
 	}
-
 	if err := c.ShouldBindJSON(&input); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "customer_id is required",
+			"error": "to is required",
 		})
 		return
 	}
-
-	ctx := context.Background()
-
-	// Check if cart already exists for this customer using GSI
-	queryInput := &dynamodb.QueryInput{
-		TableName:              aws.String(DynamoDBTableName),
-		IndexName:              aws.String(CustomerIDIndexName),
-		KeyConditionExpression: aws.String("customer_id = :customer_id"),
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":customer_id": &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", input.CustomerID)},
-		},
-		Limit: aws.Int32(1),
-	}
-
-	result, err := DynamoDBClient.Query(ctx, queryInput)
-	if err != nil {
-		// Check if it's a not found error or other error
-		var notFoundErr *types.ResourceNotFoundException
-		if errors.As(err, &notFoundErr) {
-			// Index doesn't exist yet or no results - continue to create
-		} else {
-			log.Printf("Error querying cart by customer_id: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"error": "Internal server error",
-			})
-			return
-		}
+	to, ok := parseListType(input.To)
+	if !ok {
+		respondInvalidListType(c)
+		return
 	}
-
-	// If cart exists, return it (matching MySQL behavior)
-	if result != nil && len(result.Items) > 0 {
-		var cartIDInt int
-		// First check for numeric_id field (preferred)
-		if numericIDAttr, ok := result.Items[0]["numeric_id"]; ok {
-			if numericIDMember, ok := numericIDAttr.(*types.AttributeValueMemberN); ok {
-				cartIDInt, _ = strconv.Atoi(numericIDMember.Value)
-			}
-		}
-		// If numeric_id not found, use a hash of cart_id UUID
-		if cartIDInt == 0 {
-			if cartIDAttr, ok := result.Items[0]["cart_id"]; ok {
-				if cartIDMember, ok := cartIDAttr.(*types.AttributeValueMemberS); ok {
-					// Use first few characters of UUID to generate numeric ID
-					// This is a simple approach - in production you'd store numeric_id
-					cartIDInt = int(cartIDMember.Value[0])*1000 + int(cartIDMember.Value[1])*10
-				}
-			}
-		}
-		c.JSON(http.StatusOK, gin.H{
-			"message":     "Shopping cart already exists for this customer",
-			"id":          cartIDInt,
-			"customer_id": input.CustomerID,
+	if to == from {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Item is already in this list",
 		})
 		return
 	}
+	if !listAllowed(c, customerID, to) {
+		return
+	}
 
-	// Generate UUID for partition key (cart_id)
-	cartIDUUID := uuid.New().String()
-	// Generate numeric ID for API response compatibility (use deterministic hash of UUID)
-	// Using first 8 chars of UUID hex as numeric base
-	cartIDInt := int(time.Now().UnixNano() % 100000000) // Use timestamp-based ID for simplicity
+	ctx := c.Request.Context()
+	if _, _, err := cartStore.CreateCart(ctx, customerID, to); err != nil {
+		respondCartError(c, err, "Failed to move cart item")
+		return
+	}
 
-	// Create new cart
-	now := time.Now().Format(time.RFC3339)
-	putInput := &dynamodb.PutItemInput{
-		TableName: aws.String(DynamoDBTableName),
-		Item: map[string]types.AttributeValue{
-			"cart_id":     &types.AttributeValueMemberS{Value: cartIDUUID},
-			"numeric_id":  &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", cartIDInt)},
-			"customer_id": &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", input.CustomerID)},
-			"cart_items":  &types.AttributeValueMemberL{Value: []types.AttributeValue{}}, // Empty items list
-			"created_at":  &types.AttributeValueMemberS{Value: now},
-			"updated_at":  &types.AttributeValueMemberS{Value: now},
-		},
+	previous := 0
+	if to.reservesStock() {
+		var level *StockLevel
+		var err error
+		if previous, level, err = reserveStockForMove(ctx, customerID, from, productID); err != nil {
+			respondStockError(c, err, level, "Failed to move cart item")
+			return
+		}
 	}
 
-	_, err = DynamoDBClient.PutItem(ctx, putInput)
+	item, err := cartStore.MoveItem(ctx, customerID, from, to, productID)
 	if err != nil {
-		log.Printf("Error creating shopping cart: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Failed to create shopping cart",
-		})
+		if to.reservesStock() {
+			restoreStock(ctx, customerID, productID, previous)
+		}
+		respondCartError(c, err, "Failed to move cart item")
 		return
 	}
+	if from.reservesStock() {
+		releaseStock(ctx, customerID, productID)
+	}
 
-	c.JSON(http.StatusCreated, gin.H{
-		"id":          cartIDInt,
-		"customer_id": input.CustomerID,
-		"message":     fmt.Sprintf("shopping cart %d created for customer %d", cartIDInt, input.CustomerID),
-		"created_at":  now,
+	c.JSON(http.StatusOK, gin.H{
+		"message": fmt.Sprintf("Item moved to %s", to),
+		"item":    item,
 	})
 }
 
-// getShoppingCartDynamoDB retrieves a shopping cart with all items by customer ID
-// GET /shopping-carts/:id (where id is customer_id)
-func getShoppingCartDynamoDB(c *gin.Context) {
-	customerIDParam := c.Param("id")
-
-	// Convert to integer
-	customerID, err := strconv.Atoi(customerIDParam)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "Invalid customer ID",
-		})
+// clearShoppingCart removes every item from the cart but keeps the cart
+// POST /shopping-carts/:id/clear (where id is customer_id)
+// POST /customers/:id/lists/:type/clear
+func clearShoppingCart(c *gin.Context) {
+	customerID, list, ok := cartParams(c)
+	if !ok {
 		return
 	}
 
-	ctx := context.Background()
-
-	// Query by customer_id using GSI
-	queryInput := &dynamodb.QueryInput{
-		TableName:              aws.String(DynamoDBTableName),
-		IndexName:              aws.String(CustomerIDIndexName),
-		KeyConditionExpression: aws.String("customer_id = :customer_id"),
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":customer_id": &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", customerID)},
-		},
-		Limit: aws.Int32(1),
-	}
-
-	result, err := DynamoDBClient.Query(ctx, queryInput)
-	if err != nil {
-		log.Printf("Error querying cart by customer_id: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Internal server error",
-		})
+	// Lines added between reading and clearing keep their reservation
+	// until it expires
+	ctx := c.Request.Context()
+	productIDs := cartProductIDs(ctx, customerID, list)
+	if err := cartStore.ClearCart(ctx, customerID, list); err != nil {
+		respondCartError(c, err, "Failed to clear shopping cart")
 		return
 	}
+	releaseStock(ctx, customerID, productIDs...)
+	c.Status(http.StatusNoContent)
+}
 
-	if len(result.Items) == 0 {
-		c.JSON(http.StatusNotFound, gin.H{
-			"error": "Shopping cart not found for this customer",
-		})
+// deleteShoppingCart deletes the cart and all of its items
+// DELETE /shopping-carts/:id (where id is customer_id)
+// DELETE /customers/:id/lists/:type
+func deleteShoppingCart(c *gin.Context) {
+	customerID, list, ok := cartParams(c)
+	if !ok {
 		return
 	}
 
-	// Extract cart data
-	item := result.Items[0]
-	var cart ShoppingCart
-
-	// Extract cart_id (numeric_id for API compatibility)
-	if numericIDAttr, ok := item["numeric_id"]; ok {
-		if numericIDMember, ok := numericIDAttr.(*types.AttributeValueMemberN); ok {
-			cart.ID, _ = strconv.Atoi(numericIDMember.Value)
-		}
-	} else if cartIDAttr, ok := item["cart_id"]; ok {
-		// Fallback to cart_id if numeric_id not found
-		if cartIDMember, ok := cartIDAttr.(*types.AttributeValueMemberS); ok {
-			// Try to parse as int (if stored as string representation)
-			cart.ID, _ = strconv.Atoi(cartIDMember.Value)
-		}
+	ctx := c.Request.Context()
+	productIDs := cartProductIDs(ctx, customerID, list)
+	if err := cartStore.DeleteCart(ctx, customerID, list); err != nil {
+		respondCartError(c, err, "Failed to delete shopping cart")
+		return
 	}
+	releaseStock(ctx, customerID, productIDs...)
+	c.Status(http.StatusNoContent)
+}
 
-	// Extract customer_id
-	if customerIDAttr, ok := item["customer_id"]; ok {
-		if customerIDMember, ok := customerIDAttr.(*types.AttributeValueMemberN); ok {
-			cart.CustomerID, _ = strconv.Atoi(customerIDMember.Value)
-		}
+// checkoutShoppingCart turns the cart into an order, takes the ordered units
+// off stock and empties the cart
+// POST /shopping-carts/:id/checkout (where id is customer_id)
+func checkoutShoppingCart(c *gin.Context) {
+	customerID, ok := customerIDParam(c)
+	if !ok {
+		return
 	}
 
-	// Extract timestamps
-	if createdAttr, ok := item["created_at"]; ok {
-		if createdMember, ok := createdAttr.(*types.AttributeValueMemberS); ok {
-			cart.CreatedAt = createdMember.Value
-		}
+	// The body is optional
+	var input struct {
+		AcceptPriceChanges bool `json:"accept_price_changes"`
 	}
-	if updatedAttr, ok := item["updated_at"]; ok {
-		if updatedMember, ok := updatedAttr.(*types.AttributeValueMemberS); ok {
-			cart.UpdatedAt = updatedMember.Value
-		}
+	if err := c.ShouldBindJSON(&input); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid checkout request",
+		})
+		return
 	}
 
-	// Extract items list
-	cart.Items = []CartItem{}
-	if itemsAttr, ok := item["cart_items"]; ok {
-		if itemsMember, ok := itemsAttr.(*types.AttributeValueMemberL); ok {
-			for _, itemAttr := range itemsMember.Value {
-				if itemMap, ok := itemAttr.(*types.AttributeValueMemberM); ok {
-					var cartItem CartItem
-					// Extract fields from item map
-					if idAttr, ok := itemMap.Value["id"]; ok {
-						if idMember, ok := idAttr.(*types.AttributeValueMemberN); ok {
-							cartItem.ID, _ = strconv.Atoi(idMember.Value)
-						}
-					}
-					if productIDAttr, ok := itemMap.Value["product_id"]; ok {
-						if productIDMember, ok := productIDAttr.(*types.AttributeValueMemberN); ok {
-							cartItem.ProductID, _ = strconv.Atoi(productIDMember.Value)
-						}
-					}
-					if quantityAttr, ok := itemMap.Value["quantity"]; ok {
-						if quantityMember, ok := quantityAttr.(*types.AttributeValueMemberN); ok {
-							cartItem.Quantity, _ = strconv.Atoi(quantityMember.Value)
-						}
-					}
-					if manufacturerAttr, ok := itemMap.Value["manufacturer"]; ok {
-						if manufacturerMember, ok := manufacturerAttr.(*types.AttributeValueMemberS); ok {
-							cartItem.Manufacturer = manufacturerMember.Value
-						}
-					}
-					if categoryAttr, ok := itemMap.Value["category"]; ok {
-						if categoryMember, ok := categoryAttr.(*types.AttributeValueMemberS); ok {
-							cartItem.Category = categoryMember.Value
-						}
-					}
-					if createdAtAttr, ok := itemMap.Value["created_at"]; ok {
-						if createdAtMember, ok := createdAtAttr.(*types.AttributeValueMemberS); ok {
-							cartItem.CreatedAt = createdAtMember.Value
-						}
-					}
-					if updatedAtAttr, ok := itemMap.Value["updated_at"]; ok {
-						if updatedAtMember, ok := updatedAtAttr.(*types.AttributeValueMemberS); ok {
-							cartItem.UpdatedAt = updatedAtMember.Value
-						}
-					}
-					cart.Items = append(cart.Items, cartItem)
-				}
-			}
-		}
+	order, err := orderStore.Checkout(c.Request.Context(), customerID, input.AcceptPriceChanges)
+	if err != nil {
+		respondCheckoutError(c, err)
+		return
 	}
-
-	// Return the cart with all items (matching MySQL format)
-	c.JSON(http.StatusOK, cart)
+	c.JSON(http.StatusCreated, order)
 }
 
-// addItemToCartDynamoDB adds or updates an item in the shopping cart by customer ID
-// POST /shopping-carts/:id/items (where id is customer_id)
-func addItemToCartDynamoDB(c *gin.Context) {
-	customerIDParam := c.Param("id")
-
-	// Convert to integer
-	customerID, err := strconv.Atoi(customerIDParam)
-	if err != nil {
+// mergeShoppingCart folds a guest cart into the customer's cart, typically
+// when the guest logs in. The customer's cart is created if needed. Products
+// in both carts are combined by the strategy in the body, or by
+// CART_MERGE_STRATEGY. The guest cart and its token are gone afterwards.
+// POST /shopping-carts/:id/merge (where id is customer_id)
+func mergeShoppingCart(c *gin.Context) {
+	customerID, ok := customerIDParam(c)
+	if !ok {
+		return
+	}
+	if customerID < 0 {
 		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "Invalid customer ID",
+			"error": "A guest cart can only be merged into a customer's cart",
 		})
 		return
 	}
 
-	// Parse request body
 	var input struct {
-		ProductID int `json:"product_id" binding:"required"`
-		Quantity  int `json:"quantity" binding:"required,min=1"`
+		GuestToken string `json:"guest_token" binding:"required"`
+		Strategy   string `json:"strategy"`
 	}
-
 	if err := c.ShouldBindJSON(&input); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "product_id and quantity (min 1) are required",
+			"error": "guest_token is required",
 		})
 		return
 	}
-
-	ctx := context.Background()
-
-	// Get cart by customer_id using GSI
-	queryInput := &dynamodb.QueryInput{
-		TableName:              aws.String(DynamoDBTableName),
-		IndexName:              aws.String(CustomerIDIndexName),
-		KeyConditionExpression: aws.String("customer_id = :customer_id"),
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":customer_id": &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", customerID)},
-		},
-		Limit: aws.Int32(1),
+	rule := cartMergeRule
+	if input.Strategy != "" {
+		var ok bool
+		if rule, ok = parseMergeRule(input.Strategy); !ok {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "strategy must be one of sum, max or prefer_latest",
+			})
+			return
+		}
 	}
 
-	result, err := DynamoDBClient.Query(ctx, queryInput)
+	ctx := c.Request.Context()
+	guestID, err := cartStore.GuestCustomerID(ctx, input.GuestToken)
 	if err != nil {
-		log.Printf("Error querying cart: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Internal server error",
-		})
+		respondMergeError(c, err)
 		return
 	}
-
-	if len(result.Items) == 0 {
-		c.JSON(http.StatusNotFound, gin.H{
-			"error": "Shopping cart not found for this customer",
-		})
+	if _, _, err := cartStore.CreateCart(ctx, customerID, ListCart); err != nil {
+		respondCartError(c, err, "Failed to merge shopping carts")
 		return
 	}
 
-	// Get cart_id from query result
-	var cartID string
-	if cartIDAttr, ok := result.Items[0]["cart_id"]; ok {
-		if cartIDMember, ok := cartIDAttr.(*types.AttributeValueMemberS); ok {
-			cartID = cartIDMember.Value
+	productIDs := cartProductIDs(ctx, guestID, ListCart)
+	if err := cartStore.MergeCarts(ctx, guestID, customerID, rule); err != nil {
+		if errors.Is(err, ErrCartNotFound) {
+			// Either cart may be the missing one: the customer's can be
+			// deleted again between creating it and merging
+			if _, guestErr := cartStore.GuestCustomerID(ctx, input.GuestToken); guestErr == nil {
+				respondCartError(c, err, "Failed to merge shopping carts")
+				return
+			}
 		}
+		respondMergeError(c, err)
+		return
 	}
 
-	// Validate cartID was extracted
-	if cartID == "" {
-		log.Printf("Error: cart_id not found in query result")
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Internal server error",
-		})
+	cart, err := cartStore.GetCartByCustomer(ctx, customerID, ListCart)
+	if err != nil {
+		respondCartError(c, err, "Failed to read merged shopping cart")
 		return
 	}
+	transferStock(ctx, guestID, customerID, cart, productIDs)
+	cart.computeTotals()
+	cart.markPriceChanges()
+	cart.computeExpiry()
+	c.JSON(http.StatusOK, cart)
+}
 
-	// Verify product exists (still need MySQL for product lookup)
-	// For now, we'll skip validation or use syncProducts map
-	var productExists bool
-	if value, exists := syncProducts.Load(input.ProductID); exists {
-		productExists = true
-		_ = value // Product found
+// respondMergeError answers a failed merge in which a missing cart is the
+// guest's
+func respondMergeError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, ErrCartNotFound):
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Guest cart not found",
+		})
+	case errors.Is(err, ErrCartTooLarge):
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "Shopping carts have too many lines to merge at once",
+		})
+	default:
+		respondCartError(c, err, "Failed to merge shopping carts")
 	}
+}
 
-	if !productExists {
-		// Try MySQL DB if available
-		if DB != nil {
-			var exists bool
-			checkProductQuery := `SELECT EXISTS(SELECT 1 FROM products WHERE id = ?)`
-			err = DB.QueryRow(checkProductQuery, input.ProductID).Scan(&exists)
-			if err == nil && exists {
-				productExists = true
-			}
-		}
+// respondCheckoutError answers a failed checkout. Carts that cannot be
+// checked out as they are get a 409 saying what to fix.
+func respondCheckoutError(c *gin.Context, err error) {
+	var stockErr *InsufficientStockError
+	switch {
+	case errors.As(err, &stockErr):
+		c.JSON(http.StatusConflict, gin.H{
+			"error":      "Insufficient stock",
+			"product_id": stockErr.Level.ProductID,
+			"available":  stockErr.Level.Available,
+		})
+	case errors.Is(err, ErrCartEmpty):
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "Shopping cart is empty",
+		})
+	case errors.Is(err, ErrPriceChanged):
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "Prices changed since items were added, review the cart or set accept_price_changes",
+		})
+	case errors.Is(err, ErrMixedCurrencies):
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "Shopping cart mixes currencies",
+		})
+	case errors.Is(err, ErrCartTooLarge):
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "Shopping cart has too many lines to check out at once",
+		})
+	default:
+		respondCartError(c, err, "Failed to check out shopping cart")
 	}
+}
 
-	if !productExists {
+// getOrder returns an order with its items
+// GET /orders/:id
+func getOrder(c *gin.Context) {
+	orderID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "Product not found",
+			"error": "Invalid order ID",
 		})
 		return
 	}
 
-	// Get product details for manufacturer and category
-	var manufacturer, category string
-	if value, exists := syncProducts.Load(input.ProductID); exists {
-		product := value.(Item)
-		manufacturer = product.Manufacturer
-		category = product.Category
-	} else if DB != nil {
-		// Query MySQL for product details
-		query := `SELECT manufacturer, category FROM products WHERE id = ?`
-		err = DB.QueryRow(query, input.ProductID).Scan(&manufacturer, &category)
-		if err != nil {
-			log.Printf("Error getting product details: %v", err)
-			manufacturer = ""
-			category = ""
-		}
-	}
-
-	// Get current cart to update items
-	getInput := &dynamodb.GetItemInput{
-		TableName: aws.String(DynamoDBTableName),
-		Key: map[string]types.AttributeValue{
-			"cart_id": &types.AttributeValueMemberS{Value: cartID},
-		},
+	order, err := orderStore.GetOrder(c.Request.Context(), orderID)
+	if errors.Is(err, ErrOrderNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Order not found",
+		})
+		return
 	}
-
-	cartResult, err := DynamoDBClient.GetItem(ctx, getInput)
 	if err != nil {
-		log.Printf("Error getting cart: %v", err)
+		log.Printf("Error reading order %d: %v", orderID, err)
 		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Internal server error",
+			"error": "Failed to read order",
 		})
 		return
 	}
+	c.JSON(http.StatusOK, order)
+}
 
-	if cartResult.Item == nil {
-		c.JSON(http.StatusNotFound, gin.H{
-			"error": "Shopping cart not found",
+// listCustomerOrders returns a customer's orders, newest first
+// GET /customers/:id/orders
+func listCustomerOrders(c *gin.Context) {
+	customerID, ok := customerIDParam(c)
+	if !ok {
+		return
+	}
+
+	orders, err := orderStore.ListOrders(c.Request.Context(), customerID)
+	if err != nil {
+		log.Printf("Error listing orders of customer %d: %v", customerID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to list orders",
 		})
 		return
 	}
+	c.JSON(http.StatusOK, gin.H{
+		"customer_id": customerID,
+		"orders":      orders,
+	})
+}
 
-	// Extract existing items
-	var existingItems []types.AttributeValue
-	if itemsAttr, ok := cartResult.Item["cart_items"]; ok {
-		if itemsMember, ok := itemsAttr.(*types.AttributeValueMemberL); ok {
-			existingItems = itemsMember.Value
+// getCartMetrics reports how this task expires abandoned carts and how many
+// it has deleted
+// GET /metrics/carts
+func getCartMetrics(c *gin.Context) {
+	c.JSON(http.StatusOK, cartExpirySnapshot())
+}
+
+// customerIDParam parses the :id path parameter, writing an error response
+// on failure. A guest cart token resolves to its guest customer ID; guest
+// IDs themselves are not accepted, so only the token reaches a guest cart.
+func customerIDParam(c *gin.Context) (int, bool) {
+	if id := c.Param("id"); isGuestToken(id) {
+		guestID, err := cartStore.GuestCustomerID(c.Request.Context(), id)
+		if err != nil {
+			respondCartError(c, err, "Failed to resolve guest cart")
+			return 0, false
 		}
+		return guestID, true
 	}
 
-	// Check if item already exists and update, or add new
-	now := time.Now().Format(time.RFC3339)
-	foundIndex := -1
-	for i, itemAttr := range existingItems {
-		if itemMap, ok := itemAttr.(*types.AttributeValueMemberM); ok {
-			if productIDAttr, ok := itemMap.Value["product_id"]; ok {
-				if productIDMember, ok := productIDAttr.(*types.AttributeValueMemberN); ok {
-					if productIDMember.Value == fmt.Sprintf("%d", input.ProductID) {
-						foundIndex = i
-						break
-					}
-				}
-			}
-		}
+	customerID, err := strconv.Atoi(c.Param("id"))
+	if err != nil || customerID < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid customer ID",
+		})
+		return 0, false
 	}
+	return customerID, true
+}
 
-	// Create/update item
-	newItem := map[string]types.AttributeValue{
-		"product_id":   &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", input.ProductID)},
-		"quantity":     &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", input.Quantity)},
-		"manufacturer": &types.AttributeValueMemberS{Value: manufacturer},
-		"category":     &types.AttributeValueMemberS{Value: category},
-		"updated_at":   &types.AttributeValueMemberS{Value: now},
-	}
-
-	// Generate item ID if new item
-	if foundIndex == -1 {
-		// New item - generate ID based on position
-		itemID := len(existingItems) + 1
-		newItem["id"] = &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", itemID)}
-		newItem["created_at"] = &types.AttributeValueMemberS{Value: now}
-		existingItems = append(existingItems, &types.AttributeValueMemberM{Value: newItem})
-	} else {
-		// Update existing item
-		if existingItemMap, ok := existingItems[foundIndex].(*types.AttributeValueMemberM); ok {
-			// Preserve existing id and created_at
-			if idAttr, ok := existingItemMap.Value["id"]; ok {
-				newItem["id"] = idAttr
-			}
-			if createdAtAttr, ok := existingItemMap.Value["created_at"]; ok {
-				newItem["created_at"] = createdAtAttr
-			}
-			existingItems[foundIndex] = &types.AttributeValueMemberM{Value: newItem}
+// cartParams parses the :id and :type path parameters of the cart and list
+// routes, writing an error response on failure. Routes without :type
+// address the customer's cart.
+func cartParams(c *gin.Context) (int, ListType, bool) {
+	customerID, ok := customerIDParam(c)
+	if !ok {
+		return 0, "", false
+	}
+	list := ListCart
+	if value := c.Param("type"); value != "" {
+		if list, ok = parseListType(value); !ok {
+			respondInvalidListType(c)
+			return 0, "", false
 		}
 	}
+	if !listAllowed(c, customerID, list) {
+		return 0, "", false
+	}
+	return customerID, list, true
+}
 
-	// Update cart with new items
-	updateInput := &dynamodb.UpdateItemInput{
-		TableName: aws.String(DynamoDBTableName),
-		Key: map[string]types.AttributeValue{
-			"cart_id": &types.AttributeValueMemberS{Value: cartID},
-		},
-		UpdateExpression: aws.String("SET cart_items = :cart_items, updated_at = :updated_at"),
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":cart_items": &types.AttributeValueMemberL{Value: existingItems},
-			":updated_at": &types.AttributeValueMemberS{Value: now},
-		},
-		ReturnValues: types.ReturnValueAllNew,
+// listAllowed writes a 400 and returns false when a guest asks for a list
+// other than the cart, the only list guests have
+func listAllowed(c *gin.Context, customerID int, list ListType) bool {
+	if customerID < 0 && list != ListCart {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Guests only have a shopping cart",
+		})
+		return false
 	}
+	return true
+}
+
+func respondInvalidListType(c *gin.Context) {
+	c.JSON(http.StatusBadRequest, gin.H{
+		"error": "list type must be one of cart, wishlist or saved",
+	})
+}
 
-	updateResult, err := DynamoDBClient.UpdateItem(ctx, updateInput)
+// cartProductIDParam parses the :productId path parameter, writing a 400 on failure
+func cartProductIDParam(c *gin.Context) (int, bool) {
+	productID, err := strconv.Atoi(c.Param("productId"))
 	if err != nil {
-		log.Printf("Error updating cart: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Failed to add item to cart",
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid product ID",
 		})
-		return
+		return 0, false
 	}
+	return productID, true
+}
 
-	// Build response item (matching MySQL format)
-	var responseItem CartItem
-	if foundIndex == -1 {
-		// New item
-		responseItem.ID = len(existingItems)
-		responseItem.CreatedAt = now
-	} else {
-		// Updated item - extract from update result
-		if itemsAttr, ok := updateResult.Attributes["cart_items"]; ok {
-			if itemsMember, ok := itemsAttr.(*types.AttributeValueMemberL); ok && len(itemsMember.Value) > foundIndex {
-				if itemMap, ok := itemsMember.Value[foundIndex].(*types.AttributeValueMemberM); ok {
-					if idAttr, ok := itemMap.Value["id"]; ok {
-						if idMember, ok := idAttr.(*types.AttributeValueMemberN); ok {
-							responseItem.ID, _ = strconv.Atoi(idMember.Value)
-						}
-					}
-					if createdAtAttr, ok := itemMap.Value["created_at"]; ok {
-						if createdAtMember, ok := createdAtAttr.(*types.AttributeValueMemberS); ok {
-							responseItem.CreatedAt = createdAtMember.Value
-						}
-					}
-				}
-			}
-		}
+// respondCartError maps CartStore errors to the shared error responses.
+// Unexpected errors are logged and answered with internalMessage.
+func respondCartError(c *gin.Context, err error, internalMessage string) {
+	switch {
+	case errors.Is(err, ErrCartNotFound):
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Shopping cart not found for this customer",
+		})
+	case errors.Is(err, ErrProductNotFound):
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Product not found",
+		})
+	case errors.Is(err, ErrItemNotFound):
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Item not found in shopping cart",
+		})
+	case errors.Is(err, ErrInvalidQuantity):
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Quantity cannot go below zero",
+		})
+	case errors.Is(err, ErrConcurrentModification):
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "Shopping cart was modified concurrently, please retry",
+		})
+	default:
+		log.Printf("Shopping cart error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": internalMessage,
+		})
 	}
-	responseItem.ProductID = input.ProductID
-	responseItem.Quantity = input.Quantity
-	responseItem.Manufacturer = manufacturer
-	responseItem.Category = category
-	responseItem.UpdatedAt = now
+}
 
-	statusCode := http.StatusOK
-	if foundIndex == -1 {
-		statusCode = http.StatusCreated
+// respondStockError answers a failed stock reservation. Running out of
+// stock is a 409 that tells the client how many units it can have; other
+// errors are answered like respondCartError.
+func respondStockError(c *gin.Context, err error, level *StockLevel, internalMessage string) {
+	if errors.Is(err, ErrInsufficientStock) {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":      "Insufficient stock",
+			"product_id": level.ProductID,
+			"available":  level.Available,
+		})
+		return
 	}
-
-	c.JSON(statusCode, gin.H{
-		"message": "Item added to cart successfully",
-		"item":    responseItem,
-	})
+	respondCartError(c, err, internalMessage)
 }
 
 func searchProducts(c *gin.Context) {
@@ -845,46 +805,16 @@ func searchProducts(c *gin.Context) {
 	}()
 	startTime := time.Now()
 
-	// Extract query parameter
-	query := c.Query("q")
-	if query == "" {
-		c.JSON(400, gin.H{"error": "Query parameter 'q' is required"})
+	// Parse the query, filters, sort and page
+	req, err := parseSearchRequest(c)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
-	// Convert query to lowercase for case-insensitive search
-	queryLower := strings.ToLower(query)
-
-	// Generate 100 random product IDs (1-100000)
-	randomIDs := generateRandomIDs(100, 1, 100000)
-
-	// Search for matching products
-	var matchingProducts []Item
-	totalFound := 0
-	totalSearched := 0
-
-	for _, productID := range randomIDs {
-		// Check if product exists in map
-		totalSearched++
-		if value, exists := syncProducts.Load(productID); exists {
-			// Check if query matches name, category, or brand (case-insensitive)
-			item := value.(Item)
-			nameLower := strings.ToLower(item.Name)
-			categoryLower := strings.ToLower(item.Category)
-			brandLower := strings.ToLower(item.Brand)
 
-			if strings.Contains(nameLower, queryLower) ||
-				strings.Contains(categoryLower, queryLower) ||
-				strings.Contains(brandLower, queryLower) {
-
-				totalFound++
-
-				// Add to results if we haven't reached 20 items yet
-				if len(matchingProducts) < 20 {
-					matchingProducts = append(matchingProducts, item)
-				}
-			}
-		}
-	}
+	// Match and order across the whole catalog, then cut out the page
+	matches := req.run()
+	matchingProducts, nextCursor := req.page(matches)
 
 	// Calculate search duration
 	duration := time.Since(startTime)
@@ -893,9 +823,21 @@ func searchProducts(c *gin.Context) {
 	// Create response
 	response := SearchResponse{
 		Products:      matchingProducts,
-		TotalFound:    totalFound,
-		TotalSearched: totalSearched,
+		TotalFound:    len(matches),
+		TotalSearched: catalogIndex.Len(),
 		SearchTime:    searchTime,
+		Limit:         req.Limit,
+		Offset:        req.Offset,
+		NextCursor:    nextCursor,
+		Sort:          req.Sort,
+		Order:         "asc",
+		Facets:        req.facets(matches),
+	}
+	if req.Desc {
+		response.Order = "desc"
+	}
+	if req.Filters.active() {
+		response.Filters = &req.Filters
 	}
 
 	// Return empty array instead of null if no products found
@@ -906,13 +848,40 @@ func searchProducts(c *gin.Context) {
 	c.JSON(200, response)
 }
 
-// generateRandomIDs generates n random integers between min and max (inclusive)
-func generateRandomIDs(n, min, max int) []int {
-	ids := make([]int, n)
-	for i := 0; i < n; i++ {
-		ids[i] = rand.Intn(max-min+1) + min
+// suggestProducts returns autocomplete suggestions for a partly typed
+// query: matching brands, categories and product names, typos tolerated
+// GET /products/suggest?q={query}&limit={n}
+func suggestProducts(c *gin.Context) {
+	startTime := time.Now()
+
+	query := strings.TrimSpace(c.Query("q"))
+	if query == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Query parameter 'q' is required"})
+		return
 	}
-	return ids
+	if len(query) > 100 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Query parameter 'q' must be at most 100 characters"})
+		return
+	}
+	limit := defaultSuggestLimit
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxSuggestLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxSuggestLimit)})
+			return
+		}
+		limit = n
+	}
+
+	suggestions := catalogIndex.Suggest(query, limit)
+	if suggestions == nil {
+		suggestions = []Suggestion{}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"query":       query,
+		"suggestions": suggestions,
+		"search_time": fmt.Sprintf("%.3fs", time.Since(startTime).Seconds()),
+	})
 }
 
 // postAlbums adds an album from JSON received in the request body.
@@ -940,23 +909,12 @@ func postItem(c *gin.Context) {
 		return
 	}
 
-	// Check if product exists in map
-	_, exists := syncProducts.Load(productID)
-	if !exists {
-		c.JSON(http.StatusNotFound, gin.H{
-			"error":   "NOT_FOUND",
-			"message": "product not found",
-			"details": fmt.Sprintf("no item with ID %d", productID),
-		})
-		return
-	}
-
 	// Call BindJSON to bind the received JSON (from request body) to
 	// newItem.
 	// if err := c.BindJSON(&newItem); err != nil {
 	// 	return
 	// }
-	var newDetails Item
+	var newDetails ProductUpdate
 	if err := c.ShouldBindJSON(&newDetails); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"error":   "INVALID_INPUT",
@@ -976,12 +934,208 @@ func postItem(c *gin.Context) {
 		return
 	}
 
-	// Add the new details to the corresponding product.
-	syncProducts.Store(productID, newDetails)
+	// Omitted price and currency keep the stored values, which were
+	// validated when written; stand in valid ones to check the rest
+	if err := validateProduct(newDetails.apply(Item{Currency: defaultCurrency})); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "INVALID_INPUT",
+			"message": "The provided input data is invalid",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	// Write through to the product store first, so the change survives a
+	// restart and reaches the other tasks; only then update this task's cache
+	stored, err := productStore.UpdateProduct(c.Request.Context(), newDetails)
+	if err != nil {
+		respondProductError(c, err, productID, newDetails.SKU, "failed to save product")
+		return
+	}
+	cacheProduct(*stored)
 
 	c.Status(http.StatusNoContent)
 }
 
+// createProduct adds a product to the catalog under a server-assigned ID
+// POST /products
+func createProduct(c *gin.Context) {
+	var newItem Item
+	if err := c.ShouldBindJSON(&newItem); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "INVALID_INPUT",
+			"message": "The provided input data is invalid",
+			"details": err.Error(),
+		})
+		return
+	}
+	if newItem.ID != 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "INVALID_INPUT",
+			"message": "data input invalid",
+			"details": "product_id is assigned by the server",
+		})
+		return
+	}
+	if newItem.Currency == "" {
+		newItem.Currency = defaultCurrency
+	}
+	if err := validateProduct(newItem); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "INVALID_INPUT",
+			"message": "The provided input data is invalid",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	stored, err := productStore.CreateProduct(c.Request.Context(), newItem)
+	if err != nil {
+		respondProductError(c, err, 0, newItem.SKU, "failed to create product")
+		return
+	}
+	cacheProduct(*stored)
+
+	c.Header("Location", fmt.Sprintf("/products/%d", stored.ID))
+	c.JSON(http.StatusCreated, stored)
+}
+
+// deleteProduct retires a product. Products still in a cart cannot be
+// deleted (409) unless ?soft=true, which hides the product from the catalog
+// but keeps existing cart lines intact.
+// DELETE /products/:productId
+func deleteProduct(c *gin.Context) {
+	productID, err := strconv.Atoi(c.Param("productId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "INVALID_INPUT",
+			"message": "data input invalid",
+			"details": "invalid productId",
+		})
+		return
+	}
+	soft, err := strconv.ParseBool(c.DefaultQuery("soft", "false"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "INVALID_INPUT",
+			"message": "data input invalid",
+			"details": "soft must be true or false",
+		})
+		return
+	}
+
+	if err := productStore.DeleteProduct(c.Request.Context(), productID, soft); err != nil {
+		respondProductError(c, err, productID, "", "failed to delete product")
+		return
+	}
+	evictProduct(productID)
+
+	c.Status(http.StatusNoContent)
+}
+
+// getProductStock returns a product's stock. Products without a stock
+// record are not limited and report tracked: false.
+// GET /products/:productId/stock
+func getProductStock(c *gin.Context) {
+	productID, ok := stockProductIDParam(c)
+	if !ok {
+		return
+	}
+
+	level, err := inventoryStore.GetStock(c.Request.Context(), productID)
+	if errors.Is(err, ErrStockNotTracked) {
+		c.JSON(http.StatusOK, gin.H{
+			"product_id": productID,
+			"tracked":    false,
+		})
+		return
+	}
+	if err != nil {
+		respondProductError(c, err, productID, "", "failed to read stock")
+		return
+	}
+	c.JSON(http.StatusOK, level)
+}
+
+// setProductStock sets the units on hand, which starts tracking the product
+// PUT /products/:productId/stock
+func setProductStock(c *gin.Context) {
+	productID, ok := stockProductIDParam(c)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		OnHand *int `json:"on_hand" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil || *input.OnHand < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "INVALID_INPUT",
+			"message": "The provided input data is invalid",
+			"details": "on_hand must be a non-negative integer",
+		})
+		return
+	}
+
+	level, err := inventoryStore.SetStock(c.Request.Context(), productID, *input.OnHand)
+	if err != nil {
+		respondProductError(c, err, productID, "", "failed to set stock")
+		return
+	}
+	c.JSON(http.StatusOK, level)
+}
+
+// stockProductIDParam parses :productId for the stock endpoints and checks
+// the product is in the catalog, writing a 400 or 404 on failure
+func stockProductIDParam(c *gin.Context) (int, bool) {
+	productID, err := strconv.Atoi(c.Param("productId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "INVALID_INPUT",
+			"message": "data input invalid",
+			"details": "invalid productId",
+		})
+		return 0, false
+	}
+	if _, exists := syncProducts.Load(productID); !exists {
+		respondProductError(c, ErrProductNotFound, productID, "", "")
+		return 0, false
+	}
+	return productID, true
+}
+
+// respondProductError maps ProductStore errors to the products API error shape.
+// Unexpected errors are logged and answered with internalDetails.
+func respondProductError(c *gin.Context, err error, productID int, sku, internalDetails string) {
+	switch {
+	case errors.Is(err, ErrProductNotFound):
+		c.JSON(http.StatusNotFound, gin.H{
+			"error":   "NOT_FOUND",
+			"message": "product not found",
+			"details": fmt.Sprintf("no item with ID %d", productID),
+		})
+	case errors.Is(err, ErrDuplicateSKU):
+		c.JSON(http.StatusConflict, gin.H{
+			"error":   "CONFLICT",
+			"message": "sku already in use",
+			"details": fmt.Sprintf("sku %s belongs to another product", sku),
+		})
+	case errors.Is(err, ErrProductInCart):
+		c.JSON(http.StatusConflict, gin.H{
+			"error":   "CONFLICT",
+			"message": "product is in a shopping cart",
+			"details": "remove it from all carts first, or delete with ?soft=true",
+		})
+	default:
+		log.Printf("Error writing product %d: %v", productID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "INTERNAL_SERVER_ERROR",
+			"message": "something went wrong",
+			"details": internalDetails,
+		})
+	}
+}
+
 // getItemByID locates the item whose ID value matches the productId
 // parameter sent by the client, then returns that item as a response.
 func getItemByID(c *gin.Context) {
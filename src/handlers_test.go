@@ -0,0 +1,724 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// testProductCount is the size of the catalog newTestRouter generates
+const testProductCount = 20
+
+// newTestRouter points every store at a fresh memory backend, as
+// DATABASE_TYPE=memory does, and returns the API routes over them
+func newTestRouter(t *testing.T) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	carts := NewMemoryCartStore().(*memoryCartStore)
+	inventory := NewMemoryInventoryStore().(*memoryInventoryStore)
+	cartStore = carts
+	idempotencyStore = NewMemoryIdempotencyStore()
+	inventoryStore = inventory
+	orderStore = NewMemoryOrderStore(carts, inventory)
+	cartMergeRule = MergeSum
+	stockReservationTTL = 0
+	productStore = NewMemoryProductStore(GenerateProducts(testProductCount, 1), carts.containsProduct)
+	if _, _, err := loadCatalog(context.Background(), productStore); err != nil {
+		t.Fatalf("loading catalog: %v", err)
+	}
+
+	router := gin.New()
+	registerRoutes(router, time.Hour)
+	return router
+}
+
+// serve sends one request through router. Headers come in name, value pairs.
+func serve(router *gin.Engine, method, path, body string, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// mustServe is serve for setup steps, failing the test unless the response has status want
+func mustServe(t *testing.T, router *gin.Engine, want int, method, path, body string, headers ...string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := serve(router, method, path, body, headers...)
+	if w.Code != want {
+		t.Fatalf("%s %s: status %d, want %d: %s", method, path, w.Code, want, w.Body)
+	}
+	return w
+}
+
+// decodeCart reads a ShoppingCart response body
+func decodeCart(t *testing.T, w *httptest.ResponseRecorder) ShoppingCart {
+	t.Helper()
+	var cart ShoppingCart
+	if err := json.Unmarshal(w.Body.Bytes(), &cart); err != nil {
+		t.Fatalf("decoding cart: %v: %s", err, w.Body)
+	}
+	return cart
+}
+
+// quantities maps each product in the cart to its quantity
+func quantities(cart ShoppingCart) map[int]int {
+	q := make(map[int]int, len(cart.Items))
+	for _, item := range cart.Items {
+		q[item.ProductID] = item.Quantity
+	}
+	return q
+}
+
+// cartStep is one request of a test that walks a cart through its endpoints
+type cartStep struct {
+	name         string
+	method, path string
+	body         string
+	want         int
+}
+
+// runCartSteps serves steps in order, each against the state the steps
+// before it left, and stops at the first unexpected status
+func runCartSteps(t *testing.T, router *gin.Engine, steps []cartStep) {
+	t.Helper()
+	for _, step := range steps {
+		w := serve(router, step.method, step.path, step.body)
+		if w.Code != step.want {
+			t.Fatalf("%s: %s %s: status %d, want %d: %s", step.name, step.method, step.path, w.Code, step.want, w.Body)
+		}
+	}
+}
+
+func TestCartEndpoints(t *testing.T) {
+	router := newTestRouter(t)
+	runCartSteps(t, router, []cartStep{
+		{"get missing cart", "GET", "/shopping-carts/1", "", http.StatusNotFound},
+		{"get invalid customer", "GET", "/shopping-carts/abc", "", http.StatusBadRequest},
+		{"create without customer", "POST", "/shopping-carts", `{}`, http.StatusBadRequest},
+		{"create", "POST", "/shopping-carts", `{"customer_id":1}`, http.StatusCreated},
+		{"create again", "POST", "/shopping-carts", `{"customer_id":1}`, http.StatusOK},
+		{"add to missing cart", "POST", "/shopping-carts/2/items", `{"product_id":1,"quantity":1}`, http.StatusNotFound},
+		{"add zero quantity", "POST", "/shopping-carts/1/items", `{"product_id":1,"quantity":0}`, http.StatusBadRequest},
+		{"add unknown product", "POST", "/shopping-carts/1/items", `{"product_id":9999,"quantity":1}`, http.StatusBadRequest},
+		{"add", "POST", "/shopping-carts/1/items", `{"product_id":1,"quantity":2}`, http.StatusCreated},
+		{"upsert", "POST", "/shopping-carts/1/items", `{"product_id":1,"quantity":3}`, http.StatusOK},
+		{"add second line", "POST", "/shopping-carts/1/items", `{"product_id":2,"quantity":1}`, http.StatusCreated},
+	})
+
+	cart := decodeCart(t, mustServe(t, router, http.StatusOK, "GET", "/shopping-carts/1", ""))
+	if got := quantities(cart); len(got) != 2 || got[1] != 3 || got[2] != 1 {
+		t.Errorf("cart quantities = %v, want map[1:3 2:1]", got)
+	}
+	if cart.CustomerID != 1 || cart.Items[0].ProductID != 2 {
+		t.Errorf("cart = customer %d, first line product %d; want customer 1, newest line first", cart.CustomerID, cart.Items[0].ProductID)
+	}
+
+	// Totals come from the catalog's current prices
+	first, _ := syncProducts.Load(1)
+	second, _ := syncProducts.Load(2)
+	wantSubtotal := 3*first.(Item).Price + second.(Item).Price
+	if cart.ItemCount != 4 || cart.Subtotal != wantSubtotal || cart.Currency != defaultCurrency {
+		t.Errorf("totals = %d items, subtotal %d %s; want 4 items, subtotal %d %s",
+			cart.ItemCount, cart.Subtotal, cart.Currency, wantSubtotal, defaultCurrency)
+	}
+}
+
+func TestConcurrentCreateCart(t *testing.T) {
+	router := newTestRouter(t)
+
+	const requests = 20
+	codes := make(chan int, requests)
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- serve(router, "POST", "/shopping-carts", `{"customer_id":1}`).Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	created := 0
+	for code := range codes {
+		switch code {
+		case http.StatusCreated:
+			created++
+		case http.StatusOK:
+		default:
+			t.Errorf("create: status %d, want 201 or 200", code)
+		}
+	}
+	if created != 1 {
+		t.Errorf("%d of %d concurrent creates returned 201, want exactly 1", created, requests)
+	}
+}
+
+func TestCartItemEndpoints(t *testing.T) {
+	router := newTestRouter(t)
+	runCartSteps(t, router, []cartStep{
+		{"create", "POST", "/shopping-carts", `{"customer_id":1}`, http.StatusCreated},
+		{"add", "POST", "/shopping-carts/1/items", `{"product_id":1,"quantity":3}`, http.StatusCreated},
+		{"add second line", "POST", "/shopping-carts/1/items", `{"product_id":2,"quantity":1}`, http.StatusCreated},
+		{"patch delta", "PATCH", "/shopping-carts/1/items/1", `{"delta":2}`, http.StatusOK},
+		{"patch both fields", "PATCH", "/shopping-carts/1/items/1", `{"quantity":1,"delta":1}`, http.StatusBadRequest},
+		{"patch neither field", "PATCH", "/shopping-carts/1/items/1", `{}`, http.StatusBadRequest},
+		{"patch below zero", "PATCH", "/shopping-carts/1/items/1", `{"delta":-10}`, http.StatusBadRequest},
+		{"patch missing line", "PATCH", "/shopping-carts/1/items/3", `{"quantity":1}`, http.StatusNotFound},
+		{"patch invalid product", "PATCH", "/shopping-carts/1/items/abc", `{"quantity":1}`, http.StatusBadRequest},
+		{"patch missing cart", "PATCH", "/shopping-carts/2/items/1", `{"quantity":1}`, http.StatusNotFound},
+		{"remove line", "DELETE", "/shopping-carts/1/items/2", "", http.StatusNoContent},
+		{"remove missing line", "DELETE", "/shopping-carts/1/items/2", "", http.StatusNotFound},
+		{"remove from missing cart", "DELETE", "/shopping-carts/2/items/1", "", http.StatusNotFound},
+	})
+
+	cart := decodeCart(t, mustServe(t, router, http.StatusOK, "GET", "/shopping-carts/1", ""))
+	if got := quantities(cart); len(got) != 1 || got[1] != 5 {
+		t.Errorf("cart quantities = %v, want map[1:5]", got)
+	}
+
+	// Patching to zero removes the line
+	mustServe(t, router, http.StatusOK, "PATCH", "/shopping-carts/1/items/1", `{"quantity":0}`)
+	mustServe(t, router, http.StatusNotFound, "DELETE", "/shopping-carts/1/items/1", "")
+}
+
+func TestClearAndDeleteCart(t *testing.T) {
+	router := newTestRouter(t)
+	runCartSteps(t, router, []cartStep{
+		{"clear missing cart", "POST", "/shopping-carts/1/clear", "", http.StatusNotFound},
+		{"delete missing cart", "DELETE", "/shopping-carts/1", "", http.StatusNotFound},
+		{"delete invalid customer", "DELETE", "/shopping-carts/abc", "", http.StatusBadRequest},
+		{"create", "POST", "/shopping-carts", `{"customer_id":1}`, http.StatusCreated},
+		{"add", "POST", "/shopping-carts/1/items", `{"product_id":1,"quantity":3}`, http.StatusCreated},
+		{"add second line", "POST", "/shopping-carts/1/items", `{"product_id":2,"quantity":1}`, http.StatusCreated},
+		{"clear", "POST", "/shopping-carts/1/clear", "", http.StatusNoContent},
+	})
+
+	// A cleared cart is kept, empty
+	cart := decodeCart(t, mustServe(t, router, http.StatusOK, "GET", "/shopping-carts/1", ""))
+	if len(cart.Items) != 0 {
+		t.Errorf("cleared cart has %d lines, want none", len(cart.Items))
+	}
+
+	runCartSteps(t, router, []cartStep{
+		{"add after clear", "POST", "/shopping-carts/1/items", `{"product_id":1,"quantity":1}`, http.StatusCreated},
+		{"delete", "DELETE", "/shopping-carts/1", "", http.StatusNoContent},
+		{"get deleted cart", "GET", "/shopping-carts/1", "", http.StatusNotFound},
+		{"delete again", "DELETE", "/shopping-carts/1", "", http.StatusNotFound},
+		{"create after delete", "POST", "/shopping-carts", `{"customer_id":1}`, http.StatusCreated},
+	})
+	if cart := decodeCart(t, mustServe(t, router, http.StatusOK, "GET", "/shopping-carts/1", "")); len(cart.Items) != 0 {
+		t.Errorf("recreated cart has %d lines, want none", len(cart.Items))
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	router := newTestRouter(t)
+	const body = `{"customer_id":1}`
+
+	first := serve(router, "POST", "/shopping-carts", body, IdempotencyKeyHeader, "create-1")
+	if first.Code != http.StatusCreated {
+		t.Fatalf("first request: status %d: %s", first.Code, first.Body)
+	}
+
+	replay := serve(router, "POST", "/shopping-carts", body, IdempotencyKeyHeader, "create-1")
+	if replay.Code != http.StatusCreated || replay.Body.String() != first.Body.String() {
+		t.Errorf("replay = %d %s, want %d %s", replay.Code, replay.Body, first.Code, first.Body)
+	}
+	if replay.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("replay is missing the Idempotent-Replayed header")
+	}
+
+	// Without the key the same request runs again and finds the cart
+	if w := serve(router, "POST", "/shopping-carts", body); w.Code != http.StatusOK {
+		t.Errorf("request without key: status %d, want %d", w.Code, http.StatusOK)
+	}
+
+	reused := serve(router, "POST", "/shopping-carts", `{"customer_id":2}`, IdempotencyKeyHeader, "create-1")
+	if reused.Code != http.StatusUnprocessableEntity {
+		t.Errorf("key reused with another body: status %d, want %d", reused.Code, http.StatusUnprocessableEntity)
+	}
+
+	tooLong := serve(router, "POST", "/shopping-carts", body, IdempotencyKeyHeader, strings.Repeat("k", maxIdempotencyKeyLength+1))
+	if tooLong.Code != http.StatusBadRequest {
+		t.Errorf("oversized key: status %d, want %d", tooLong.Code, http.StatusBadRequest)
+	}
+
+	padded := `{"customer_id":1,"note":"` + strings.Repeat("x", maxIdempotentBodyBytes) + `"}`
+	if w := serve(router, "POST", "/shopping-carts", padded, IdempotencyKeyHeader, "create-3"); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized body: status %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+
+	// A request still holding the key, as if it were running on another task
+	fingerprint := requestFingerprint("POST", "/shopping-carts", []byte(body))
+	if _, err := idempotencyStore.Reserve(context.Background(), "create-2", fingerprint, time.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("reserving key: %v", err)
+	}
+	inFlight := serve(router, "POST", "/shopping-carts", body, IdempotencyKeyHeader, "create-2")
+	if inFlight.Code != http.StatusConflict {
+		t.Errorf("key in flight: status %d, want %d", inFlight.Code, http.StatusConflict)
+	}
+}
+
+// conflictingCartStore fails the next conflicts item writes with
+// ErrConcurrentModification, as a DynamoDB cart does when its retries run out
+type conflictingCartStore struct {
+	CartStore
+	conflicts int
+}
+
+func (s *conflictingCartStore) UpsertItem(ctx context.Context, customerID int, list ListType, productID, quantity int) (*CartItem, bool, error) {
+	if s.conflicts > 0 {
+		s.conflicts--
+		return nil, false, ErrConcurrentModification
+	}
+	return s.CartStore.UpsertItem(ctx, customerID, list, productID, quantity)
+}
+
+func TestIdempotencyKeyRetriesConflicts(t *testing.T) {
+	router := newTestRouter(t)
+	mustServe(t, router, http.StatusCreated, "POST", "/shopping-carts", `{"customer_id":1}`)
+	cartStore = &conflictingCartStore{CartStore: cartStore, conflicts: 1}
+	const body = `{"product_id":3,"quantity":2}`
+
+	first := serve(router, "POST", "/shopping-carts/1/items", body, IdempotencyKeyHeader, "add-1")
+	if first.Code != http.StatusConflict {
+		t.Fatalf("first request: status %d, want %d: %s", first.Code, http.StatusConflict, first.Body)
+	}
+
+	// The 409 is not stored, so the retry with the same key goes through
+	retry := serve(router, "POST", "/shopping-carts/1/items", body, IdempotencyKeyHeader, "add-1")
+	if retry.Code != http.StatusCreated || retry.Header().Get("Idempotent-Replayed") != "" {
+		t.Fatalf("retry: status %d, replayed %q, want a fresh %d: %s", retry.Code, retry.Header().Get("Idempotent-Replayed"), http.StatusCreated, retry.Body)
+	}
+	replay := serve(router, "POST", "/shopping-carts/1/items", body, IdempotencyKeyHeader, "add-1")
+	if replay.Code != http.StatusCreated || replay.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("replay after success: status %d, want a replayed %d", replay.Code, http.StatusCreated)
+	}
+	if q := quantities(decodeCart(t, mustServe(t, router, http.StatusOK, "GET", "/shopping-carts/1", ""))); q[3] != 2 {
+		t.Errorf("quantities = %v, want product 3 added once", q)
+	}
+}
+
+func TestRespondCartError(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name      string
+		err       error
+		wantCode  int
+		wantError string
+	}{
+		{"cart not found", ErrCartNotFound, http.StatusNotFound, "Shopping cart not found for this customer"},
+		{"wrapped cart not found", fmt.Errorf("reading cart: %w", ErrCartNotFound), http.StatusNotFound, "Shopping cart not found for this customer"},
+		{"product not found", ErrProductNotFound, http.StatusBadRequest, "Product not found"},
+		{"item not found", ErrItemNotFound, http.StatusNotFound, "Item not found in shopping cart"},
+		{"invalid quantity", ErrInvalidQuantity, http.StatusBadRequest, "Quantity cannot go below zero"},
+		{"concurrent modification", ErrConcurrentModification, http.StatusConflict, "Shopping cart was modified concurrently, please retry"},
+		{"unexpected", errors.New("connection refused"), http.StatusInternalServerError, "Failed to add item"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			respondCartError(c, tt.err, "Failed to add item")
+
+			var body struct {
+				Error string `json:"error"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("decoding response: %v: %s", err, w.Body)
+			}
+			if w.Code != tt.wantCode || body.Error != tt.wantError {
+				t.Errorf("got %d %q, want %d %q", w.Code, body.Error, tt.wantCode, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestUpdateProductDetails(t *testing.T) {
+	router := newTestRouter(t)
+	value, _ := syncProducts.Load(1)
+	before := value.(Item)
+	other, _ := syncProducts.Load(2)
+	runCartSteps(t, router, []cartStep{
+		{"invalid product", "POST", "/products/abc/details", `{}`, http.StatusBadRequest},
+		{"id mismatch", "POST", "/products/1/details", `{"product_id":2,"sku":"SKU-NEW"}`, http.StatusBadRequest},
+		{"missing sku", "POST", "/products/1/details", `{"product_id":1}`, http.StatusBadRequest},
+		{"negative weight", "POST", "/products/1/details", `{"product_id":1,"sku":"SKU-NEW","weight":-1}`, http.StatusBadRequest},
+		{"unknown product", "POST", "/products/9999/details", `{"product_id":9999,"sku":"SKU-NEW"}`, http.StatusNotFound},
+		{"duplicate sku", "POST", "/products/1/details", `{"product_id":1,"sku":"` + other.(Item).SKU + `"}`, http.StatusConflict},
+		{"update", "POST", "/products/1/details", `{"product_id":1,"sku":"SKU-NEW","name":"Renamed"}`, http.StatusNoContent},
+	})
+
+	var item Item
+	w := mustServe(t, router, http.StatusOK, "GET", "/products/1", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &item); err != nil || item.SKU != "SKU-NEW" || item.Name != "Renamed" {
+		t.Errorf("product after update = %s, want sku SKU-NEW named Renamed", w.Body)
+	}
+	// The update left out the price, so the stored one stays
+	if item.Price != before.Price {
+		t.Errorf("price after update = %d, want %d kept", item.Price, before.Price)
+	}
+}
+
+func TestCreateAndDeleteProduct(t *testing.T) {
+	router := newTestRouter(t)
+	runCartSteps(t, router, []cartStep{
+		{"create with id", "POST", "/products", `{"product_id":5,"sku":"SKU-NEW"}`, http.StatusBadRequest},
+		{"create without sku", "POST", "/products", `{"name":"No SKU"}`, http.StatusBadRequest},
+		{"create negative price", "POST", "/products", `{"sku":"SKU-NEW","price":-1}`, http.StatusBadRequest},
+		{"create lowercase currency", "POST", "/products", `{"sku":"SKU-NEW","currency":"usd"}`, http.StatusBadRequest},
+	})
+
+	var created Item
+	w := mustServe(t, router, http.StatusCreated, "POST", "/products", `{"sku":"SKU-NEW","name":"New"}`)
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil || created.ID <= testProductCount {
+		t.Fatalf("created product = %s, want an ID past the catalog", w.Body)
+	}
+	if created.Currency != defaultCurrency {
+		t.Errorf("created product currency = %q, want %q", created.Currency, defaultCurrency)
+	}
+	if got := w.Header().Get("Location"); got != fmt.Sprintf("/products/%d", created.ID) {
+		t.Errorf("Location = %q, want /products/%d", got, created.ID)
+	}
+
+	path := fmt.Sprintf("/products/%d", created.ID)
+	runCartSteps(t, router, []cartStep{
+		{"create duplicate sku", "POST", "/products", `{"sku":"SKU-NEW"}`, http.StatusConflict},
+		{"get created", "GET", path, "", http.StatusOK},
+		{"create cart", "POST", "/shopping-carts", `{"customer_id":1}`, http.StatusCreated},
+		{"add created", "POST", "/shopping-carts/1/items", fmt.Sprintf(`{"product_id":%d,"quantity":1}`, created.ID), http.StatusCreated},
+		{"delete invalid soft", "DELETE", path + "?soft=maybe", "", http.StatusBadRequest},
+		{"hard delete in cart", "DELETE", path, "", http.StatusConflict},
+		{"soft delete in cart", "DELETE", path + "?soft=true", "", http.StatusNoContent},
+		{"get soft deleted", "GET", path, "", http.StatusNotFound},
+		{"cart keeps line", "GET", "/shopping-carts/1", "", http.StatusOK},
+		{"soft delete again", "DELETE", path + "?soft=true", "", http.StatusNotFound},
+		{"hard delete soft deleted in cart", "DELETE", path, "", http.StatusConflict},
+		{"remove from cart", "DELETE", fmt.Sprintf("/shopping-carts/1/items/%d", created.ID), "", http.StatusNoContent},
+		{"hard delete soft deleted", "DELETE", path, "", http.StatusNoContent},
+		{"delete again", "DELETE", path, "", http.StatusNotFound},
+		{"hard delete", "DELETE", "/products/2", "", http.StatusNoContent},
+		{"add deleted", "POST", "/shopping-carts/1/items", `{"product_id":2,"quantity":1}`, http.StatusBadRequest},
+	})
+}
+
+func TestCartFlagsPriceChanges(t *testing.T) {
+	router := newTestRouter(t)
+	mustServe(t, router, http.StatusCreated, "POST", "/shopping-carts", `{"customer_id":1}`)
+	mustServe(t, router, http.StatusCreated, "POST", "/shopping-carts/1/items", `{"product_id":1,"quantity":2}`)
+	mustServe(t, router, http.StatusCreated, "POST", "/shopping-carts/1/items", `{"product_id":2,"quantity":1}`)
+
+	value, _ := syncProducts.Load(1)
+	product := value.(Item)
+	oldPrice := product.Price
+	product.Price = oldPrice + 100
+	body, _ := json.Marshal(product)
+	mustServe(t, router, http.StatusNoContent, "POST", "/products/1/details", string(body))
+
+	cart := decodeCart(t, mustServe(t, router, http.StatusOK, "GET", "/shopping-carts/1", ""))
+	for _, item := range cart.Items {
+		switch {
+		case item.UnitPriceAtAdd == nil:
+			t.Errorf("product %d has no unit_price_at_add", item.ProductID)
+		case item.ProductID == 1 && (!item.PriceChanged || item.UnitPrice != oldPrice+100 || *item.UnitPriceAtAdd != oldPrice):
+			t.Errorf("repriced line = %d now, %d at add, changed %v; want %d now, %d at add, changed",
+				item.UnitPrice, *item.UnitPriceAtAdd, item.PriceChanged, oldPrice+100, oldPrice)
+		case item.ProductID == 2 && item.PriceChanged:
+			t.Errorf("product 2 flagged as repriced")
+		}
+	}
+
+	// Adding the product again records the new price
+	mustServe(t, router, http.StatusOK, "POST", "/shopping-carts/1/items", `{"product_id":1,"quantity":3}`)
+	cart = decodeCart(t, mustServe(t, router, http.StatusOK, "GET", "/shopping-carts/1", ""))
+	for _, item := range cart.Items {
+		if item.PriceChanged {
+			t.Errorf("product %d still flagged after re-adding", item.ProductID)
+		}
+	}
+}
+
+func TestStockReservations(t *testing.T) {
+	router := newTestRouter(t)
+	stockReservationTTL = time.Minute
+	defer func() { stockReservationTTL = 0 }()
+
+	stock := func(productID int) StockLevel {
+		t.Helper()
+		var level StockLevel
+		w := mustServe(t, router, http.StatusOK, "GET", "/products/"+strconv.Itoa(productID)+"/stock", "")
+		if err := json.Unmarshal(w.Body.Bytes(), &level); err != nil {
+			t.Fatalf("decoding stock: %v: %s", err, w.Body)
+		}
+		return level
+	}
+
+	runCartSteps(t, router, []cartStep{
+		{"stock of unknown product", "GET", "/products/9999/stock", "", http.StatusNotFound},
+		{"set negative stock", "PUT", "/products/1/stock", `{"on_hand":-1}`, http.StatusBadRequest},
+		{"set stock", "PUT", "/products/1/stock", `{"on_hand":5}`, http.StatusOK},
+		{"create", "POST", "/shopping-carts", `{"customer_id":1}`, http.StatusCreated},
+		{"create other", "POST", "/shopping-carts", `{"customer_id":2}`, http.StatusCreated},
+		{"reserve", "POST", "/shopping-carts/1/items", `{"product_id":1,"quantity":3}`, http.StatusCreated},
+		{"reserve too many", "POST", "/shopping-carts/2/items", `{"product_id":1,"quantity":3}`, http.StatusConflict},
+		{"reserve the rest", "POST", "/shopping-carts/2/items", `{"product_id":1,"quantity":2}`, http.StatusCreated},
+		{"untracked product", "POST", "/shopping-carts/2/items", `{"product_id":2,"quantity":100}`, http.StatusCreated},
+	})
+	if level := stock(1); level.OnHand != 5 || level.Reserved != 5 || level.Available != 0 {
+		t.Errorf("stock after reserving = %+v, want 5 on hand, all reserved", level)
+	}
+	if level := stock(2); level.Tracked {
+		t.Errorf("product 2 stock = %+v, want untracked", level)
+	}
+
+	// Lowering a line or removing it frees its units
+	mustServe(t, router, http.StatusOK, "PATCH", "/shopping-carts/1/items/1", `{"quantity":1}`)
+	mustServe(t, router, http.StatusNoContent, "DELETE", "/shopping-carts/2/items/1", "")
+	if level := stock(1); level.Reserved != 1 || level.Available != 4 {
+		t.Errorf("stock after releasing = %+v, want 1 reserved, 4 available", level)
+	}
+
+	// An add whose cart write fails holds what the line held before: the
+	// existing line's unit in cart 1, nothing in cart 2
+	cartStore = &conflictingCartStore{CartStore: cartStore, conflicts: 2}
+	mustServe(t, router, http.StatusConflict, "POST", "/shopping-carts/1/items", `{"product_id":1,"quantity":4}`)
+	mustServe(t, router, http.StatusConflict, "POST", "/shopping-carts/2/items", `{"product_id":1,"quantity":2}`)
+	if level := stock(1); level.Reserved != 1 || level.Available != 4 {
+		t.Errorf("stock after failed adds = %+v, want 1 reserved, 4 available", level)
+	}
+}
+
+func TestCheckout(t *testing.T) {
+	router := newTestRouter(t)
+	checkout := func(want int, key, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		return mustServe(t, router, want, "POST", "/shopping-carts/1/checkout", body, IdempotencyKeyHeader, key)
+	}
+	checkout(http.StatusNotFound, "missing-cart", "")
+	runCartSteps(t, router, []cartStep{
+		{"create", "POST", "/shopping-carts", `{"customer_id":1}`, http.StatusCreated},
+		{"checkout without key", "POST", "/shopping-carts/1/checkout", "", http.StatusPreconditionRequired},
+	})
+	checkout(http.StatusConflict, "empty-cart", "")
+	runCartSteps(t, router, []cartStep{
+		{"add", "POST", "/shopping-carts/1/items", `{"product_id":1,"quantity":2}`, http.StatusCreated},
+		{"add second line", "POST", "/shopping-carts/1/items", `{"product_id":2,"quantity":1}`, http.StatusCreated},
+	})
+	checkout(http.StatusBadRequest, "bad-body", `{"accept_price_changes":"yes"}`)
+
+	// A price change needs the customer's consent
+	value, _ := syncProducts.Load(1)
+	product := value.(Item)
+	product.Price += 100
+	body, _ := json.Marshal(product)
+	mustServe(t, router, http.StatusNoContent, "POST", "/products/1/details", string(body))
+	checkout(http.StatusConflict, "price-changed", "")
+
+	var order Order
+	w := checkout(http.StatusCreated, "accepted", `{"accept_price_changes":true}`)
+	if err := json.Unmarshal(w.Body.Bytes(), &order); err != nil {
+		t.Fatalf("decoding order: %v: %s", err, w.Body)
+	}
+	// Retrying with the same key returns the same order instead of placing another
+	if retry := checkout(http.StatusCreated, "accepted", `{"accept_price_changes":true}`); retry.Body.String() != w.Body.String() {
+		t.Errorf("retried checkout = %s, want %s", retry.Body, w.Body)
+	}
+	second, _ := syncProducts.Load(2)
+	wantSubtotal := 2*product.Price + second.(Item).Price
+	if order.CustomerID != 1 || order.Status != OrderStatusPlaced || len(order.Items) != 2 ||
+		order.ItemCount != 3 || order.Subtotal != wantSubtotal {
+		t.Errorf("order = %+v, want 2 lines, 3 items, subtotal %d for customer 1", order, wantSubtotal)
+	}
+
+	// The cart is kept, empty, and the order can be read back
+	if cart := decodeCart(t, mustServe(t, router, http.StatusOK, "GET", "/shopping-carts/1", "")); len(cart.Items) != 0 {
+		t.Errorf("cart after checkout has %d lines, want none", len(cart.Items))
+	}
+	mustServe(t, router, http.StatusOK, "GET", "/orders/"+strconv.Itoa(order.ID), "")
+	mustServe(t, router, http.StatusNotFound, "GET", "/orders/9999", "")
+	var orders struct {
+		Orders []Order `json:"orders"`
+	}
+	w = mustServe(t, router, http.StatusOK, "GET", "/customers/1/orders", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &orders); err != nil || len(orders.Orders) != 1 || orders.Orders[0].ID != order.ID {
+		t.Errorf("customer orders = %s, want order %d", w.Body, order.ID)
+	}
+}
+
+func TestCheckoutStockShortageChangesNothing(t *testing.T) {
+	router := newTestRouter(t)
+	mustServe(t, router, http.StatusCreated, "POST", "/shopping-carts", `{"customer_id":1}`)
+	mustServe(t, router, http.StatusCreated, "POST", "/shopping-carts/1/items", `{"product_id":1,"quantity":1}`)
+	mustServe(t, router, http.StatusCreated, "POST", "/shopping-carts/1/items", `{"product_id":2,"quantity":3}`)
+	mustServe(t, router, http.StatusOK, "PUT", "/products/1/stock", `{"on_hand":5}`)
+	mustServe(t, router, http.StatusOK, "PUT", "/products/2/stock", `{"on_hand":2}`)
+
+	w := mustServe(t, router, http.StatusConflict, "POST", "/shopping-carts/1/checkout", "", IdempotencyKeyHeader, "checkout-1")
+	var shortage struct {
+		ProductID int `json:"product_id"`
+		Available int `json:"available"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &shortage); err != nil || shortage.ProductID != 2 || shortage.Available != 2 {
+		t.Errorf("shortage = %s, want product 2 with 2 available", w.Body)
+	}
+
+	cart := decodeCart(t, mustServe(t, router, http.StatusOK, "GET", "/shopping-carts/1", ""))
+	if got := quantities(cart); len(got) != 2 || got[1] != 1 || got[2] != 3 {
+		t.Errorf("cart quantities after failed checkout = %v, want map[1:1 2:3]", got)
+	}
+	for productID, want := range map[int]int{1: 5, 2: 2} {
+		var level StockLevel
+		w := mustServe(t, router, http.StatusOK, "GET", "/products/"+strconv.Itoa(productID)+"/stock", "")
+		if err := json.Unmarshal(w.Body.Bytes(), &level); err != nil || level.OnHand != want {
+			t.Errorf("product %d stock after failed checkout = %s, want %d on hand", productID, w.Body, want)
+		}
+	}
+	var orders struct {
+		Orders []Order `json:"orders"`
+	}
+	w = mustServe(t, router, http.StatusOK, "GET", "/customers/1/orders", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &orders); err != nil || len(orders.Orders) != 0 {
+		t.Errorf("orders after failed checkout = %s, want none", w.Body)
+	}
+
+	// With enough stock the same cart checks out
+	mustServe(t, router, http.StatusOK, "PUT", "/products/2/stock", `{"on_hand":3}`)
+	mustServe(t, router, http.StatusCreated, "POST", "/shopping-carts/1/checkout", "", IdempotencyKeyHeader, "checkout-1")
+	if cart := decodeCart(t, mustServe(t, router, http.StatusOK, "GET", "/shopping-carts/1", "")); len(cart.Items) != 0 {
+		t.Errorf("cart after checkout has %d lines, want none", len(cart.Items))
+	}
+}
+
+func TestMergeRules(t *testing.T) {
+	tests := []struct {
+		strategy string
+		want     int
+	}{
+		{"sum", 7},
+		{"max", 5},
+		// The guest line is written last
+		{"prefer_latest", 2},
+		// Falls back to CART_MERGE_STRATEGY, which defaults to sum
+		{"", 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			router := newTestRouter(t)
+			mustServe(t, router, http.StatusCreated, "POST", "/shopping-carts", `{"customer_id":1}`)
+			mustServe(t, router, http.StatusCreated, "POST", "/shopping-carts/1/items", `{"product_id":1,"quantity":5}`)
+
+			var guest struct {
+				Token string `json:"token"`
+			}
+			w := mustServe(t, router, http.StatusCreated, "POST", "/guest-carts", "")
+			if err := json.Unmarshal(w.Body.Bytes(), &guest); err != nil || guest.Token == "" {
+				t.Fatalf("guest cart response without token: %s", w.Body)
+			}
+			mustServe(t, router, http.StatusCreated, "POST", "/shopping-carts/"+guest.Token+"/items", `{"product_id":1,"quantity":2}`)
+			mustServe(t, router, http.StatusCreated, "POST", "/shopping-carts/"+guest.Token+"/items", `{"product_id":3,"quantity":1}`)
+
+			body := `{"guest_token":"` + guest.Token + `","strategy":"` + tt.strategy + `"}`
+			cart := decodeCart(t, mustServe(t, router, http.StatusOK, "POST", "/shopping-carts/1/merge", body))
+			if got := quantities(cart); len(got) != 2 || got[1] != tt.want || got[3] != 1 {
+				t.Errorf("merged quantities = %v, want map[1:%d 3:1]", got, tt.want)
+			}
+
+			// The guest cart and its token are gone
+			mustServe(t, router, http.StatusNotFound, "GET", "/shopping-carts/"+guest.Token, "")
+			mustServe(t, router, http.StatusNotFound, "POST", "/shopping-carts/1/merge", body)
+		})
+	}
+}
+
+func TestMergeRejectsBadRequests(t *testing.T) {
+	router := newTestRouter(t)
+	w := mustServe(t, router, http.StatusCreated, "POST", "/guest-carts", "")
+	var guest struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &guest); err != nil {
+		t.Fatalf("decoding guest cart: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		path string
+		body string
+		want int
+	}{
+		{"missing token", "/shopping-carts/1/merge", `{}`, http.StatusBadRequest},
+		{"unknown strategy", "/shopping-carts/1/merge", `{"guest_token":"` + guest.Token + `","strategy":"min"}`, http.StatusBadRequest},
+		{"unknown token", "/shopping-carts/1/merge", `{"guest_token":"guest_unknown"}`, http.StatusNotFound},
+		{"into a guest cart", "/shopping-carts/" + guest.Token + "/merge", `{"guest_token":"` + guest.Token + `"}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := serve(router, "POST", tt.path, tt.body); w.Code != tt.want {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
+
+func TestCustomerLists(t *testing.T) {
+	router := newTestRouter(t)
+	runCartSteps(t, router, []cartStep{
+		{"create list without type", "POST", "/customers/1/lists", `{}`, http.StatusBadRequest},
+		{"create unknown list", "POST", "/customers/1/lists", `{"type":"registry"}`, http.StatusBadRequest},
+		{"get missing wishlist", "GET", "/customers/1/lists/wishlist", "", http.StatusNotFound},
+		{"create cart", "POST", "/shopping-carts", `{"customer_id":1}`, http.StatusCreated},
+		{"create wishlist", "POST", "/customers/1/lists", `{"type":"wishlist"}`, http.StatusCreated},
+		{"create wishlist again", "POST", "/customers/1/lists", `{"type":"wishlist"}`, http.StatusOK},
+		{"add to cart", "POST", "/shopping-carts/1/items", `{"product_id":1,"quantity":2}`, http.StatusCreated},
+		{"add to wishlist", "POST", "/customers/1/lists/wishlist/items", `{"product_id":1,"quantity":1}`, http.StatusCreated},
+		{"add second to wishlist", "POST", "/customers/1/lists/wishlist/items", `{"product_id":2,"quantity":1}`, http.StatusCreated},
+		{"move to same list", "POST", "/customers/1/lists/wishlist/items/2/move", `{"to":"wishlist"}`, http.StatusBadRequest},
+		{"move to unknown list", "POST", "/customers/1/lists/wishlist/items/2/move", `{"to":"registry"}`, http.StatusBadRequest},
+		{"move missing line", "POST", "/customers/1/lists/wishlist/items/3/move", `{"to":"saved"}`, http.StatusNotFound},
+		{"move to saved", "POST", "/customers/1/lists/wishlist/items/2/move", `{"to":"saved"}`, http.StatusOK},
+		{"move onto a cart line", "POST", "/customers/1/lists/wishlist/items/1/move", `{"to":"cart"}`, http.StatusOK},
+	})
+
+	cart := decodeCart(t, mustServe(t, router, http.StatusOK, "GET", "/customers/1/lists/cart", ""))
+	if got := quantities(cart); len(got) != 1 || got[1] != 3 {
+		t.Errorf("cart quantities = %v, want map[1:3]", got)
+	}
+	saved := decodeCart(t, mustServe(t, router, http.StatusOK, "GET", "/customers/1/lists/saved", ""))
+	if got := quantities(saved); len(got) != 1 || got[2] != 1 {
+		t.Errorf("saved quantities = %v, want map[2:1]", got)
+	}
+	wishlist := decodeCart(t, mustServe(t, router, http.StatusOK, "GET", "/customers/1/lists/wishlist", ""))
+	if len(wishlist.Items) != 0 {
+		t.Errorf("wishlist has %d lines after moving both out, want none", len(wishlist.Items))
+	}
+
+	var lists struct {
+		Lists []ShoppingCart `json:"lists"`
+	}
+	w := mustServe(t, router, http.StatusOK, "GET", "/customers/1/lists", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &lists); err != nil || len(lists.Lists) != 3 {
+		t.Errorf("customer lists = %s, want cart, wishlist and saved", w.Body)
+	}
+
+	// Deleting the wishlist leaves the other lists alone
+	mustServe(t, router, http.StatusNoContent, "DELETE", "/customers/1/lists/wishlist", "")
+	mustServe(t, router, http.StatusNotFound, "GET", "/customers/1/lists/wishlist", "")
+	mustServe(t, router, http.StatusOK, "GET", "/shopping-carts/1", "")
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/gin-gonic/gin"
+)
+
+// healthProbeTimeout bounds each readiness probe. Probes run concurrently,
+// so a whole check stays inside the ALB's 5 second health check timeout.
+const healthProbeTimeout = 2 * time.Second
+
+// catalogStaleIntervals is how many refresh intervals may pass without a
+// successful refresh before this task's catalog counts as stale
+const catalogStaleIntervals = 3
+
+var (
+	// catalogRefreshedAt is when the catalog was last loaded or refreshed
+	// without error, in Unix nanoseconds; zero until loadCatalog has run
+	catalogRefreshedAt atomic.Int64
+
+	// catalogRefreshInterval is how often refreshCatalog runs; zero while
+	// nothing refreshes the catalog
+	catalogRefreshInterval atomic.Int64
+)
+
+// DependencyStatus is the outcome of probing one dependency
+type DependencyStatus struct {
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// readinessCheck probes one dependency the handlers need
+type readinessCheck struct {
+	name  string
+	probe func(ctx context.Context) error
+}
+
+// readinessChecks lists the dependencies this task was set up with in main.
+// In DynamoDB mode MySQL is checked too when products come from it.
+func readinessChecks() []readinessCheck {
+	var checks []readinessCheck
+	if DB != nil {
+		checks = append(checks, readinessCheck{"mysql", func(ctx context.Context) error {
+			return DB.PingContext(ctx)
+		}})
+	}
+	if DynamoDBClient != nil {
+		checks = append(checks, readinessCheck{"dynamodb", probeDynamoDBTable})
+	}
+	return append(checks, readinessCheck{"catalog", probeCatalogFreshness})
+}
+
+// probeCatalogFreshness checks the catalog is loaded and that refreshCatalog
+// has not been failing, which would leave other tasks' product edits unseen
+func probeCatalogFreshness(ctx context.Context) error {
+	refreshed := catalogRefreshedAt.Load()
+	if refreshed == 0 {
+		return errors.New("product catalog not loaded")
+	}
+	interval := time.Duration(catalogRefreshInterval.Load())
+	if age := time.Since(time.Unix(0, refreshed)); interval > 0 && age > catalogStaleIntervals*interval {
+		return fmt.Errorf("product catalog last refreshed %s ago", age.Round(time.Second))
+	}
+	return nil
+}
+
+// probeDynamoDBTable checks the carts table exists and can take requests
+func probeDynamoDBTable(ctx context.Context) error {
+	result, err := DynamoDBClient.DescribeTable(ctx, &dynamodb.DescribeTableInput{
+		TableName: aws.String(DynamoDBTableName),
+	})
+	if err != nil {
+		return err
+	}
+	switch status := result.Table.TableStatus; status {
+	case types.TableStatusActive, types.TableStatusUpdating:
+		return nil
+	default:
+		return fmt.Errorf("table %s is %s", DynamoDBTableName, status)
+	}
+}
+
+// runReadinessChecks probes every dependency at once, each with its own timeout
+func runReadinessChecks(ctx context.Context, checks []readinessCheck) (map[string]DependencyStatus, bool) {
+	results := make(map[string]DependencyStatus, len(checks))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			probeCtx, cancel := context.WithTimeout(ctx, healthProbeTimeout)
+			defer cancel()
+
+			start := time.Now()
+			err := check.probe(probeCtx)
+			result := DependencyStatus{
+				Status:    "up",
+				LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+			}
+			if err != nil {
+				result.Status = "down"
+				result.Error = err.Error()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			results[check.name] = result
+		}()
+	}
+	wg.Wait()
+
+	ready := true
+	for _, result := range results {
+		if result.Status != "up" {
+			ready = false
+		}
+	}
+	return results, ready
+}
+
+// healthLive reports that the process is up. It probes nothing, so an
+// outage of a dependency never gets the task restarted.
+// GET /healthz/live
+func healthLive(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"status": "alive",
+	})
+}
+
+// healthReady probes every dependency and answers 503 unless all are up, or
+// while the task drains
+// GET /healthz/ready
+func healthReady(c *gin.Context) {
+	if draining.Load() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status": "draining",
+		})
+		return
+	}
+
+	dependencies, ready := runReadinessChecks(c.Request.Context(), readinessChecks())
+	status, code := "ready", http.StatusOK
+	if !ready {
+		status, code = "not_ready", http.StatusServiceUnavailable
+	}
+	c.JSON(code, gin.H{
+		"status":       status,
+		"dependencies": dependencies,
+	})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRunReadinessChecks(t *testing.T) {
+	up := func(ctx context.Context) error { return nil }
+	down := func(ctx context.Context) error { return errors.New("connection refused") }
+	// A hung dependency is cut off by healthProbeTimeout
+	hung := func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	results, ready := runReadinessChecks(context.Background(), []readinessCheck{{"mysql", up}, {"catalog", up}})
+	if !ready || len(results) != 2 || results["mysql"].Status != "up" {
+		t.Errorf("all up: ready %v, results %+v", ready, results)
+	}
+
+	start := time.Now()
+	results, ready = runReadinessChecks(context.Background(), []readinessCheck{{"mysql", down}, {"dynamodb", hung}, {"catalog", up}})
+	if ready || results["mysql"].Error != "connection refused" || results["dynamodb"].Status != "down" || results["catalog"].Status != "up" {
+		t.Errorf("with failures: ready %v, results %+v", ready, results)
+	}
+	if elapsed := time.Since(start); elapsed > healthProbeTimeout+time.Second {
+		t.Errorf("checks took %s, want them run at once within %s", elapsed, healthProbeTimeout)
+	}
+}
+
+func TestHealthReady(t *testing.T) {
+	newTestRouter(t)
+	router := gin.New()
+	router.GET("/healthz/live", healthLive)
+	router.GET("/healthz/ready", healthReady)
+
+	ready := func() (int, string) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/healthz/ready", nil))
+		var body struct {
+			Status string `json:"status"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("decoding readiness: %v: %s", err, w.Body)
+		}
+		return w.Code, body.Status
+	}
+
+	if code, status := ready(); code != http.StatusOK || status != "ready" {
+		t.Errorf("with the catalog loaded: %d %q, want 200 ready", code, status)
+	}
+
+	defer catalogRefreshedAt.Store(catalogRefreshedAt.Load())
+	catalogRefreshedAt.Store(0)
+	if code, status := ready(); code != http.StatusServiceUnavailable || status != "not_ready" {
+		t.Errorf("without a catalog: %d %q, want 503 not_ready", code, status)
+	}
+
+	defer draining.Store(false)
+	draining.Store(true)
+	if code, status := ready(); code != http.StatusServiceUnavailable || status != "draining" {
+		t.Errorf("while draining: %d %q, want 503 draining", code, status)
+	}
+
+	// Liveness probes nothing, so it stays up through all of it
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/healthz/live", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("liveness: status %d, want 200", w.Code)
+	}
+}
+
+func TestProbeCatalogFreshness(t *testing.T) {
+	defer catalogRefreshedAt.Store(catalogRefreshedAt.Load())
+	defer catalogRefreshInterval.Store(catalogRefreshInterval.Load())
+
+	tests := []struct {
+		name     string
+		age      time.Duration // since the last refresh; 0 for never loaded
+		interval time.Duration
+		wantErr  bool
+	}{
+		{"not loaded", 0, 5 * time.Second, true},
+		{"fresh", time.Second, 5 * time.Second, false},
+		{"within the allowed intervals", 14 * time.Second, 5 * time.Second, false},
+		{"stale", 16 * time.Second, 5 * time.Second, true},
+		{"not refreshing", time.Hour, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			catalogRefreshedAt.Store(0)
+			if tt.age > 0 {
+				catalogRefreshedAt.Store(time.Now().Add(-tt.age).UnixNano())
+			}
+			catalogRefreshInterval.Store(int64(tt.interval))
+			if err := probeCatalogFreshness(context.Background()); (err != nil) != tt.wantErr {
+				t.Errorf("probeCatalogFreshness() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// IdempotencyKeyHeader lets clients retry a mutation safely: a repeated
+// request with the same key gets the stored response instead of running again
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+const (
+	// defaultIdempotencyTTL is how long completed responses are kept,
+	// unless IDEMPOTENCY_KEY_TTL says otherwise
+	defaultIdempotencyTTL = 24 * time.Hour
+
+	// idempotencyLockTimeout bounds how long a key stays claimed by a request
+	// that never finishes (e.g. the task was killed mid-request)
+	idempotencyLockTimeout = 30 * time.Second
+
+	maxIdempotencyKeyLength = 255
+
+	// maxIdempotentBodyBytes caps the request body buffered for the
+	// fingerprint; cart and order payloads are far smaller
+	maxIdempotentBodyBytes = 64 << 10
+)
+
+// ErrIdempotencyKeyExists is returned by Reserve when the key is already taken
+var ErrIdempotencyKeyExists = errors.New("idempotency key already exists")
+
+// IdempotencyRecord is what is remembered about one Idempotency-Key
+type IdempotencyRecord struct {
+	Key         string
+	Fingerprint string
+	Completed   bool
+	StatusCode  int
+	ContentType string
+	Body        []byte
+	ExpiresAt   time.Time
+}
+
+// IdempotencyStore persists Idempotency-Key records. Implementations must
+// make Reserve atomic, so only one of several concurrent requests with the
+// same key gets to run.
+type IdempotencyStore interface {
+	// Reserve claims key for a request with the given fingerprint until
+	// lockUntil. If a live record already exists it is returned together
+	// with ErrIdempotencyKeyExists. Expired records count as absent.
+	Reserve(ctx context.Context, key, fingerprint string, lockUntil time.Time) (*IdempotencyRecord, error)
+
+	// Complete stores the response for a reserved key until record.ExpiresAt
+	Complete(ctx context.Context, record IdempotencyRecord) error
+
+	// Release drops a reservation so the request can be retried
+	Release(ctx context.Context, key string) error
+}
+
+// idempotencyStore is the backend selected in main by DATABASE_TYPE
+var idempotencyStore IdempotencyStore
+
+// idempotencyTTLFromEnv reads IDEMPOTENCY_KEY_TTL (a Go duration such as "24h")
+func idempotencyTTLFromEnv() time.Duration {
+	value := os.Getenv("IDEMPOTENCY_KEY_TTL")
+	if value == "" {
+		return defaultIdempotencyTTL
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl <= 0 {
+		log.Printf("Warning: invalid IDEMPOTENCY_KEY_TTL %q, using %s", value, defaultIdempotencyTTL)
+		return defaultIdempotencyTTL
+	}
+	return ttl
+}
+
+// idempotent wraps a mutation handler with Idempotency-Key support.
+// Requests without the header pass straight through. The first request with
+// a key runs the handler and its response is stored for ttl; a repeat with
+// the same method, path and body replays that response, and a repeat with a
+// different payload is rejected with 422. Server errors and 409 conflicts
+// (a concurrent modification, running out of stock) are not stored: they
+// change nothing and may succeed later, so a retry runs the handler again.
+func idempotent(ttl time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(IdempotencyKeyHeader)
+		if key == "" || idempotencyStore == nil {
+			c.Next()
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"error": "Idempotency-Key must be at most 255 characters",
+			})
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxIdempotentBodyBytes))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{
+				"error": "Request body must be at most 64 KiB",
+			})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"error": "Failed to read request body",
+			})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		fingerprint := requestFingerprint(c.Request.Method, c.Request.URL.Path, body)
+
+		ctx := c.Request.Context()
+		existing, err := idempotencyStore.Reserve(ctx, key, fingerprint, time.Now().Add(idempotencyLockTimeout))
+		switch {
+		case errors.Is(err, ErrIdempotencyKeyExists):
+			replayIdempotent(c, existing, fingerprint)
+			return
+		case err != nil:
+			log.Printf("Error reserving idempotency key: %v", err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+				"error": "Internal server error",
+			})
+			return
+		}
+
+		writer := &capturingWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+		c.Next()
+
+		// Use a fresh context: the request's may already be cancelled
+		storeCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if retryableStatus(writer.Status()) {
+			if err := idempotencyStore.Release(storeCtx, key); err != nil {
+				log.Printf("Error releasing idempotency key: %v", err)
+			}
+			return
+		}
+		err = idempotencyStore.Complete(storeCtx, IdempotencyRecord{
+			Key:         key,
+			Fingerprint: fingerprint,
+			Completed:   true,
+			StatusCode:  writer.Status(),
+			ContentType: writer.Header().Get("Content-Type"),
+			Body:        writer.body.Bytes(),
+			ExpiresAt:   time.Now().Add(ttl),
+		})
+		if err != nil {
+			log.Printf("Error storing idempotent response: %v", err)
+		}
+	}
+}
+
+// requireIdempotencyKey rejects requests without an Idempotency-Key, for
+// routes like checkout where a blind retry must not run the handler twice
+func requireIdempotencyKey(c *gin.Context) {
+	if c.GetHeader(IdempotencyKeyHeader) == "" {
+		c.AbortWithStatusJSON(http.StatusPreconditionRequired, gin.H{
+			"error": "Idempotency-Key header is required",
+		})
+		return
+	}
+	c.Next()
+}
+
+// retryableStatus reports whether a response is released instead of stored
+func retryableStatus(code int) bool {
+	return code >= http.StatusInternalServerError || code == http.StatusConflict
+}
+
+// replayIdempotent answers a request whose key is already taken
+func replayIdempotent(c *gin.Context, existing *IdempotencyRecord, fingerprint string) {
+	switch {
+	case existing.Fingerprint != fingerprint:
+		c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{
+			"error": "Idempotency-Key was already used with a different request",
+		})
+	case !existing.Completed:
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+			"error": "A request with this Idempotency-Key is still being processed",
+		})
+	default:
+		c.Header("Idempotent-Replayed", "true")
+		c.Data(existing.StatusCode, existing.ContentType, existing.Body)
+		c.Abort()
+	}
+}
+
+// requestFingerprint identifies a request's payload, so a reused key can be
+// told apart from a genuine retry
+func requestFingerprint(method, path string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(method))
+	h.Write([]byte{0})
+	h.Write([]byte(path))
+	h.Write([]byte{0})
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// capturingWriter keeps a copy of the response body while writing it through
+type capturingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *capturingWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *capturingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyTTLFromEnv(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", defaultIdempotencyTTL},
+		{"1h30m", 90 * time.Minute},
+		{"forever", defaultIdempotencyTTL},
+		{"-1h", defaultIdempotencyTTL},
+		{"0s", defaultIdempotencyTTL},
+	}
+	for _, tt := range tests {
+		t.Setenv("IDEMPOTENCY_KEY_TTL", tt.value)
+		if got := idempotencyTTLFromEnv(); got != tt.want {
+			t.Errorf("IDEMPOTENCY_KEY_TTL=%q: got %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestMemoryIdempotencyStoreReserve(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryIdempotencyStore()
+	now := time.Now()
+
+	if _, err := store.Reserve(ctx, "k", "fp", now.Add(time.Minute)); err != nil {
+		t.Fatalf("first Reserve: %v", err)
+	}
+	existing, err := store.Reserve(ctx, "k", "other", now.Add(time.Minute))
+	if !errors.Is(err, ErrIdempotencyKeyExists) || existing == nil || existing.Fingerprint != "fp" {
+		t.Errorf("second Reserve = %+v, %v; want the first reservation and ErrIdempotencyKeyExists", existing, err)
+	}
+
+	// Released and expired keys can be claimed again
+	if err := store.Release(ctx, "k"); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if _, err := store.Reserve(ctx, "k", "fp", now.Add(-time.Second)); err != nil {
+		t.Errorf("Reserve after Release: %v", err)
+	}
+	if _, err := store.Reserve(ctx, "k", "fp", now.Add(time.Minute)); err != nil {
+		t.Errorf("Reserve of an expired key: %v", err)
+	}
+}
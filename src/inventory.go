@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// defaultStockReservationTTL is how long a cart holds the units it reserved,
+// unless STOCK_RESERVATION_TTL says otherwise. Every write to the cart line
+// starts the period again.
+const defaultStockReservationTTL = 30 * time.Minute
+
+// Errors returned by InventoryStore implementations
+var (
+	// ErrStockNotTracked means a product has no stock record, so its
+	// quantity is not limited
+	ErrStockNotTracked = errors.New("stock is not tracked for this product")
+	// ErrInsufficientStock means a reservation asked for more units than are available
+	ErrInsufficientStock = errors.New("insufficient stock")
+)
+
+// StockLevel is a product's stock. Reserved counts the units held by
+// unexpired cart reservations; Available is what is left to reserve.
+type StockLevel struct {
+	ProductID int  `json:"product_id"`
+	Tracked   bool `json:"tracked"`
+	OnHand    int  `json:"on_hand"`
+	Reserved  int  `json:"reserved"`
+	Available int  `json:"available"`
+}
+
+// stockReservation is the units one cart holds of a product
+type stockReservation struct {
+	Quantity  int
+	ExpiresAt time.Time
+}
+
+// InventoryStore keeps units on hand per product and the units carts have
+// reserved. Implementations must make Reserve atomic per product, so
+// concurrent adds can never reserve more than is on hand.
+type InventoryStore interface {
+	// GetStock returns a product's stock, or ErrStockNotTracked
+	GetStock(ctx context.Context, productID int) (*StockLevel, error)
+
+	// SetStock sets the units on hand, starting to track the product if needed.
+	// Reservations are kept, so Available can drop to zero.
+	SetStock(ctx context.Context, productID, onHand int) (*StockLevel, error)
+
+	// Reserve sets the units of a product held by a customer's cart to
+	// quantity, until ttl from now. Products without a stock record need no
+	// reservation, and nil is returned. If fewer units are available the
+	// reservation is left as it was and ErrInsufficientStock is returned with
+	// the level; Available then counts the customer's own reservation as free.
+	Reserve(ctx context.Context, customerID, productID, quantity int, ttl time.Duration) (*StockLevel, error)
+
+	// Release drops a customer's reservations of the given products
+	Release(ctx context.Context, customerID int, productIDs ...int) error
+}
+
+// inventoryStore is the backend selected in main by DATABASE_TYPE
+var inventoryStore InventoryStore
+
+// stockReservationsEnabled reports whether STOCK_RESERVATIONS asks cart
+// writes to reserve stock
+func stockReservationsEnabled() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv("STOCK_RESERVATIONS"))
+	return enabled
+}
+
+// stockReservationTTLFromEnv reads STOCK_RESERVATION_TTL (a Go duration such as "30m")
+func stockReservationTTLFromEnv() time.Duration {
+	value := os.Getenv("STOCK_RESERVATION_TTL")
+	if value == "" {
+		return defaultStockReservationTTL
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl <= 0 {
+		log.Printf("Warning: invalid STOCK_RESERVATION_TTL %q, using %s", value, defaultStockReservationTTL)
+		return defaultStockReservationTTL
+	}
+	return ttl
+}
+
+// stockReservationTTL is set in main when STOCK_RESERVATIONS is on; zero
+// means cart writes do not reserve stock
+var stockReservationTTL time.Duration
+
+// reserveStock reserves quantity units for a cart line when reservations are enabled
+func reserveStock(ctx context.Context, customerID, productID, quantity int) (*StockLevel, error) {
+	if stockReservationTTL == 0 {
+		return nil, nil
+	}
+	if quantity == 0 {
+		return nil, inventoryStore.Release(ctx, customerID, productID)
+	}
+	return inventoryStore.Reserve(ctx, customerID, productID, quantity, stockReservationTTL)
+}
+
+// reserveStockForAdd reserves stock for the quantity an add leaves in the
+// cart. It returns the line's current quantity, zero if the product is not
+// in the cart yet, to restore if the cart write fails. Lists other than the
+// cart reserve nothing.
+func reserveStockForAdd(ctx context.Context, customerID int, list ListType, productID, quantity int) (int, *StockLevel, error) {
+	if stockReservationTTL == 0 || !list.reservesStock() {
+		return 0, nil, nil
+	}
+	cart, err := cartStore.GetCartByCustomer(ctx, customerID, list)
+	if err != nil {
+		return 0, nil, err
+	}
+	previous, _ := cart.quantityOf(productID)
+	level, err := reserveStock(ctx, customerID, productID, quantity)
+	return previous, level, err
+}
+
+// reserveStockForUpdate reserves stock for the quantity a PATCH leaves in
+// the cart, reading the line first since the update may be relative. It
+// returns the line's current quantity, to restore if the cart write fails.
+// Lists other than the cart reserve nothing.
+func reserveStockForUpdate(ctx context.Context, customerID int, list ListType, productID int, update QuantityUpdate) (int, *StockLevel, error) {
+	if stockReservationTTL == 0 || !list.reservesStock() {
+		return 0, nil, nil
+	}
+	cart, err := cartStore.GetCartByCustomer(ctx, customerID, list)
+	if err != nil {
+		return 0, nil, err
+	}
+	for _, item := range cart.Items {
+		if item.ProductID == productID {
+			next, err := update.apply(item.Quantity)
+			if err != nil {
+				return 0, nil, err
+			}
+			level, err := reserveStock(ctx, customerID, productID, next)
+			return item.Quantity, level, err
+		}
+	}
+	return 0, nil, ErrItemNotFound
+}
+
+// reserveStockForMove reserves stock for the quantity moving a line from
+// another list leaves in the cart: the line's plus what the cart already
+// holds of the product. It returns the cart's current quantity, to restore
+// if the move fails.
+func reserveStockForMove(ctx context.Context, customerID int, from ListType, productID int) (int, *StockLevel, error) {
+	if stockReservationTTL == 0 {
+		return 0, nil, nil
+	}
+	source, err := cartStore.GetCartByCustomer(ctx, customerID, from)
+	if err != nil {
+		return 0, nil, err
+	}
+	moved, ok := source.quantityOf(productID)
+	if !ok {
+		return 0, nil, ErrItemNotFound
+	}
+	cart, err := cartStore.GetCartByCustomer(ctx, customerID, ListCart)
+	if err != nil {
+		return 0, nil, err
+	}
+	previous, _ := cart.quantityOf(productID)
+	level, err := reserveStock(ctx, customerID, productID, previous+moved)
+	return previous, level, err
+}
+
+// restoreStock puts a line's reservation back to quantity after the cart
+// write it was made for failed
+func restoreStock(ctx context.Context, customerID, productID, quantity int) {
+	if _, err := reserveStock(ctx, customerID, productID, quantity); err != nil {
+		log.Printf("Error restoring stock reservation of product %d for customer %d: %v", productID, customerID, err)
+	}
+}
+
+// cartProductIDs lists the products in a customer's cart when reservations
+// are enabled, so they can be released once the lines are gone. Other lists
+// hold no reservations and list nothing.
+func cartProductIDs(ctx context.Context, customerID int, list ListType) []int {
+	if stockReservationTTL == 0 || !list.reservesStock() {
+		return nil
+	}
+	cart, err := cartStore.GetCartByCustomer(ctx, customerID, list)
+	if err != nil {
+		return nil
+	}
+	productIDs := make([]int, len(cart.Items))
+	for i, item := range cart.Items {
+		productIDs[i] = item.ProductID
+	}
+	return productIDs
+}
+
+// releaseStock drops the reservations of cart lines that are gone. Failures
+// are only logged: the reservations still run out after their TTL.
+func releaseStock(ctx context.Context, customerID int, productIDs ...int) {
+	if stockReservationTTL == 0 || len(productIDs) == 0 {
+		return
+	}
+	if err := inventoryStore.Release(ctx, customerID, productIDs...); err != nil {
+		log.Printf("Error releasing stock for customer %d: %v", customerID, err)
+	}
+}
+
+// transferStock moves the reservations of merged guest lines to the
+// customer. The guest's are released first, so the units they held are
+// available to the customer's. A merged line that cannot be reserved in full
+// is only logged: the merge has happened, and checkout checks stock again.
+func transferStock(ctx context.Context, guestID, customerID int, cart *ShoppingCart, productIDs []int) {
+	if stockReservationTTL == 0 || len(productIDs) == 0 {
+		return
+	}
+	releaseStock(ctx, guestID, productIDs...)
+
+	merged := make(map[int]bool, len(productIDs))
+	for _, productID := range productIDs {
+		merged[productID] = true
+	}
+	for _, item := range cart.Items {
+		if !merged[item.ProductID] {
+			continue
+		}
+		if _, err := reserveStock(ctx, customerID, item.ProductID, item.Quantity); err != nil {
+			log.Printf("Error reserving stock of merged product %d for customer %d: %v", item.ProductID, customerID, err)
+		}
+	}
+}
+
+// stockLevel totals the unexpired reservations, deleting expired ones from
+// the map on the way. The reservation of except, if any, counts as available.
+func stockLevel(productID, onHand int, reservations map[int]stockReservation, except int, now time.Time) *StockLevel {
+	reserved := 0
+	for customerID, r := range reservations {
+		switch {
+		case !r.ExpiresAt.After(now):
+			delete(reservations, customerID)
+		case customerID != except:
+			reserved += r.Quantity
+		}
+	}
+	return &StockLevel{
+		ProductID: productID,
+		Tracked:   true,
+		OnHand:    onHand,
+		Reserved:  reserved,
+		Available: availableStock(onHand, reserved),
+	}
+}
+
+// takeStock checks that quantity units of a product can be ordered by
+// customerID, counting the customer's own reservation as available. It
+// returns the units left on hand; the caller drops the reservation.
+func takeStock(productID, onHand int, reservations map[int]stockReservation, customerID, quantity int, now time.Time) (int, error) {
+	level := stockLevel(productID, onHand, reservations, customerID, now)
+	if quantity > level.Available {
+		return onHand, &InsufficientStockError{Level: level}
+	}
+	return onHand - quantity, nil
+}
+
+// availableStock is how many units are left once other reservations are
+// taken out, never less than zero
+func availableStock(onHand, reserved int) int {
+	return max(onHand-reserved, 0)
+}
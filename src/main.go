@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
 	"log"
+	"net/http"
 	"os"
 	"sync"
+	"time"
 	
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
@@ -15,10 +18,18 @@ var syncProducts sync.Map
 
 // Response structure
 type SearchResponse struct {
-	Products      []Item `json:"products"`
-	TotalFound    int    `json:"total_found"`
-	TotalSearched int    `json:"total_searched"`
-	SearchTime    string `json:"search_time"`
+	Products      []Item         `json:"products"`
+	TotalFound    int            `json:"total_found"`
+	TotalSearched int            `json:"total_searched"`
+	SearchTime    string         `json:"search_time"`
+	Limit         int            `json:"limit"`
+	Offset        int            `json:"offset"`
+	NextCursor    string         `json:"next_cursor,omitempty"`
+	Sort          string         `json:"sort"`
+	Order         string         `json:"order"`
+	Filters       *SearchFilters `json:"filters,omitempty"`
+	// Facets counts values over every match, not just this page
+	Facets map[string][]FacetBucket `json:"facets,omitempty"`
 }
 
 // func init() {
@@ -43,14 +54,36 @@ func main() {
 	log.Printf("Using database type: %s", databaseType)
 
 	// Initialize database based on type
-	if databaseType == "dynamodb" {
+	switch databaseType {
+	case "memory":
+		// In-process cart store for local development and CI, no external services
+		log.Println("Using in-memory cart store (data is lost on restart)")
+		cartStore = NewMemoryCartStore()
+		idempotencyStore = NewMemoryIdempotencyStore()
+		inventoryStore = NewMemoryInventoryStore()
+		orderStore = NewMemoryOrderStore(cartStore.(*memoryCartStore), inventoryStore.(*memoryInventoryStore))
+	case "dynamodb":
 		// Initialize DynamoDB
 		log.Println("Initializing DynamoDB...")
 		if err := InitDynamoDB(); err != nil {
 			log.Fatalf("Failed to initialize DynamoDB: %v", err)
 		}
 		defer CloseDynamoDB()
-		
+		cartStore = NewDynamoDBCartStore(DynamoDBClient, DynamoDBTableName)
+		idempotencyStore = NewDynamoDBIdempotencyStore(DynamoDBClient, DynamoDBTableName)
+		inventoryStore = NewDynamoDBInventoryStore(DynamoDBClient, DynamoDBTableName)
+		orderStore = NewDynamoDBOrderStore(DynamoDBClient, DynamoDBTableName)
+
+		// Copy carts from the old list-shaped table before serving, so
+		// customers never get a second cart next to their legacy one. Only
+		// the first task to finish does the scan; later ones see the marker.
+		if legacyTable := os.Getenv("DYNAMODB_LEGACY_TABLE"); legacyTable != "" {
+			log.Printf("Migrating legacy carts from %s...", legacyTable)
+			if err := MigrateLegacyCarts(context.Background(), DynamoDBClient, legacyTable, DynamoDBTableName); err != nil {
+				log.Fatalf("Failed to migrate legacy carts: %v", err)
+			}
+		}
+
 		// Still initialize MySQL for product lookups (products table)
 		log.Println("Initializing MySQL for product lookups...")
 		if err := InitDatabase(); err != nil {
@@ -58,36 +91,118 @@ func main() {
 		} else {
 			defer CloseDatabase()
 		}
-	} else {
+	default:
 		// Initialize MySQL (default)
 		log.Println("Initializing MySQL database...")
 		if err := InitDatabase(); err != nil {
 			log.Fatalf("Failed to initialize database: %v", err)
 		}
 		defer CloseDatabase()
+		cartStore = NewMySQLCartStore(DB)
+		idempotencyStore = NewMySQLIdempotencyStore(DB)
+		inventoryStore = NewMySQLInventoryStore(DB)
+		orderStore = NewMySQLOrderStore(DB)
+	}
+
+	// Background loops stop on shutdown, before the database pools close
+	background, stopBackground := context.WithCancel(context.Background())
+	var backgroundDone sync.WaitGroup
+	defer backgroundDone.Wait()
+	defer stopBackground()
+
+	// Duplicate products of a merged guest cart are combined by this rule
+	// unless the request names one
+	cartMergeRule = cartMergeRuleFromEnv()
+
+	// Abandoned carts expire after CART_TTL_DAYS days without a write.
+	// DynamoDB deletes them through its TTL; the other stores need a sweeper.
+	cartTTL = cartTTLFromEnv()
+	if cartTTL > 0 {
+		log.Printf("Carts expire after %s without a write", cartTTL)
+		if sweeper, ok := cartStore.(idleCartSweeper); ok {
+			setCartExpiryMode("sweeper")
+			backgroundDone.Add(1)
+			go func() {
+				defer backgroundDone.Done()
+				sweepIdleCarts(background, sweeper, cartTTL, cartSweepIntervalFromEnv())
+			}()
+		} else {
+			setCartExpiryMode("dynamodb_ttl")
+		}
+	}
+
+	// Cart writes reserve stock of tracked products only when asked to
+	if stockReservationsEnabled() {
+		stockReservationTTL = stockReservationTTLFromEnv()
+		log.Printf("Reserving stock for cart items for %s", stockReservationTTL)
 	}
 
-	// Generate and seed products (always needed for product lookups)
-    log.Println("Generating products...")
-    products := GenerateProducts(100000)
-    
-    // Seed products into MySQL database (if MySQL is available)
-    if DB != nil {
-		if err := seedProductsBatch(products); err != nil {
-			log.Printf("Warning: Failed to seed products: %v", err)
+	// Products live in MySQL whenever it is available. Without it there is
+	// nothing to load from, so generate the catalog from PRODUCT_SEED, which
+	// gives every task the same products.
+	productSeed := productSeedFromEnv()
+	// Carts kept outside MySQL stand in for fk_product when deleting products
+	var inCart cartProductChecker
+	switch carts := cartStore.(type) {
+	case *memoryCartStore:
+		inCart = carts.containsProduct
+	case *dynamoCartStore:
+		inCart = carts.containsProduct
+	}
+	if DB != nil {
+		if seedProductsEnabled() {
+			log.Println("Seeding products...")
+			if err := seedProductsBatch(GenerateProducts(defaultProductCount, productSeed)); err != nil {
+				log.Printf("Warning: Failed to seed products: %v", err)
+			}
+		}
+		if err := backfillProductPrices(productSeed); err != nil {
+			log.Fatalf("Failed to backfill product prices: %v", err)
 		}
+		productStore = NewMySQLProductStore(DB, inCart)
+	} else {
+		log.Printf("No MySQL database, generating products from seed %d", productSeed)
+		productStore = NewMemoryProductStore(GenerateProducts(defaultProductCount, productSeed), inCart)
 	}
 
-	for k, v := range products {
-		syncProducts.Store(k, v)
+	// Load the catalog every handler reads from
+	products, catalogVersion, err := loadCatalog(context.Background(), productStore)
+	if err != nil {
+		log.Fatalf("Failed to load products: %v", err)
+	}
+	if len(products) == 0 {
+		log.Println("Warning: product catalog is empty; set SEED_PRODUCTS=true to seed it")
 	}
 
+	// Pick up product edits made through the other tasks
+	backgroundDone.Add(1)
+	go func() {
+		defer backgroundDone.Done()
+		refreshCatalog(background, productStore, catalogVersion, productRefreshIntervalFromEnv())
+	}()
+
 	// initialize Gin router using Default
 	router := gin.Default()
 
+	// Liveness and readiness for the ECS and ALB health checks
+	router.GET("/healthz/live", healthLive)
+	router.GET("/healthz/ready", healthReady)
+
 	// Health endpoint - checks appropriate database connection
     router.GET("/health", func(c *gin.Context) {
-		if databaseType == "dynamodb" {
+		// A draining task takes itself out of the load balancer
+		if draining.Load() {
+			c.JSON(503, gin.H{
+				"status": "draining",
+			})
+			return
+		}
+		if databaseType == "memory" {
+			c.JSON(200, gin.H{
+				"status": "healthy",
+				"database": "memory",
+			})
+		} else if databaseType == "dynamodb" {
 			// Check DynamoDB connection (describe table)
 			if DynamoDBClient == nil {
 				c.JSON(503, gin.H{
@@ -124,24 +239,58 @@ func main() {
 		}
     })
 
-	// Shopping cart endpoints - route to appropriate handlers based on database type
-	if databaseType == "dynamodb" {
-		router.POST("/shopping-carts", createShoppingCartDynamoDB)
-		router.GET("/shopping-carts/:id", getShoppingCartDynamoDB)
-		router.POST("/shopping-carts/:id/items", addItemToCartDynamoDB)
-	} else {
-		router.POST("/shopping-carts", createShoppingCart)
-		router.GET("/shopping-carts/:id", getShoppingCart)
-		router.POST("/shopping-carts/:id/items", addItemToCart)
+	registerRoutes(router, idempotencyTTLFromEnv())
+	printSample(products, 10)
+	log.Printf("Total products: %d", len(products))
+	// Serve until ECS stops the task, then drain before the deferred
+	// background and database shutdowns run
+	server := &http.Server{Addr: ":8080", Handler: router}
+	if err := serveUntilSignal(server, drainDurationFromEnv("DRAIN_DELAY", defaultDrainDelay),
+		drainDurationFromEnv("DRAIN_TIMEOUT", defaultDrainTimeout)); err != nil {
+		log.Printf("Server stopped: %v", err)
 	}
+}
+
+// registerRoutes adds the cart, order and product endpoints to router
+func registerRoutes(router *gin.Engine, idempotencyTTL time.Duration) {
+	// Shopping cart endpoints - backed by whichever CartStore main selected.
+	// Creating a cart, adding items, merging and checking out honor the
+	// Idempotency-Key header, since clients retry those POSTs on timeout.
+	// Guest carts are addressed by their token in place of the customer ID.
+	router.POST("/shopping-carts", idempotent(idempotencyTTL), createShoppingCart)
+	router.POST("/guest-carts", idempotent(idempotencyTTL), createGuestCart)
+	router.GET("/shopping-carts/:id", getShoppingCart)
+	router.DELETE("/shopping-carts/:id", deleteShoppingCart)
+	router.POST("/shopping-carts/:id/clear", clearShoppingCart)
+	router.POST("/shopping-carts/:id/items", idempotent(idempotencyTTL), addItemToCart)
+	router.PATCH("/shopping-carts/:id/items/:productId", updateCartItem)
+	router.DELETE("/shopping-carts/:id/items/:productId", removeCartItem)
+	router.POST("/shopping-carts/:id/items/:productId/move", idempotent(idempotencyTTL), moveCartItem)
+	router.POST("/shopping-carts/:id/merge", idempotent(idempotencyTTL), mergeShoppingCart)
+	router.POST("/shopping-carts/:id/checkout", requireIdempotencyKey, idempotent(idempotencyTTL), checkoutShoppingCart)
+	router.GET("/orders/:id", getOrder)
+	router.GET("/customers/:id/orders", listCustomerOrders)
+	// Wishlists and saved-for-later lists take the same routes as the cart,
+	// under the list type; /customers/:id/lists/cart is the cart again
+	router.GET("/customers/:id/lists", listCustomerLists)
+	router.POST("/customers/:id/lists", idempotent(idempotencyTTL), createCustomerList)
+	router.GET("/customers/:id/lists/:type", getShoppingCart)
+	router.DELETE("/customers/:id/lists/:type", deleteShoppingCart)
+	router.POST("/customers/:id/lists/:type/clear", clearShoppingCart)
+	router.POST("/customers/:id/lists/:type/items", idempotent(idempotencyTTL), addItemToCart)
+	router.PATCH("/customers/:id/lists/:type/items/:productId", updateCartItem)
+	router.DELETE("/customers/:id/lists/:type/items/:productId", removeCartItem)
+	router.POST("/customers/:id/lists/:type/items/:productId/move", idempotent(idempotencyTTL), moveCartItem)
+	router.GET("/metrics/carts", getCartMetrics)
+	router.POST("/products", createProduct)
+	router.DELETE("/products/:productId", deleteProduct)
 	// associate GET HTTP method and "/products/{productId}" path with a handler function "getItemByID"
 	router.GET("/products/:productId", getItemByID)
 	// associate POST HTTP method and "/products/{productId}/details" path with a handler function "postItem"
 	router.POST("/products/:productId/details", postItem)
 	// associate GET HTTP method and "/products/search?q={query}" path with a handler function "searchProducts"
 	router.GET("/products/search", searchProducts)
-	printSample(products, 10)
-	log.Printf("Total products: %d", len(products))
-	// "Run()" attaches router to an http server and start the server
-	router.Run(":8080")
+	router.GET("/products/suggest", suggestProducts)
+	router.GET("/products/:productId/stock", getProductStock)
+	router.PUT("/products/:productId/stock", setProductStock)
 }
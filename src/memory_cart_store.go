@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryCartStore keeps carts in process memory. It mirrors the MySQL
+// schema (one list of each type per customer, one row per product in a list)
+// so it can stand in for a real database in local development and CI.
+type memoryCartStore struct {
+	mu          sync.Mutex
+	carts       map[cartKey]*memoryCart
+	guests      map[string]int // guest customer IDs keyed by token
+	nextCartID  int
+	nextItemID  int
+	nextGuestID int
+}
+
+type memoryCart struct {
+	cart  ShoppingCart
+	items map[int]*CartItem // keyed by product ID
+}
+
+// NewMemoryCartStore returns an empty in-process CartStore
+func NewMemoryCartStore() CartStore {
+	return &memoryCartStore{carts: make(map[cartKey]*memoryCart), guests: make(map[string]int)}
+}
+
+func (s *memoryCartStore) CreateCart(ctx context.Context, customerID int, list ListType) (*ShoppingCart, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.carts[cartKey{customerID, list}]; ok {
+		return existing.snapshot(), false, nil
+	}
+	return s.createLocked(customerID, list).snapshot(), true, nil
+}
+
+// createLocked adds an empty list for the customer; s.mu must be held
+func (s *memoryCartStore) createLocked(customerID int, list ListType) *memoryCart {
+	s.nextCartID++
+	now := time.Now().Format(time.RFC3339)
+	mc := &memoryCart{
+		cart: ShoppingCart{
+			ID:         s.nextCartID,
+			CustomerID: customerID,
+			Type:       list,
+			CreatedAt:  now,
+			UpdatedAt:  now,
+		},
+		items: make(map[int]*CartItem),
+	}
+	s.carts[cartKey{customerID, list}] = mc
+	return mc
+}
+
+func (s *memoryCartStore) GetCartByCustomer(ctx context.Context, customerID int, list ListType) (*ShoppingCart, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mc, ok := s.carts[cartKey{customerID, list}]
+	if !ok {
+		return nil, ErrCartNotFound
+	}
+	return mc.snapshot(), nil
+}
+
+func (s *memoryCartStore) ListCarts(ctx context.Context, customerID int) ([]ShoppingCart, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	carts := []ShoppingCart{}
+	for key, mc := range s.carts {
+		if key.customerID == customerID {
+			carts = append(carts, *mc.snapshot())
+		}
+	}
+	sort.Slice(carts, func(i, j int) bool { return carts[i].ID < carts[j].ID })
+	return carts, nil
+}
+
+func (s *memoryCartStore) UpsertItem(ctx context.Context, customerID int, list ListType, productID, quantity int) (*CartItem, bool, error) {
+	value, exists := syncProducts.Load(productID)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mc, ok := s.carts[cartKey{customerID, list}]
+	if !ok {
+		return nil, false, ErrCartNotFound
+	}
+	if !exists {
+		return nil, false, ErrProductNotFound
+	}
+	product := value.(Item)
+
+	now := time.Now().Format(time.RFC3339)
+	item, found := mc.items[productID]
+	if !found {
+		s.nextItemID++
+		item = &CartItem{ID: s.nextItemID, ProductID: productID, CreatedAt: now}
+		mc.items[productID] = item
+	}
+	item.Quantity = quantity
+	item.Manufacturer = product.Manufacturer
+	item.Category = product.Category
+	item.UnitPrice = product.Price
+	item.UnitPriceAtAdd = &product.Price
+	item.Currency = product.Currency
+	item.Weight = product.Weight
+	item.UpdatedAt = now
+	mc.cart.UpdatedAt = now
+
+	result := *item
+	return &result, !found, nil
+}
+
+func (s *memoryCartStore) UpdateItemQuantity(ctx context.Context, customerID int, list ListType, productID int, update QuantityUpdate) (*CartItem, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mc, ok := s.carts[cartKey{customerID, list}]
+	if !ok {
+		return nil, ErrCartNotFound
+	}
+	item, ok := mc.items[productID]
+	if !ok {
+		return nil, ErrItemNotFound
+	}
+
+	next, err := update.apply(item.Quantity)
+	if err != nil {
+		return nil, err
+	}
+
+	result := *item
+	result.Quantity = next
+	result.UpdatedAt = time.Now().Format(time.RFC3339)
+	mc.cart.UpdatedAt = result.UpdatedAt
+	if next == 0 {
+		delete(mc.items, productID)
+	} else {
+		*item = result
+	}
+	result.fillFromCatalog()
+	return &result, nil
+}
+
+func (s *memoryCartStore) RemoveItem(ctx context.Context, customerID int, list ListType, productID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mc, ok := s.carts[cartKey{customerID, list}]
+	if !ok {
+		return ErrCartNotFound
+	}
+	if _, ok := mc.items[productID]; !ok {
+		return ErrItemNotFound
+	}
+	delete(mc.items, productID)
+	mc.cart.UpdatedAt = time.Now().Format(time.RFC3339)
+	return nil
+}
+
+func (s *memoryCartStore) ClearCart(ctx context.Context, customerID int, list ListType) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mc, ok := s.carts[cartKey{customerID, list}]
+	if !ok {
+		return ErrCartNotFound
+	}
+	mc.items = make(map[int]*CartItem)
+	mc.cart.UpdatedAt = time.Now().Format(time.RFC3339)
+	return nil
+}
+
+func (s *memoryCartStore) DeleteCart(ctx context.Context, customerID int, list ListType) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := cartKey{customerID, list}
+	if _, ok := s.carts[key]; !ok {
+		return ErrCartNotFound
+	}
+	delete(s.carts, key)
+	return nil
+}
+
+func (s *memoryCartStore) MoveItem(ctx context.Context, customerID int, from, to ListType, productID int) (*CartItem, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	source, ok := s.carts[cartKey{customerID, from}]
+	if !ok {
+		return nil, ErrCartNotFound
+	}
+	target, ok := s.carts[cartKey{customerID, to}]
+	if !ok {
+		return nil, ErrCartNotFound
+	}
+	line, ok := source.items[productID]
+	if !ok {
+		return nil, ErrItemNotFound
+	}
+
+	now := time.Now().Format(time.RFC3339)
+	result := target.addLine(*line, MergeSum, now)
+	delete(source.items, productID)
+	source.cart.UpdatedAt = now
+	result.fillFromCatalog()
+	return &result, nil
+}
+
+func (s *memoryCartStore) CreateGuestCart(ctx context.Context) (*ShoppingCart, string, error) {
+	token, err := newGuestToken()
+	if err != nil {
+		return nil, "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextGuestID++
+	s.guests[token] = -s.nextGuestID
+	return s.createLocked(-s.nextGuestID, ListCart).snapshot(), token, nil
+}
+
+func (s *memoryCartStore) GuestCustomerID(ctx context.Context, token string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	guestID, ok := s.guests[token]
+	if !ok {
+		return 0, ErrCartNotFound
+	}
+	return guestID, nil
+}
+
+func (s *memoryCartStore) MergeCarts(ctx context.Context, guestID, customerID int, rule MergeRule) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	guest, ok := s.carts[cartKey{guestID, ListCart}]
+	if !ok {
+		return ErrCartNotFound
+	}
+	mc, ok := s.carts[cartKey{customerID, ListCart}]
+	if !ok {
+		return ErrCartNotFound
+	}
+
+	now := time.Now().Format(time.RFC3339)
+	for _, guestLine := range guest.items {
+		mc.addLine(*guestLine, rule, now)
+	}
+	mc.cart.UpdatedAt = now
+
+	delete(s.carts, cartKey{guestID, ListCart})
+	for token, id := range s.guests {
+		if id == guestID {
+			delete(s.guests, token)
+		}
+	}
+	return nil
+}
+
+// DeleteIdleCarts implements idleCartSweeper
+func (s *memoryCartStore) DeleteIdleCarts(ctx context.Context, cutoff time.Time, limit int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deleted := 0
+	for key, mc := range s.carts {
+		if deleted == limit {
+			break
+		}
+		if !key.list.expires() {
+			continue
+		}
+		updated, err := time.Parse(time.RFC3339, mc.cart.UpdatedAt)
+		if err == nil && updated.Before(cutoff) {
+			delete(s.carts, key)
+			deleted++
+		}
+	}
+	// Tokens of guest carts that are gone lead nowhere
+	for token, guestID := range s.guests {
+		if _, ok := s.carts[cartKey{guestID, ListCart}]; !ok {
+			delete(s.guests, token)
+		}
+	}
+	return deleted, nil
+}
+
+// containsProduct reports whether any cart holds the product. It keeps
+// nothing out, so there is nothing to release.
+func (s *memoryCartStore) containsProduct(ctx context.Context, productID int) (bool, func(), error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, mc := range s.carts {
+		if _, ok := mc.items[productID]; ok {
+			return true, nil, nil
+		}
+	}
+	return false, func() {}, nil
+}
+
+// addLine puts a line from another list into mc, combining it by rule with
+// mc's line for the same product, and returns the line mc ends up with
+func (mc *memoryCart) addLine(line CartItem, rule MergeRule, now string) CartItem {
+	if existing, ok := mc.items[line.ProductID]; ok {
+		line = rule.merge(*existing, line)
+	}
+	line.UpdatedAt = now
+	mc.items[line.ProductID] = &line
+	mc.cart.UpdatedAt = now
+	return line
+}
+
+// snapshot copies the cart so callers never share memory with the store.
+// Items are ordered newest first, like the MySQL query, and priced like its
+// products join.
+func (mc *memoryCart) snapshot() *ShoppingCart {
+	cart := mc.cart
+	cart.Items = make([]CartItem, 0, len(mc.items))
+	for _, item := range mc.items {
+		line := *item
+		line.fillFromCatalog()
+		cart.Items = append(cart.Items, line)
+	}
+	sort.Slice(cart.Items, func(i, j int) bool {
+		return cart.Items[i].ID > cart.Items[j].ID
+	})
+	return &cart
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryCartStoreReturnsCopies(t *testing.T) {
+	newTestRouter(t)
+	ctx := context.Background()
+	if _, _, err := cartStore.CreateCart(ctx, 1, ListCart); err != nil {
+		t.Fatalf("creating cart: %v", err)
+	}
+	if _, _, err := cartStore.UpsertItem(ctx, 1, ListCart, 1, 2); err != nil {
+		t.Fatalf("adding item: %v", err)
+	}
+
+	cart, err := cartStore.GetCartByCustomer(ctx, 1, ListCart)
+	if err != nil {
+		t.Fatalf("reading cart: %v", err)
+	}
+	cart.Items[0].Quantity = 99
+	cart.Items = nil
+
+	again, err := cartStore.GetCartByCustomer(ctx, 1, ListCart)
+	if err != nil {
+		t.Fatalf("reading cart again: %v", err)
+	}
+	if len(again.Items) != 1 || again.Items[0].Quantity != 2 {
+		t.Errorf("stored cart changed through a returned copy: %+v", again.Items)
+	}
+}
+
+func TestMemoryCartStoreDeleteIdleCarts(t *testing.T) {
+	newTestRouter(t)
+	ctx := context.Background()
+	for customerID := 1; customerID <= 3; customerID++ {
+		if _, _, err := cartStore.CreateCart(ctx, customerID, ListCart); err != nil {
+			t.Fatalf("creating cart: %v", err)
+		}
+	}
+	// Wishlists are kept however long they sit idle
+	if _, _, err := cartStore.CreateCart(ctx, 1, ListWishlist); err != nil {
+		t.Fatalf("creating wishlist: %v", err)
+	}
+	sweeper := cartStore.(idleCartSweeper)
+
+	if n, err := sweeper.DeleteIdleCarts(ctx, time.Now().Add(-time.Hour), 10); err != nil || n != 0 {
+		t.Errorf("sweeping fresh carts deleted %d, %v; want 0", n, err)
+	}
+	// Timestamps have whole seconds, so every cart is idle a minute from now
+	if n, err := sweeper.DeleteIdleCarts(ctx, time.Now().Add(time.Minute), 2); err != nil || n != 2 {
+		t.Errorf("sweep with limit 2 deleted %d, %v; want 2", n, err)
+	}
+	if n, err := sweeper.DeleteIdleCarts(ctx, time.Now().Add(time.Minute), 2); err != nil || n != 1 {
+		t.Errorf("second sweep deleted %d, %v; want the last cart", n, err)
+	}
+	if _, err := cartStore.GetCartByCustomer(ctx, 1, ListWishlist); err != nil {
+		t.Errorf("wishlist after sweeping: %v", err)
+	}
+}
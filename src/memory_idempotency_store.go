@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// memoryIdempotencyStore keeps Idempotency-Key records in process memory
+type memoryIdempotencyStore struct {
+	mu       sync.Mutex
+	records  map[string]IdempotencyRecord
+	reserves int
+}
+
+// NewMemoryIdempotencyStore returns an empty in-process IdempotencyStore
+func NewMemoryIdempotencyStore() IdempotencyStore {
+	return &memoryIdempotencyStore{records: make(map[string]IdempotencyRecord)}
+}
+
+func (s *memoryIdempotencyStore) Reserve(ctx context.Context, key, fingerprint string, lockUntil time.Time) (*IdempotencyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if existing, ok := s.records[key]; ok && existing.ExpiresAt.After(now) {
+		return &existing, ErrIdempotencyKeyExists
+	}
+
+	// Drop expired records now and then so the map doesn't grow forever
+	s.reserves++
+	if s.reserves%1000 == 0 {
+		for k, record := range s.records {
+			if !record.ExpiresAt.After(now) {
+				delete(s.records, k)
+			}
+		}
+	}
+
+	s.records[key] = IdempotencyRecord{Key: key, Fingerprint: fingerprint, ExpiresAt: lockUntil}
+	return nil, nil
+}
+
+func (s *memoryIdempotencyStore) Complete(ctx context.Context, record IdempotencyRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.records[record.Key] = record
+	return nil
+}
+
+func (s *memoryIdempotencyStore) Release(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.records, key)
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// memoryInventoryStore keeps stock in process memory
+type memoryInventoryStore struct {
+	mu    sync.Mutex
+	stock map[int]*memoryStock // keyed by product ID
+}
+
+type memoryStock struct {
+	onHand       int
+	reservations map[int]stockReservation // keyed by customer ID
+}
+
+// NewMemoryInventoryStore returns an InventoryStore tracking no products yet
+func NewMemoryInventoryStore() InventoryStore {
+	return &memoryInventoryStore{stock: make(map[int]*memoryStock)}
+}
+
+func (s *memoryInventoryStore) GetStock(ctx context.Context, productID int) (*StockLevel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stock, ok := s.stock[productID]
+	if !ok {
+		return nil, ErrStockNotTracked
+	}
+	return stock.level(productID, 0, time.Now()), nil
+}
+
+func (s *memoryInventoryStore) SetStock(ctx context.Context, productID, onHand int) (*StockLevel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stock, ok := s.stock[productID]
+	if !ok {
+		stock = &memoryStock{reservations: make(map[int]stockReservation)}
+		s.stock[productID] = stock
+	}
+	stock.onHand = onHand
+	return stock.level(productID, 0, time.Now()), nil
+}
+
+func (s *memoryInventoryStore) Reserve(ctx context.Context, customerID, productID, quantity int, ttl time.Duration) (*StockLevel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stock, ok := s.stock[productID]
+	if !ok {
+		return nil, nil
+	}
+
+	now := time.Now()
+	if level := stock.level(productID, customerID, now); quantity > level.Available {
+		return level, ErrInsufficientStock
+	}
+	stock.reservations[customerID] = stockReservation{Quantity: quantity, ExpiresAt: now.Add(ttl)}
+	return stock.level(productID, 0, now), nil
+}
+
+func (s *memoryInventoryStore) Release(ctx context.Context, customerID int, productIDs ...int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, productID := range productIDs {
+		if stock, ok := s.stock[productID]; ok {
+			delete(stock.reservations, customerID)
+		}
+	}
+	return nil
+}
+
+func (stock *memoryStock) level(productID, except int, now time.Time) *StockLevel {
+	return stockLevel(productID, stock.onHand, stock.reservations, except, now)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryOrderStore keeps orders in process memory. Checkout works directly
+// on the memory cart and inventory stores, holding their locks throughout,
+// so it is atomic like the MySQL transaction.
+type memoryOrderStore struct {
+	mu        sync.Mutex
+	carts     *memoryCartStore
+	inventory *memoryInventoryStore
+	orders    map[int]Order
+	nextID    int
+}
+
+// NewMemoryOrderStore returns an OrderStore checking out the given stores' carts
+func NewMemoryOrderStore(carts *memoryCartStore, inventory *memoryInventoryStore) OrderStore {
+	return &memoryOrderStore{
+		carts:     carts,
+		inventory: inventory,
+		orders:    make(map[int]Order),
+	}
+}
+
+func (s *memoryOrderStore) Checkout(ctx context.Context, customerID int, acceptPriceChanges bool) (*Order, error) {
+	s.carts.mu.Lock()
+	defer s.carts.mu.Unlock()
+	s.inventory.mu.Lock()
+	defer s.inventory.mu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mc, ok := s.carts.carts[cartKey{customerID, ListCart}]
+	if !ok {
+		return nil, ErrCartNotFound
+	}
+	order, err := newOrderFromCart(mc.snapshot(), acceptPriceChanges)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check every line before touching stock, so a shortage changes nothing
+	now := time.Now()
+	onHand := make(map[int]int)
+	for _, item := range order.Items {
+		stock, tracked := s.inventory.stock[item.ProductID]
+		if !tracked {
+			continue
+		}
+		left, err := takeStock(item.ProductID, stock.onHand, stock.reservations, customerID, item.Quantity, now)
+		if err != nil {
+			return nil, err
+		}
+		onHand[item.ProductID] = left
+	}
+	for productID, left := range onHand {
+		stock := s.inventory.stock[productID]
+		stock.onHand = left
+		delete(stock.reservations, customerID)
+	}
+
+	s.nextID++
+	order.ID = s.nextID
+	order.CreatedAt = now.Format(time.RFC3339)
+	s.orders[order.ID] = *order
+	mc.items = make(map[int]*CartItem)
+	mc.cart.UpdatedAt = order.CreatedAt
+	return order, nil
+}
+
+func (s *memoryOrderStore) GetOrder(ctx context.Context, orderID int) (*Order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	order, ok := s.orders[orderID]
+	if !ok {
+		return nil, ErrOrderNotFound
+	}
+	return &order, nil
+}
+
+func (s *memoryOrderStore) ListOrders(ctx context.Context, customerID int) ([]Order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	orders := []Order{}
+	for _, order := range s.orders {
+		if order.CustomerID == customerID {
+			orders = append(orders, order)
+		}
+	}
+	sort.Slice(orders, func(i, j int) bool { return orders[i].ID > orders[j].ID })
+	return orders, nil
+}
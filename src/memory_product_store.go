@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// memoryProductStore holds the catalog in process memory. It is used when no
+// MySQL database is available, so it starts from a generated catalog.
+type memoryProductStore struct {
+	mu        sync.RWMutex
+	products  map[int]Item
+	skus      map[string]int // SKU -> product ID, mirrors products.sku UNIQUE
+	updatedAt map[int]time.Time
+	deletedAt map[int]time.Time
+	retired   map[int]Item // soft-deleted products
+	nextID    int
+
+	// inCart stands in for fk_product; nil when there are no carts to check
+	inCart cartProductChecker
+}
+
+// NewMemoryProductStore returns a ProductStore holding a copy of products.
+// inCart, if not nil, reports whether any cart holds a product, so hard
+// deletes can be refused like MySQL's ON DELETE RESTRICT does.
+func NewMemoryProductStore(products map[int]Item, inCart cartProductChecker) ProductStore {
+	s := &memoryProductStore{
+		products:  make(map[int]Item, len(products)),
+		skus:      make(map[string]int, len(products)),
+		updatedAt: make(map[int]time.Time),
+		deletedAt: make(map[int]time.Time),
+		retired:   make(map[int]Item),
+		inCart:    inCart,
+	}
+	for id, item := range products {
+		s.products[id] = item
+		s.skus[item.SKU] = id
+		s.nextID = max(s.nextID, id)
+	}
+	return s
+}
+
+func (s *memoryProductStore) LoadProducts(ctx context.Context) (map[int]Item, time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	products := make(map[int]Item, len(s.products))
+	for id, item := range s.products {
+		products[id] = item
+	}
+	return products, time.Now(), nil
+}
+
+func (s *memoryProductStore) UpdateProduct(ctx context.Context, update ProductUpdate) (*Item, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, ok := s.products[update.ID]
+	if !ok {
+		return nil, ErrProductNotFound
+	}
+	item := update.apply(current)
+	if owner, taken := s.skus[item.SKU]; taken && owner != item.ID {
+		return nil, ErrDuplicateSKU
+	}
+
+	delete(s.skus, current.SKU)
+	s.skus[item.SKU] = item.ID
+	s.products[item.ID] = item
+	s.updatedAt[item.ID] = time.Now()
+	return &item, nil
+}
+
+func (s *memoryProductStore) CreateProduct(ctx context.Context, item Item) (*Item, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, taken := s.skus[item.SKU]; taken {
+		return nil, ErrDuplicateSKU
+	}
+
+	s.nextID++
+	item.ID = s.nextID
+	s.skus[item.SKU] = item.ID
+	s.products[item.ID] = item
+	s.updatedAt[item.ID] = time.Now()
+	return &item, nil
+}
+
+func (s *memoryProductStore) DeleteProduct(ctx context.Context, productID int, soft bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item, ok := s.products[productID]
+	if !ok && !soft {
+		// Soft-deleted products can still be removed for good
+		item, ok = s.retired[productID]
+	}
+	if !ok {
+		return ErrProductNotFound
+	}
+	if !soft && s.inCart != nil {
+		// Nothing below can fail, so the check is never released
+		held, _, err := s.inCart(ctx, productID)
+		if err != nil {
+			return err
+		}
+		if held {
+			return ErrProductInCart
+		}
+	}
+
+	// A soft-deleted product keeps its SKU, as the row stays in MySQL
+	if soft {
+		s.retired[productID] = item
+	} else {
+		delete(s.skus, item.SKU)
+		delete(s.retired, productID)
+	}
+	delete(s.products, productID)
+	delete(s.updatedAt, productID)
+	s.deletedAt[productID] = time.Now()
+	return nil
+}
+
+func (s *memoryProductStore) ChangedSince(ctx context.Context, since time.Time) ([]Item, []int, time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	var changed []Item
+	for id, updatedAt := range s.updatedAt {
+		if !updatedAt.Before(since) {
+			changed = append(changed, s.products[id])
+		}
+	}
+	var deleted []int
+	for id, deletedAt := range s.deletedAt {
+		if !deletedAt.Before(since) {
+			deleted = append(deleted, id)
+		}
+	}
+	return changed, deleted, now, nil
+}
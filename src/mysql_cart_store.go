@@ -0,0 +1,591 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// mysqlCartStore keeps every kind of list in the shopping_carts and
+// shopping_cart_items tables, told apart by shopping_carts.list_type
+type mysqlCartStore struct {
+	db *sql.DB
+}
+
+// NewMySQLCartStore returns a CartStore backed by the given connection pool
+func NewMySQLCartStore(db *sql.DB) CartStore {
+	return &mysqlCartStore{db: db}
+}
+
+// cartItemColumns selects a CartItem joined with its product details
+const cartItemColumns = `
+        SELECT
+            sci.id,
+            sci.product_id,
+            p.manufacturer,
+            p.category,
+            sci.quantity,
+            p.price,
+            sci.unit_price_at_add,
+            p.currency,
+            COALESCE(p.weight, 0),
+            sci.created_at,
+            sci.updated_at
+        FROM shopping_cart_items sci
+        INNER JOIN products p ON sci.product_id = p.id`
+
+func scanCartItem(row interface{ Scan(...any) error }, item *CartItem) error {
+	return row.Scan(
+		&item.ID,
+		&item.ProductID,
+		&item.Manufacturer,
+		&item.Category,
+		&item.Quantity,
+		&item.UnitPrice,
+		&item.UnitPriceAtAdd,
+		&item.Currency,
+		&item.Weight,
+		&item.CreatedAt,
+		&item.UpdatedAt,
+	)
+}
+
+func (s *mysqlCartStore) CreateCart(ctx context.Context, customerID int, list ListType) (*ShoppingCart, bool, error) {
+	// One atomic statement per list: the UNIQUE key on (customer_id,
+	// list_type) turns a concurrent duplicate into a no-op update, and
+	// LAST_INSERT_ID(id) hands back the existing list's ID in that case
+	insertQuery := `
+        INSERT INTO shopping_carts (customer_id, list_type) VALUES (?, ?)
+        ON DUPLICATE KEY UPDATE id = LAST_INSERT_ID(id)`
+	result, err := s.db.ExecContext(ctx, insertQuery, customerID, list)
+	if err != nil {
+		return nil, false, fmt.Errorf("creating shopping cart: %w", err)
+	}
+
+	cartID, err := result.LastInsertId()
+	if err != nil {
+		return nil, false, fmt.Errorf("getting cart ID: %w", err)
+	}
+	// One row affected means insert; the no-op duplicate path affects none
+	rowsAffected, _ := result.RowsAffected()
+
+	cart := &ShoppingCart{ID: int(cartID), CustomerID: customerID, Type: list, Items: []CartItem{}}
+	err = s.db.QueryRowContext(ctx, `SELECT created_at, updated_at FROM shopping_carts WHERE id = ?`, cartID).
+		Scan(&cart.CreatedAt, &cart.UpdatedAt)
+	if err != nil {
+		log.Printf("Error reading back cart %d: %v", cartID, err)
+	}
+	return cart, rowsAffected == 1, nil
+}
+
+// cartColumns selects a ShoppingCart header
+const cartColumns = `SELECT id, customer_id, list_type, created_at, updated_at FROM shopping_carts`
+
+func scanCart(row interface{ Scan(...any) error }, cart *ShoppingCart) error {
+	return row.Scan(
+		&cart.ID,
+		&cart.CustomerID,
+		&cart.Type,
+		&cart.CreatedAt,
+		&cart.UpdatedAt,
+	)
+}
+
+func (s *mysqlCartStore) GetCartByCustomer(ctx context.Context, customerID int, list ListType) (*ShoppingCart, error) {
+	var cart ShoppingCart
+	err := scanCart(s.db.QueryRowContext(ctx, cartColumns+` WHERE customer_id = ? AND list_type = ?`, customerID, list), &cart)
+	if err == sql.ErrNoRows {
+		return nil, ErrCartNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("retrieving cart: %w", err)
+	}
+
+	cart.Items, err = s.cartItems(ctx, cart.ID)
+	return &cart, err
+}
+
+func (s *mysqlCartStore) ListCarts(ctx context.Context, customerID int) ([]ShoppingCart, error) {
+	rows, err := s.db.QueryContext(ctx, cartColumns+` WHERE customer_id = ? ORDER BY id`, customerID)
+	if err != nil {
+		return nil, fmt.Errorf("listing carts: %w", err)
+	}
+	carts := []ShoppingCart{}
+	for rows.Next() {
+		var cart ShoppingCart
+		if err := scanCart(rows, &cart); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scanning cart: %w", err)
+		}
+		carts = append(carts, cart)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("listing carts: %w", err)
+	}
+
+	// A customer has at most one list of each type, so a query per list is cheap
+	for i := range carts {
+		if carts[i].Items, err = s.cartItems(ctx, carts[i].ID); err != nil {
+			return nil, err
+		}
+	}
+	return carts, nil
+}
+
+// cartItems reads a cart's lines, newest first
+func (s *mysqlCartStore) cartItems(ctx context.Context, cartID int) ([]CartItem, error) {
+	// Get cart items with product details using efficient JOINs
+	rows, err := s.db.QueryContext(ctx, cartItemColumns+`
+        WHERE sci.shopping_cart_id = ?
+        ORDER BY sci.created_at DESC`, cartID)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving cart items: %w", err)
+	}
+	defer rows.Close()
+
+	items := []CartItem{}
+	for rows.Next() {
+		var item CartItem
+		if err := scanCartItem(rows, &item); err != nil {
+			log.Printf("Error scanning cart item: %v", err)
+			continue
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+func (s *mysqlCartStore) UpsertItem(ctx context.Context, customerID int, list ListType, productID, quantity int) (*CartItem, bool, error) {
+	cartID, err := s.cartIDForCustomer(ctx, customerID, list)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Verify product exists, and read the price the line records
+	var price int64
+	checkProductQuery := `SELECT price FROM products WHERE id = ? AND deleted_at IS NULL`
+	err = s.db.QueryRowContext(ctx, checkProductQuery, productID).Scan(&price)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, ErrProductNotFound
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("checking product existence: %w", err)
+	}
+
+	// Insert or update cart item (MySQL handles duplicate with ON DUPLICATE KEY UPDATE).
+	// Adding a product again records its current price.
+	insertQuery := `
+        INSERT INTO shopping_cart_items (shopping_cart_id, product_id, quantity, unit_price_at_add)
+        VALUES (?, ?, ?, ?)
+        ON DUPLICATE KEY UPDATE
+            quantity = VALUES(quantity),
+            unit_price_at_add = VALUES(unit_price_at_add),
+            updated_at = CURRENT_TIMESTAMP`
+
+	result, err := s.db.ExecContext(ctx, insertQuery, cartID, productID, quantity, price)
+	if err != nil {
+		return nil, false, fmt.Errorf("adding item to cart: %w", err)
+	}
+	if err := touchCart(ctx, s.db, cartID); err != nil {
+		log.Printf("Error touching cart %d: %v", cartID, err)
+	}
+
+	// One row affected means insert, two means the duplicate key path updated it
+	rowsAffected, _ := result.RowsAffected()
+	created := rowsAffected == 1
+
+	item := &CartItem{ProductID: productID, Quantity: quantity}
+	row := s.db.QueryRowContext(ctx, cartItemColumns+`
+        WHERE sci.shopping_cart_id = ? AND sci.product_id = ?`, cartID, productID)
+	if err := scanCartItem(row, item); err != nil {
+		// Still report success since the item was written
+		log.Printf("Error retrieving added item: %v", err)
+	}
+	return item, created, nil
+}
+
+// cartIDForCustomer resolves the shopping_carts primary key of a customer's list
+func (s *mysqlCartStore) cartIDForCustomer(ctx context.Context, customerID int, list ListType) (int, error) {
+	var cartID int
+	err := s.db.QueryRowContext(ctx, `SELECT id FROM shopping_carts WHERE customer_id = ? AND list_type = ?`,
+		customerID, list).Scan(&cartID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrCartNotFound
+	}
+	if err != nil {
+		return 0, fmt.Errorf("finding cart: %w", err)
+	}
+	return cartID, nil
+}
+
+func (s *mysqlCartStore) UpdateItemQuantity(ctx context.Context, customerID int, list ListType, productID int, update QuantityUpdate) (*CartItem, error) {
+	cartID, err := s.cartIDForCustomer(ctx, customerID, list)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Lock the line so concurrent deltas are applied one after another
+	var current int
+	lockQuery := `SELECT quantity FROM shopping_cart_items
+                  WHERE shopping_cart_id = ? AND product_id = ? FOR UPDATE`
+	err = tx.QueryRowContext(ctx, lockQuery, cartID, productID).Scan(&current)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrItemNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("locking cart item: %w", err)
+	}
+
+	next, err := update.apply(current)
+	if err != nil {
+		return nil, err
+	}
+
+	if next == 0 {
+		_, err = tx.ExecContext(ctx, `DELETE FROM shopping_cart_items WHERE shopping_cart_id = ? AND product_id = ?`,
+			cartID, productID)
+	} else {
+		_, err = tx.ExecContext(ctx, `UPDATE shopping_cart_items SET quantity = ?, updated_at = CURRENT_TIMESTAMP
+                                      WHERE shopping_cart_id = ? AND product_id = ?`, next, cartID, productID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("updating cart item: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("committing cart item update: %w", err)
+	}
+	// Outside the transaction: checkout locks the cart row before its lines
+	if err := touchCart(ctx, s.db, cartID); err != nil {
+		log.Printf("Error touching cart %d: %v", cartID, err)
+	}
+
+	item := &CartItem{ProductID: productID, Quantity: next}
+	if next == 0 {
+		return item, nil
+	}
+	row := s.db.QueryRowContext(ctx, cartItemColumns+`
+        WHERE sci.shopping_cart_id = ? AND sci.product_id = ?`, cartID, productID)
+	if err := scanCartItem(row, item); err != nil {
+		log.Printf("Error retrieving updated item: %v", err)
+	}
+	return item, nil
+}
+
+func (s *mysqlCartStore) RemoveItem(ctx context.Context, customerID int, list ListType, productID int) error {
+	cartID, err := s.cartIDForCustomer(ctx, customerID, list)
+	if err != nil {
+		return err
+	}
+
+	result, err := s.db.ExecContext(ctx, `DELETE FROM shopping_cart_items WHERE shopping_cart_id = ? AND product_id = ?`,
+		cartID, productID)
+	if err != nil {
+		return fmt.Errorf("removing cart item: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrItemNotFound
+	}
+	if err := touchCart(ctx, s.db, cartID); err != nil {
+		log.Printf("Error touching cart %d: %v", cartID, err)
+	}
+	return nil
+}
+
+func (s *mysqlCartStore) ClearCart(ctx context.Context, customerID int, list ListType) error {
+	cartID, err := s.cartIDForCustomer(ctx, customerID, list)
+	if err != nil {
+		return err
+	}
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM shopping_cart_items WHERE shopping_cart_id = ?`, cartID); err != nil {
+		return fmt.Errorf("clearing cart: %w", err)
+	}
+	if err := touchCart(ctx, s.db, cartID); err != nil {
+		log.Printf("Error touching cart %d: %v", cartID, err)
+	}
+	return nil
+}
+
+func (s *mysqlCartStore) DeleteCart(ctx context.Context, customerID int, list ListType) error {
+	// shopping_cart_items rows go with the cart through fk_cart ON DELETE CASCADE
+	result, err := s.db.ExecContext(ctx, `DELETE FROM shopping_carts WHERE customer_id = ? AND list_type = ?`,
+		customerID, list)
+	if err != nil {
+		return fmt.Errorf("deleting cart: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrCartNotFound
+	}
+	return nil
+}
+
+func (s *mysqlCartStore) CreateGuestCart(ctx context.Context) (*ShoppingCart, string, error) {
+	token, err := newGuestToken()
+	if err != nil {
+		return nil, "", err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// The guest_carts ID numbers the guest, and the token is linked to the
+	// cart once the cart exists
+	result, err := tx.ExecContext(ctx, `INSERT INTO guest_carts (token) VALUES (?)`, token)
+	if err != nil {
+		return nil, "", fmt.Errorf("creating guest: %w", err)
+	}
+	guestRowID, err := result.LastInsertId()
+	if err != nil {
+		return nil, "", fmt.Errorf("getting guest ID: %w", err)
+	}
+	guestID := -int(guestRowID)
+
+	result, err = tx.ExecContext(ctx, `INSERT INTO shopping_carts (customer_id) VALUES (?)`, guestID)
+	if err != nil {
+		return nil, "", fmt.Errorf("creating guest cart: %w", err)
+	}
+	cartID, err := result.LastInsertId()
+	if err != nil {
+		return nil, "", fmt.Errorf("getting cart ID: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE guest_carts SET shopping_cart_id = ? WHERE id = ?`, cartID, guestRowID); err != nil {
+		return nil, "", fmt.Errorf("linking guest cart: %w", err)
+	}
+
+	cart := &ShoppingCart{ID: int(cartID), CustomerID: guestID, Type: ListCart, Items: []CartItem{}}
+	err = tx.QueryRowContext(ctx, `SELECT created_at, updated_at FROM shopping_carts WHERE id = ?`, cartID).
+		Scan(&cart.CreatedAt, &cart.UpdatedAt)
+	if err != nil {
+		return nil, "", fmt.Errorf("reading back guest cart: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, "", fmt.Errorf("committing guest cart: %w", err)
+	}
+	return cart, token, nil
+}
+
+func (s *mysqlCartStore) GuestCustomerID(ctx context.Context, token string) (int, error) {
+	var guestRowID int
+	err := s.db.QueryRowContext(ctx, `SELECT id FROM guest_carts WHERE token = ?`, token).Scan(&guestRowID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrCartNotFound
+	}
+	if err != nil {
+		return 0, fmt.Errorf("finding guest cart: %w", err)
+	}
+	return -guestRowID, nil
+}
+
+func (s *mysqlCartStore) MergeCarts(ctx context.Context, guestID, customerID int, rule MergeRule) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	guestKey, customerKey := cartKey{guestID, ListCart}, cartKey{customerID, ListCart}
+	cartIDs, err := lockCarts(ctx, tx, guestKey, customerKey)
+	if err != nil {
+		return err
+	}
+	guestLines, err := lockCartItems(ctx, tx, cartIDs[guestKey])
+	if err != nil {
+		return err
+	}
+	customerLines, err := lockCartItems(ctx, tx, cartIDs[customerKey])
+	if err != nil {
+		return err
+	}
+
+	for productID, guestLine := range guestLines {
+		var existing *CartItem
+		if customerLine, ok := customerLines[productID]; ok {
+			existing = &customerLine
+		}
+		if err := moveLine(ctx, tx, guestLine, cartIDs[customerKey], existing, rule); err != nil {
+			return err
+		}
+	}
+
+	// The guest's guest_carts row goes with the cart through ON DELETE CASCADE
+	if _, err := tx.ExecContext(ctx, `DELETE FROM shopping_carts WHERE id = ?`, cartIDs[guestKey]); err != nil {
+		return fmt.Errorf("deleting guest cart: %w", err)
+	}
+	if err := touchCart(ctx, tx, cartIDs[customerKey]); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing cart merge: %w", err)
+	}
+	return nil
+}
+
+func (s *mysqlCartStore) MoveItem(ctx context.Context, customerID int, from, to ListType, productID int) (*CartItem, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	fromKey, toKey := cartKey{customerID, from}, cartKey{customerID, to}
+	cartIDs, err := lockCarts(ctx, tx, fromKey, toKey)
+	if err != nil {
+		return nil, err
+	}
+	fromLines, err := lockCartItems(ctx, tx, cartIDs[fromKey])
+	if err != nil {
+		return nil, err
+	}
+	line, ok := fromLines[productID]
+	if !ok {
+		return nil, ErrItemNotFound
+	}
+	toLines, err := lockCartItems(ctx, tx, cartIDs[toKey])
+	if err != nil {
+		return nil, err
+	}
+
+	var existing *CartItem
+	if toLine, ok := toLines[productID]; ok {
+		existing = &toLine
+	}
+	if err := moveLine(ctx, tx, line, cartIDs[toKey], existing, MergeSum); err != nil {
+		return nil, err
+	}
+	for _, cartID := range cartIDs {
+		if err := touchCart(ctx, tx, cartID); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("committing item move: %w", err)
+	}
+
+	item := &CartItem{ProductID: productID}
+	row := s.db.QueryRowContext(ctx, cartItemColumns+`
+        WHERE sci.shopping_cart_id = ? AND sci.product_id = ?`, cartIDs[toKey], productID)
+	if err := scanCartItem(row, item); err != nil {
+		// Still report success since the item was moved
+		log.Printf("Error retrieving moved item: %v", err)
+	}
+	return item, nil
+}
+
+// lockCarts locks the shopping_carts rows of the given lists in ID order,
+// the order every transaction that locks several lists takes them in, and
+// returns their IDs. Their lines are locked after them, as checkout does.
+// Unless every list exists it returns ErrCartNotFound.
+func lockCarts(ctx context.Context, tx *sql.Tx, keys ...cartKey) (map[cartKey]int, error) {
+	args := make([]any, 0, 2*len(keys))
+	for _, key := range keys {
+		args = append(args, key.customerID, key.list)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("(?, ?), ", len(keys)), ", ")
+	rows, err := tx.QueryContext(ctx, `SELECT id, customer_id, list_type FROM shopping_carts
+                                       WHERE (customer_id, list_type) IN (`+placeholders+`)
+                                       ORDER BY id FOR UPDATE`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("locking carts: %w", err)
+	}
+	defer rows.Close()
+
+	cartIDs := make(map[cartKey]int, len(keys))
+	for rows.Next() {
+		var cartID int
+		var key cartKey
+		if err := rows.Scan(&cartID, &key.customerID, &key.list); err != nil {
+			return nil, fmt.Errorf("locking carts: %w", err)
+		}
+		cartIDs[key] = cartID
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("locking carts: %w", err)
+	}
+	if len(cartIDs) < len(keys) {
+		return nil, ErrCartNotFound
+	}
+	return cartIDs, nil
+}
+
+// moveLine moves a locked line into another cart. If that cart already has
+// a line for the product, existing, the two are combined by rule into
+// existing and the moved line is deleted.
+func moveLine(ctx context.Context, tx *sql.Tx, line CartItem, toCartID int, existing *CartItem, rule MergeRule) error {
+	if existing == nil {
+		_, err := tx.ExecContext(ctx, `UPDATE shopping_cart_items SET shopping_cart_id = ?,
+                                       updated_at = CURRENT_TIMESTAMP WHERE id = ?`, toCartID, line.ID)
+		if err != nil {
+			return fmt.Errorf("moving cart item: %w", err)
+		}
+		return nil
+	}
+
+	merged := rule.merge(*existing, line)
+	_, err := tx.ExecContext(ctx, `UPDATE shopping_cart_items SET quantity = ?, unit_price_at_add = ?,
+                                   updated_at = CURRENT_TIMESTAMP WHERE id = ?`,
+		merged.Quantity, merged.UnitPriceAtAdd, merged.ID)
+	if err != nil {
+		return fmt.Errorf("merging cart item: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM shopping_cart_items WHERE id = ?`, line.ID); err != nil {
+		return fmt.Errorf("deleting merged cart item: %w", err)
+	}
+	return nil
+}
+
+// lockCartItems reads a cart's lines keyed by product ID and locks them until
+// the transaction ends
+func lockCartItems(ctx context.Context, tx *sql.Tx, cartID int) (map[int]CartItem, error) {
+	rows, err := tx.QueryContext(ctx, cartItemColumns+`
+        WHERE sci.shopping_cart_id = ? FOR UPDATE OF sci`, cartID)
+	if err != nil {
+		return nil, fmt.Errorf("locking cart items: %w", err)
+	}
+	defer rows.Close()
+
+	items := map[int]CartItem{}
+	for rows.Next() {
+		var item CartItem
+		if err := scanCartItem(rows, &item); err != nil {
+			return nil, fmt.Errorf("scanning cart item: %w", err)
+		}
+		items[item.ProductID] = item
+	}
+	return items, rows.Err()
+}
+
+// DeleteIdleCarts implements idleCartSweeper. Only carts expire, not other
+// lists. Items and guest tokens go with their carts through ON DELETE CASCADE.
+func (s *mysqlCartStore) DeleteIdleCarts(ctx context.Context, cutoff time.Time, limit int) (int, error) {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM shopping_carts WHERE list_type = ? AND updated_at < ? LIMIT ?`,
+		ListCart, cutoff.UTC(), limit)
+	if err != nil {
+		return 0, fmt.Errorf("deleting idle carts: %w", err)
+	}
+	n, _ := result.RowsAffected()
+	return int(n), nil
+}
+
+// touchCart sets a cart's updated_at to now after a write to its items, so
+// updated_at is the cart's last activity, which its expiry counts from
+func touchCart(ctx context.Context, q interface {
+	ExecContext(context.Context, string, ...any) (sql.Result, error)
+}, cartID int) error {
+	if _, err := q.ExecContext(ctx, `UPDATE shopping_carts SET updated_at = CURRENT_TIMESTAMP WHERE id = ?`, cartID); err != nil {
+		return fmt.Errorf("touching cart: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// mysqlIdempotencyStore keeps Idempotency-Key records in the idempotency_keys table
+type mysqlIdempotencyStore struct {
+	db       *sql.DB
+	reserves atomic.Int64
+}
+
+// NewMySQLIdempotencyStore returns an IdempotencyStore backed by the given connection pool
+func NewMySQLIdempotencyStore(db *sql.DB) IdempotencyStore {
+	return &mysqlIdempotencyStore{db: db}
+}
+
+func (s *mysqlIdempotencyStore) Reserve(ctx context.Context, key, fingerprint string, lockUntil time.Time) (*IdempotencyRecord, error) {
+	// Purge expired keys now and then so the table doesn't grow forever
+	if s.reserves.Add(1)%1000 == 0 {
+		if _, err := s.db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE expires_at <= ? LIMIT 1000`, time.Now().UTC()); err != nil {
+			log.Printf("Error purging expired idempotency keys: %v", err)
+		}
+	}
+
+	for {
+		// The primary key makes the insert the atomic claim
+		_, err := s.db.ExecContext(ctx, `INSERT INTO idempotency_keys (idempotency_key, fingerprint, expires_at) VALUES (?, ?, ?)`,
+			key, fingerprint, lockUntil.UTC())
+		if err == nil {
+			return nil, nil
+		}
+		if !isDuplicateKey(err) {
+			return nil, fmt.Errorf("reserving idempotency key: %w", err)
+		}
+
+		// The key exists; take it over only if it has expired
+		result, err := s.db.ExecContext(ctx, `
+        UPDATE idempotency_keys
+        SET fingerprint = ?, completed = FALSE, status_code = NULL, content_type = NULL,
+            response_body = NULL, expires_at = ?
+        WHERE idempotency_key = ? AND expires_at <= ?`,
+			fingerprint, lockUntil.UTC(), key, time.Now().UTC())
+		if err != nil {
+			return nil, fmt.Errorf("reclaiming idempotency key: %w", err)
+		}
+		if n, _ := result.RowsAffected(); n == 1 {
+			return nil, nil
+		}
+
+		existing, err := s.get(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if existing != nil {
+			return existing, ErrIdempotencyKeyExists
+		}
+		// Released between our insert and read, so the key is free again
+	}
+}
+
+func (s *mysqlIdempotencyStore) Complete(ctx context.Context, record IdempotencyRecord) error {
+	_, err := s.db.ExecContext(ctx, `
+        UPDATE idempotency_keys
+        SET completed = TRUE, status_code = ?, content_type = ?, response_body = ?, expires_at = ?
+        WHERE idempotency_key = ? AND fingerprint = ?`,
+		record.StatusCode, record.ContentType, record.Body, record.ExpiresAt.UTC(), record.Key, record.Fingerprint)
+	if err != nil {
+		return fmt.Errorf("storing idempotent response: %w", err)
+	}
+	return nil
+}
+
+func (s *mysqlIdempotencyStore) Release(ctx context.Context, key string) error {
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE idempotency_key = ? AND completed = FALSE`, key); err != nil {
+		return fmt.Errorf("releasing idempotency key: %w", err)
+	}
+	return nil
+}
+
+// get reads a key's record, or nil when there is none
+func (s *mysqlIdempotencyStore) get(ctx context.Context, key string) (*IdempotencyRecord, error) {
+	record := IdempotencyRecord{Key: key}
+	var statusCode sql.NullInt64
+	var contentType sql.NullString
+	err := s.db.QueryRowContext(ctx, `
+        SELECT fingerprint, completed, status_code, content_type, response_body, expires_at
+        FROM idempotency_keys WHERE idempotency_key = ?`, key).Scan(
+		&record.Fingerprint,
+		&record.Completed,
+		&statusCode,
+		&contentType,
+		&record.Body,
+		&record.ExpiresAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading idempotency key: %w", err)
+	}
+	record.StatusCode = int(statusCode.Int64)
+	record.ContentType = contentType.String
+	return &record, nil
+}
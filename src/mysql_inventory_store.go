@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// mysqlInventoryStore keeps stock in the product_stock table and cart
+// reservations in stock_reservations
+type mysqlInventoryStore struct {
+	db *sql.DB
+}
+
+// NewMySQLInventoryStore returns an InventoryStore backed by the given connection pool
+func NewMySQLInventoryStore(db *sql.DB) InventoryStore {
+	return &mysqlInventoryStore{db: db}
+}
+
+func (s *mysqlInventoryStore) GetStock(ctx context.Context, productID int) (*StockLevel, error) {
+	var onHand int
+	err := s.db.QueryRowContext(ctx, `SELECT on_hand FROM product_stock WHERE product_id = ?`, productID).Scan(&onHand)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrStockNotTracked
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading stock: %w", err)
+	}
+	return mysqlStockLevel(ctx, s.db, productID, onHand, 0)
+}
+
+func (s *mysqlInventoryStore) SetStock(ctx context.Context, productID, onHand int) (*StockLevel, error) {
+	_, err := s.db.ExecContext(ctx, `
+        INSERT INTO product_stock (product_id, on_hand) VALUES (?, ?)
+        ON DUPLICATE KEY UPDATE on_hand = VALUES(on_hand)`, productID, onHand)
+	if err != nil {
+		return nil, fmt.Errorf("setting stock: %w", err)
+	}
+	return mysqlStockLevel(ctx, s.db, productID, onHand, 0)
+}
+
+func (s *mysqlInventoryStore) Reserve(ctx context.Context, customerID, productID, quantity int, ttl time.Duration) (*StockLevel, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// The stock row lock makes concurrent reservations of one product take
+	// turns, so each sees the others' committed reservations
+	var onHand int
+	err = tx.QueryRowContext(ctx, `SELECT on_hand FROM product_stock WHERE product_id = ? FOR UPDATE`, productID).Scan(&onHand)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("locking stock: %w", err)
+	}
+
+	now := time.Now().UTC()
+	if _, err := tx.ExecContext(ctx, `DELETE FROM stock_reservations WHERE product_id = ? AND expires_at <= ?`, productID, now); err != nil {
+		return nil, fmt.Errorf("purging expired reservations: %w", err)
+	}
+	level, err := mysqlStockLevel(ctx, tx, productID, onHand, customerID)
+	if err != nil {
+		return nil, err
+	}
+	if quantity > level.Available {
+		return level, ErrInsufficientStock
+	}
+
+	_, err = tx.ExecContext(ctx, `
+        INSERT INTO stock_reservations (product_id, customer_id, quantity, expires_at) VALUES (?, ?, ?, ?)
+        ON DUPLICATE KEY UPDATE quantity = VALUES(quantity), expires_at = VALUES(expires_at)`,
+		productID, customerID, quantity, now.Add(ttl))
+	if err != nil {
+		return nil, fmt.Errorf("reserving stock: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	level.Reserved += quantity
+	level.Available = availableStock(onHand, level.Reserved)
+	return level, nil
+}
+
+func (s *mysqlInventoryStore) Release(ctx context.Context, customerID int, productIDs ...int) error {
+	if len(productIDs) == 0 {
+		return nil
+	}
+	args := []any{customerID}
+	for _, productID := range productIDs {
+		args = append(args, productID)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(productIDs)), ", ")
+	_, err := s.db.ExecContext(ctx,
+		`DELETE FROM stock_reservations WHERE customer_id = ? AND product_id IN (`+placeholders+`)`, args...)
+	if err != nil {
+		return fmt.Errorf("releasing stock: %w", err)
+	}
+	return nil
+}
+
+// mysqlStockLevel sums the unexpired reservations of a product, leaving out except's
+func mysqlStockLevel(ctx context.Context, q interface {
+	QueryRowContext(context.Context, string, ...any) *sql.Row
+}, productID, onHand, except int) (*StockLevel, error) {
+	var reserved int
+	err := q.QueryRowContext(ctx, `
+        SELECT COALESCE(SUM(quantity), 0) FROM stock_reservations
+        WHERE product_id = ? AND customer_id <> ? AND expires_at > ?`,
+		productID, except, time.Now().UTC()).Scan(&reserved)
+	if err != nil {
+		return nil, fmt.Errorf("summing reservations: %w", err)
+	}
+	return &StockLevel{
+		ProductID: productID,
+		Tracked:   true,
+		OnHand:    onHand,
+		Reserved:  reserved,
+		Available: availableStock(onHand, reserved),
+	}, nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// mysqlOrderStore keeps orders in the orders and order_items tables
+type mysqlOrderStore struct {
+	db *sql.DB
+}
+
+// NewMySQLOrderStore returns an OrderStore backed by the given connection pool
+func NewMySQLOrderStore(db *sql.DB) OrderStore {
+	return &mysqlOrderStore{db: db}
+}
+
+// orderColumns selects an orders row in the order scanOrder expects
+const orderColumns = `
+        SELECT id, customer_id, status, subtotal, currency, item_count, total_weight, created_at
+        FROM orders`
+
+func scanOrder(row interface{ Scan(...any) error }, order *Order) error {
+	return row.Scan(
+		&order.ID,
+		&order.CustomerID,
+		&order.Status,
+		&order.Subtotal,
+		&order.Currency,
+		&order.ItemCount,
+		&order.TotalWeight,
+		&order.CreatedAt,
+	)
+}
+
+func (s *mysqlOrderStore) Checkout(ctx context.Context, customerID int, acceptPriceChanges bool) (*Order, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Lock the cart and its lines, so nothing is added or changed between
+	// reading the lines and deleting them
+	cart := ShoppingCart{CustomerID: customerID, Type: ListCart}
+	err = tx.QueryRowContext(ctx, `SELECT id FROM shopping_carts WHERE customer_id = ? AND list_type = ? FOR UPDATE`,
+		customerID, ListCart).Scan(&cart.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrCartNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("locking cart: %w", err)
+	}
+	rows, err := tx.QueryContext(ctx, cartItemColumns+`
+        WHERE sci.shopping_cart_id = ?
+        ORDER BY sci.created_at DESC
+        FOR UPDATE OF sci`, cart.ID)
+	if err != nil {
+		return nil, fmt.Errorf("reading cart items: %w", err)
+	}
+	for rows.Next() {
+		var item CartItem
+		if err := scanCartItem(rows, &item); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scanning cart item: %w", err)
+		}
+		cart.Items = append(cart.Items, item)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading cart items: %w", err)
+	}
+
+	order, err := newOrderFromCart(&cart, acceptPriceChanges)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.takeStock(ctx, tx, customerID, order.Items); err != nil {
+		return nil, err
+	}
+
+	result, err := tx.ExecContext(ctx, `
+        INSERT INTO orders (customer_id, status, subtotal, currency, item_count, total_weight)
+        VALUES (?, ?, ?, ?, ?, ?)`,
+		customerID, order.Status, order.Subtotal, order.Currency, order.ItemCount, order.TotalWeight)
+	if err != nil {
+		return nil, fmt.Errorf("creating order: %w", err)
+	}
+	orderID, err := result.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("getting order ID: %w", err)
+	}
+
+	valueStrings := make([]string, 0, len(order.Items))
+	args := make([]any, 0, len(order.Items)*7)
+	for _, item := range order.Items {
+		valueStrings = append(valueStrings, "(?, ?, ?, ?, ?, ?, ?)")
+		args = append(args, orderID, item.ProductID, item.Manufacturer, item.Category,
+			item.Quantity, item.UnitPrice, item.Weight)
+	}
+	_, err = tx.ExecContext(ctx, `
+        INSERT INTO order_items (order_id, product_id, manufacturer, category, quantity, unit_price, weight)
+        VALUES `+strings.Join(valueStrings, ", "), args...)
+	if err != nil {
+		return nil, fmt.Errorf("creating order items: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM shopping_cart_items WHERE shopping_cart_id = ?`, cart.ID); err != nil {
+		return nil, fmt.Errorf("emptying cart: %w", err)
+	}
+	if err := touchCart(ctx, tx, cart.ID); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return s.GetOrder(ctx, int(orderID))
+}
+
+// takeStock takes ordered units of tracked products off stock and drops the
+// customer's reservations of them. Stock rows are locked in product ID
+// order, so concurrent checkouts cannot deadlock on them.
+func (s *mysqlOrderStore) takeStock(ctx context.Context, tx *sql.Tx, customerID int, items []OrderItem) error {
+	quantities := make(map[int]int, len(items))
+	args := make([]any, 0, len(items))
+	for _, item := range items {
+		quantities[item.ProductID] = item.Quantity
+		args = append(args, item.ProductID)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(items)), ", ")
+
+	rows, err := tx.QueryContext(ctx, `
+        SELECT product_id, on_hand FROM product_stock
+        WHERE product_id IN (`+placeholders+`)
+        ORDER BY product_id
+        FOR UPDATE`, args...)
+	if err != nil {
+		return fmt.Errorf("locking stock: %w", err)
+	}
+	onHand := make(map[int]int)
+	for rows.Next() {
+		var productID, units int
+		if err := rows.Scan(&productID, &units); err != nil {
+			rows.Close()
+			return fmt.Errorf("scanning stock: %w", err)
+		}
+		onHand[productID] = units
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("locking stock: %w", err)
+	}
+
+	for productID, units := range onHand {
+		level, err := mysqlStockLevel(ctx, tx, productID, units, customerID)
+		if err != nil {
+			return err
+		}
+		if quantities[productID] > level.Available {
+			return &InsufficientStockError{Level: level}
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE product_stock SET on_hand = on_hand - ? WHERE product_id = ?`,
+			quantities[productID], productID)
+		if err != nil {
+			return fmt.Errorf("taking stock: %w", err)
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM stock_reservations WHERE customer_id = ? AND product_id IN (`+placeholders+`)`,
+		append([]any{customerID}, args...)...)
+	if err != nil {
+		return fmt.Errorf("dropping reservations: %w", err)
+	}
+	return nil
+}
+
+func (s *mysqlOrderStore) GetOrder(ctx context.Context, orderID int) (*Order, error) {
+	var order Order
+	err := scanOrder(s.db.QueryRowContext(ctx, orderColumns+` WHERE id = ?`, orderID), &order)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrOrderNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading order: %w", err)
+	}
+
+	items, err := s.orderItems(ctx, []int{order.ID})
+	if err != nil {
+		return nil, err
+	}
+	order.Items = items[order.ID]
+	return &order, nil
+}
+
+func (s *mysqlOrderStore) ListOrders(ctx context.Context, customerID int) ([]Order, error) {
+	rows, err := s.db.QueryContext(ctx, orderColumns+` WHERE customer_id = ? ORDER BY id DESC`, customerID)
+	if err != nil {
+		return nil, fmt.Errorf("reading orders: %w", err)
+	}
+	defer rows.Close()
+
+	orders := []Order{}
+	var orderIDs []int
+	for rows.Next() {
+		var order Order
+		if err := scanOrder(rows, &order); err != nil {
+			return nil, fmt.Errorf("scanning order: %w", err)
+		}
+		orders = append(orders, order)
+		orderIDs = append(orderIDs, order.ID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading orders: %w", err)
+	}
+	if len(orders) == 0 {
+		return orders, nil
+	}
+
+	items, err := s.orderItems(ctx, orderIDs)
+	if err != nil {
+		return nil, err
+	}
+	for i := range orders {
+		orders[i].Items = items[orders[i].ID]
+	}
+	return orders, nil
+}
+
+// orderItems reads the items of several orders, keyed by order ID
+func (s *mysqlOrderStore) orderItems(ctx context.Context, orderIDs []int) (map[int][]OrderItem, error) {
+	args := make([]any, len(orderIDs))
+	for i, id := range orderIDs {
+		args[i] = id
+	}
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT order_id, product_id, manufacturer, category, quantity, unit_price, weight
+        FROM order_items
+        WHERE order_id IN (`+strings.TrimSuffix(strings.Repeat("?, ", len(orderIDs)), ", ")+`)
+        ORDER BY id`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("reading order items: %w", err)
+	}
+	defer rows.Close()
+
+	items := make(map[int][]OrderItem, len(orderIDs))
+	for rows.Next() {
+		var orderID int
+		var item OrderItem
+		if err := rows.Scan(&orderID, &item.ProductID, &item.Manufacturer, &item.Category,
+			&item.Quantity, &item.UnitPrice, &item.Weight); err != nil {
+			return nil, fmt.Errorf("scanning order item: %w", err)
+		}
+		items[orderID] = append(items[orderID], item)
+	}
+	return items, rows.Err()
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// mysqlProductStore keeps the catalog in the products table
+type mysqlProductStore struct {
+	db *sql.DB
+
+	// inCart checks carts kept outside MySQL, which fk_product cannot see;
+	// nil when the carts are in MySQL too
+	inCart cartProductChecker
+}
+
+// NewMySQLProductStore returns a ProductStore backed by the given connection
+// pool. inCart, if not nil, is asked before a hard delete as well.
+func NewMySQLProductStore(db *sql.DB, inCart cartProductChecker) ProductStore {
+	return &mysqlProductStore{db: db, inCart: inCart}
+}
+
+// changeWatermarkLag holds the catalog refresh watermark back from the
+// database clock. updated_at is stamped when a row is written, not when its
+// transaction commits, so a write can become visible after the clock has
+// passed its timestamp. Rows are read again until they are older than this,
+// which covers the one-second timestamp resolution plus a slow commit.
+const changeWatermarkLag = 10 * time.Second
+
+// productColumns selects a products row in the order scanProduct expects.
+// Callers add the WHERE clause, which should exclude soft-deleted rows.
+const productColumns = `
+        SELECT id, sku, COALESCE(manufacturer, ''), COALESCE(category_id, 0), COALESCE(weight, 0),
+               COALESCE(some_other_id, 0), COALESCE(name, ''), COALESCE(category, ''),
+               COALESCE(description, ''), COALESCE(brand, ''), price, currency
+        FROM products`
+
+func scanProduct(scanner interface{ Scan(...any) error }) (Item, error) {
+	var item Item
+	err := scanner.Scan(
+		&item.ID,
+		&item.SKU,
+		&item.Manufacturer,
+		&item.CategoryID,
+		&item.Weight,
+		&item.SomeOtherID,
+		&item.Name,
+		&item.Category,
+		&item.Description,
+		&item.Brand,
+		&item.Price,
+		&item.Currency,
+	)
+	return item, err
+}
+
+func (s *mysqlProductStore) LoadProducts(ctx context.Context) (map[int]Item, time.Time, error) {
+	// Read the watermark first, so changes made or committed during the
+	// load are picked up by the next ChangedSince
+	since, err := s.watermark(ctx)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	products := make(map[int]Item)
+	err = s.query(ctx, productColumns+` WHERE deleted_at IS NULL`, nil, func(item Item) {
+		products[item.ID] = item
+	})
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return products, since, nil
+}
+
+func (s *mysqlProductStore) UpdateProduct(ctx context.Context, update ProductUpdate) (*Item, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Lock the row so concurrent edits of the same product apply one after another
+	var current Item
+	err = tx.QueryRowContext(ctx, `SELECT price, currency FROM products WHERE id = ? AND deleted_at IS NULL FOR UPDATE`,
+		update.ID).Scan(&current.Price, &current.Currency)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrProductNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	item := update.apply(current)
+
+	_, err = tx.ExecContext(ctx, `
+        UPDATE products
+        SET sku = ?, manufacturer = ?, category_id = ?, weight = ?, some_other_id = ?,
+            name = ?, category = ?, description = ?, brand = ?, price = ?, currency = ?
+        WHERE id = ?`,
+		item.SKU, item.Manufacturer, item.CategoryID, item.Weight, item.SomeOtherID,
+		item.Name, item.Category, item.Description, item.Brand, item.Price, item.Currency, item.ID,
+	)
+	if isDuplicateKey(err) {
+		return nil, ErrDuplicateSKU
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Return what MySQL stored (weight is a FLOAT column)
+	stored, err := scanProduct(tx.QueryRowContext(ctx, productColumns+` WHERE id = ?`, item.ID))
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &stored, nil
+}
+
+func (s *mysqlProductStore) CreateProduct(ctx context.Context, item Item) (*Item, error) {
+	result, err := s.db.ExecContext(ctx, `
+        INSERT INTO products (sku, manufacturer, category_id, weight, some_other_id, name, category, description, brand, price, currency)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		item.SKU, item.Manufacturer, item.CategoryID, item.Weight, item.SomeOtherID,
+		item.Name, item.Category, item.Description, item.Brand, item.Price, item.Currency,
+	)
+	if isDuplicateKey(err) {
+		return nil, ErrDuplicateSKU
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	productID, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	stored, err := scanProduct(s.db.QueryRowContext(ctx, productColumns+` WHERE id = ?`, productID))
+	if err != nil {
+		return nil, err
+	}
+	return &stored, nil
+}
+
+func (s *mysqlProductStore) DeleteProduct(ctx context.Context, productID int, soft bool) error {
+	if soft {
+		result, err := s.db.ExecContext(ctx,
+			`UPDATE products SET deleted_at = CURRENT_TIMESTAMP WHERE id = ? AND deleted_at IS NULL`, productID)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return ErrProductNotFound
+		}
+		return nil
+	}
+
+	if s.inCart != nil {
+		held, release, err := s.inCart(ctx, productID)
+		if err != nil {
+			return fmt.Errorf("checking carts for product %d: %w", productID, err)
+		}
+		if held {
+			return ErrProductInCart
+		}
+		if err := s.hardDelete(ctx, productID); err != nil {
+			// The product stays, so its lines must not be refused
+			release()
+			return err
+		}
+		return nil
+	}
+	return s.hardDelete(ctx, productID)
+}
+
+// hardDelete removes a product's row and leaves a tombstone for it
+func (s *mysqlProductStore) hardDelete(ctx context.Context, productID int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// fk_product is ON DELETE RESTRICT, so MySQL refuses while a cart holds it.
+	// Soft-deleted products can still be removed for good this way.
+	result, err := tx.ExecContext(ctx, `DELETE FROM products WHERE id = ?`, productID)
+	if isForeignKeyViolation(err) {
+		return ErrProductInCart
+	}
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrProductNotFound
+	}
+
+	// Leave a tombstone so other tasks drop the product from their catalog
+	_, err = tx.ExecContext(ctx, `
+        INSERT INTO deleted_products (product_id) VALUES (?)
+        ON DUPLICATE KEY UPDATE deleted_at = CURRENT_TIMESTAMP`, productID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *mysqlProductStore) ChangedSince(ctx context.Context, since time.Time) ([]Item, []int, time.Time, error) {
+	next, err := s.watermark(ctx)
+	if err != nil {
+		return nil, nil, since, err
+	}
+
+	// The watermark trails the clock, so recent rows are read again on the
+	// next call, and one committed late is still ahead of it
+	var changed []Item
+	err = s.query(ctx, productColumns+` WHERE updated_at >= ? AND deleted_at IS NULL`, []any{since}, func(item Item) {
+		changed = append(changed, item)
+	})
+	if err != nil {
+		return nil, nil, since, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT id FROM products WHERE deleted_at >= ?
+        UNION
+        SELECT product_id FROM deleted_products WHERE deleted_at >= ?`, since, since)
+	if err != nil {
+		return nil, nil, since, fmt.Errorf("loading deleted products: %w", err)
+	}
+	defer rows.Close()
+	var deleted []int
+	for rows.Next() {
+		var productID int
+		if err := rows.Scan(&productID); err != nil {
+			return nil, nil, since, fmt.Errorf("scanning deleted product: %w", err)
+		}
+		deleted = append(deleted, productID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, since, fmt.Errorf("loading deleted products: %w", err)
+	}
+
+	if len(changed) > 0 || len(deleted) > 0 {
+		log.Printf("Picked up %d changed and %d deleted products", len(changed), len(deleted))
+	}
+	return changed, deleted, next, nil
+}
+
+// watermark returns the database clock, which updated_at is written with,
+// less changeWatermarkLag
+func (s *mysqlProductStore) watermark(ctx context.Context) (time.Time, error) {
+	var now time.Time
+	if err := s.db.QueryRowContext(ctx, `SELECT CURRENT_TIMESTAMP`).Scan(&now); err != nil {
+		return time.Time{}, fmt.Errorf("reading database clock: %w", err)
+	}
+	return now.Add(-changeWatermarkLag), nil
+}
+
+// query runs a products query and calls fn for every row
+func (s *mysqlProductStore) query(ctx context.Context, query string, args []any, fn func(Item)) error {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("loading products: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		item, err := scanProduct(rows)
+		if err != nil {
+			return fmt.Errorf("scanning product: %w", err)
+		}
+		fn(item)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("loading products: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Errors returned by OrderStore implementations
+var (
+	ErrOrderNotFound = errors.New("order not found")
+	ErrCartEmpty     = errors.New("shopping cart is empty")
+	// ErrPriceChanged means a line's price moved since it was added and the
+	// customer has not accepted the new price
+	ErrPriceChanged = errors.New("prices changed since items were added")
+	// ErrMixedCurrencies means the cart has no single currency to charge in
+	ErrMixedCurrencies = errors.New("shopping cart mixes currencies")
+)
+
+// OrderStatusPlaced is the status of every order checkout creates
+const OrderStatusPlaced = "placed"
+
+// Order is a checked-out cart. Its lines and totals are fixed when it is placed.
+type Order struct {
+	ID          int         `json:"id"`
+	CustomerID  int         `json:"customer_id"`
+	Status      string      `json:"status"`
+	Items       []OrderItem `json:"items"`
+	Subtotal    int64       `json:"subtotal"` // minor units of Currency
+	Currency    string      `json:"currency"`
+	ItemCount   int         `json:"item_count"`
+	TotalWeight float64     `json:"total_weight"`
+	CreatedAt   string      `json:"created_at"`
+}
+
+// OrderItem is one product of an order, at the price it was ordered for
+type OrderItem struct {
+	ProductID    int     `json:"product_id"`
+	Manufacturer string  `json:"manufacturer"`
+	Category     string  `json:"category"`
+	Quantity     int     `json:"quantity"`
+	UnitPrice    int64   `json:"unit_price"`
+	Weight       float64 `json:"weight"`
+}
+
+// InsufficientStockError is returned by Checkout when a tracked product has
+// fewer units than the cart holds. It matches ErrInsufficientStock.
+type InsufficientStockError struct {
+	Level *StockLevel
+}
+
+func (e *InsufficientStockError) Error() string {
+	return fmt.Sprintf("insufficient stock of product %d", e.Level.ProductID)
+}
+
+func (e *InsufficientStockError) Is(target error) bool {
+	return target == ErrInsufficientStock
+}
+
+// OrderStore turns carts into orders and reads them back
+type OrderStore interface {
+	// Checkout atomically creates an order from the customer's cart, takes
+	// the ordered units off stock (dropping the cart's reservations) and
+	// empties the cart. Lines are charged their current price; unless
+	// acceptPriceChanges is set, a line whose price changed since it was
+	// added fails the checkout with ErrPriceChanged.
+	Checkout(ctx context.Context, customerID int, acceptPriceChanges bool) (*Order, error)
+
+	// GetOrder returns an order with its items
+	GetOrder(ctx context.Context, orderID int) (*Order, error)
+
+	// ListOrders returns a customer's orders, newest first
+	ListOrders(ctx context.Context, customerID int) ([]Order, error)
+}
+
+// orderStore is the backend selected in main by DATABASE_TYPE
+var orderStore OrderStore
+
+// newOrderFromCart checks a cart read inside a checkout and builds the order
+// it turns into. Every backend calls it, so they refuse the same carts.
+func newOrderFromCart(cart *ShoppingCart, acceptPriceChanges bool) (*Order, error) {
+	if len(cart.Items) == 0 {
+		return nil, ErrCartEmpty
+	}
+	cart.computeTotals()
+	cart.markPriceChanges()
+	if cart.Currency == "" {
+		return nil, ErrMixedCurrencies
+	}
+
+	order := &Order{
+		CustomerID:  cart.CustomerID,
+		Status:      OrderStatusPlaced,
+		Items:       make([]OrderItem, 0, len(cart.Items)),
+		Subtotal:    cart.Subtotal,
+		Currency:    cart.Currency,
+		ItemCount:   cart.ItemCount,
+		TotalWeight: cart.TotalWeight,
+	}
+	for _, item := range cart.Items {
+		if item.PriceChanged && !acceptPriceChanges {
+			return nil, ErrPriceChanged
+		}
+		order.Items = append(order.Items, OrderItem{
+			ProductID:    item.ProductID,
+			Manufacturer: item.Manufacturer,
+			Category:     item.Category,
+			Quantity:     item.Quantity,
+			UnitPrice:    item.UnitPrice,
+			Weight:       item.Weight,
+		})
+	}
+	return order, nil
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+
+	defaultFacetSize = 10
+	maxFacetSize     = 100
+)
+
+// searchFacetFields are the Item fields clients can ask facet counts for
+var searchFacetFields = map[string]func(Item) string{
+	"manufacturer": func(item Item) string { return item.Manufacturer },
+	"category":     func(item Item) string { return item.Category },
+	"brand":        func(item Item) string { return item.Brand },
+}
+
+// FacetBucket is the number of matching products with one field value
+type FacetBucket struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// SearchFilters narrows a product search. Only the filters a request set
+// are echoed back in SearchResponse.
+type SearchFilters struct {
+	Category      []string `json:"category,omitempty"`
+	Manufacturer  []string `json:"manufacturer,omitempty"`
+	Brand         []string `json:"brand,omitempty"`
+	CategoryIDMin *int     `json:"category_id_min,omitempty"`
+	CategoryIDMax *int     `json:"category_id_max,omitempty"`
+	WeightMin     *float64 `json:"weight_min,omitempty"`
+	WeightMax     *float64 `json:"weight_max,omitempty"`
+}
+
+// searchRequest is a parsed /products/search query string
+type searchRequest struct {
+	Query   string
+	Filters SearchFilters
+	Sort    string // relevance, name, weight or id
+	Desc    bool
+	Limit   int
+	Offset  int
+	// Facets lists the fields to count values of, each cut to FacetSize buckets
+	Facets    []string
+	FacetSize int
+}
+
+// parseSearchRequest reads q, the filters, sort/order and limit/offset or cursor
+func parseSearchRequest(c *gin.Context) (*searchRequest, error) {
+	req := &searchRequest{
+		Query: strings.TrimSpace(c.Query("q")),
+		Filters: SearchFilters{
+			Category:     splitFilterValues(c.Query("category")),
+			Manufacturer: splitFilterValues(c.Query("manufacturer")),
+			Brand:        splitFilterValues(c.Query("brand")),
+		},
+		Limit:     defaultSearchLimit,
+		Facets:    splitFilterValues(c.Query("facets")),
+		FacetSize: defaultFacetSize,
+	}
+
+	var err error
+	if req.Filters.CategoryIDMin, err = optionalInt(c, "category_id_min"); err != nil {
+		return nil, err
+	}
+	if req.Filters.CategoryIDMax, err = optionalInt(c, "category_id_max"); err != nil {
+		return nil, err
+	}
+	if req.Filters.WeightMin, err = optionalFloat(c, "weight_min"); err != nil {
+		return nil, err
+	}
+	if req.Filters.WeightMax, err = optionalFloat(c, "weight_max"); err != nil {
+		return nil, err
+	}
+	if req.Query == "" && !req.Filters.active() {
+		return nil, fmt.Errorf("Query parameter 'q' or at least one filter is required")
+	}
+
+	// Without a query there is no relevance to sort by
+	req.Sort = c.Query("sort")
+	switch req.Sort {
+	case "":
+		req.Sort = "relevance"
+		if req.Query == "" {
+			req.Sort = "id"
+		}
+	case "relevance":
+		if req.Query == "" {
+			return nil, fmt.Errorf("sort=relevance requires 'q'")
+		}
+	case "name", "weight", "id":
+	default:
+		return nil, fmt.Errorf("sort must be one of relevance, name, weight, id")
+	}
+	switch c.DefaultQuery("order", "asc") {
+	case "asc":
+	case "desc":
+		req.Desc = true
+	default:
+		return nil, fmt.Errorf("order must be asc or desc")
+	}
+	// Relevance always runs best match first; reversed it would put the
+	// weakest matches on the first page
+	if req.Sort == "relevance" && req.Desc {
+		return nil, fmt.Errorf("order=desc does not apply to sort=relevance")
+	}
+
+	if value := c.Query("limit"); value != "" {
+		req.Limit, err = strconv.Atoi(value)
+		if err != nil || req.Limit < 1 || req.Limit > maxSearchLimit {
+			return nil, fmt.Errorf("limit must be between 1 and %d", maxSearchLimit)
+		}
+	}
+	if value := c.Query("offset"); value != "" {
+		req.Offset, err = strconv.Atoi(value)
+		if err != nil || req.Offset < 0 {
+			return nil, fmt.Errorf("offset must be a non-negative integer")
+		}
+	}
+	for _, field := range req.Facets {
+		if _, ok := searchFacetFields[field]; !ok {
+			return nil, fmt.Errorf("facets must be a comma-separated list of manufacturer, category, brand")
+		}
+	}
+	if value := c.Query("facet_size"); value != "" {
+		req.FacetSize, err = strconv.Atoi(value)
+		if err != nil || req.FacetSize < 1 || req.FacetSize > maxFacetSize {
+			return nil, fmt.Errorf("facet_size must be between 1 and %d", maxFacetSize)
+		}
+	}
+	if cursor := c.Query("cursor"); cursor != "" {
+		if c.Query("offset") != "" {
+			return nil, fmt.Errorf("use either offset or cursor, not both")
+		}
+		if req.Offset, err = req.decodeCursor(cursor); err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
+
+// active reports whether any filter is set
+func (f SearchFilters) active() bool {
+	return len(f.Category) > 0 || len(f.Manufacturer) > 0 || len(f.Brand) > 0 ||
+		f.CategoryIDMin != nil || f.CategoryIDMax != nil || f.WeightMin != nil || f.WeightMax != nil
+}
+
+// matches reports whether item passes every filter. Text filters compare
+// case-insensitively and accept any of their comma-separated values.
+func (f SearchFilters) matches(item Item) bool {
+	switch {
+	case !matchesAny(f.Category, item.Category),
+		!matchesAny(f.Manufacturer, item.Manufacturer),
+		!matchesAny(f.Brand, item.Brand),
+		f.CategoryIDMin != nil && item.CategoryID < *f.CategoryIDMin,
+		f.CategoryIDMax != nil && item.CategoryID > *f.CategoryIDMax,
+		f.WeightMin != nil && item.Weight < *f.WeightMin,
+		f.WeightMax != nil && item.Weight > *f.WeightMax:
+		return false
+	}
+	return true
+}
+
+// run returns every product matching the request, in the requested order
+func (req *searchRequest) run() []Item {
+	var matches []Item
+	if req.Query != "" {
+		// Hits come back best match first, which is the relevance order
+		for _, hit := range catalogIndex.Search(req.Query) {
+			if value, exists := syncProducts.Load(hit.ProductID); exists {
+				if item := value.(Item); req.Filters.matches(item) {
+					matches = append(matches, item)
+				}
+			}
+		}
+	} else {
+		syncProducts.Range(func(_, value any) bool {
+			if item := value.(Item); req.Filters.matches(item) {
+				matches = append(matches, item)
+			}
+			return true
+		})
+	}
+
+	var less func(a, b Item) bool
+	switch req.Sort {
+	case "name":
+		less = func(a, b Item) bool {
+			if an, bn := strings.ToLower(a.Name), strings.ToLower(b.Name); an != bn {
+				return an < bn
+			}
+			return a.ID < b.ID
+		}
+	case "weight":
+		less = func(a, b Item) bool {
+			if a.Weight != b.Weight {
+				return a.Weight < b.Weight
+			}
+			return a.ID < b.ID
+		}
+	case "id":
+		less = func(a, b Item) bool { return a.ID < b.ID }
+	}
+	if less != nil {
+		sort.Slice(matches, func(i, j int) bool { return less(matches[i], matches[j]) })
+	}
+	if req.Desc {
+		for i, j := 0, len(matches)-1; i < j; i, j = i+1, j-1 {
+			matches[i], matches[j] = matches[j], matches[i]
+		}
+	}
+	return matches
+}
+
+// page returns the slice of matches selected by limit and offset, and the
+// cursor for the next page ("" on the last page)
+func (req *searchRequest) page(matches []Item) ([]Item, string) {
+	start := min(req.Offset, len(matches))
+	end := min(start+req.Limit, len(matches))
+	next := ""
+	if end < len(matches) {
+		next = req.encodeCursor(end)
+	}
+	return matches[start:end], next
+}
+
+// facets counts the values of each requested field over all matches and
+// keeps the FacetSize most common, most common first
+func (req *searchRequest) facets(matches []Item) map[string][]FacetBucket {
+	if len(req.Facets) == 0 {
+		return nil
+	}
+
+	facets := make(map[string][]FacetBucket, len(req.Facets))
+	for _, field := range req.Facets {
+		value := searchFacetFields[field]
+		counts := make(map[string]int)
+		for _, item := range matches {
+			counts[value(item)]++
+		}
+
+		buckets := make([]FacetBucket, 0, len(counts))
+		for v, n := range counts {
+			buckets = append(buckets, FacetBucket{Value: v, Count: n})
+		}
+		sort.Slice(buckets, func(i, j int) bool {
+			if buckets[i].Count != buckets[j].Count {
+				return buckets[i].Count > buckets[j].Count
+			}
+			return buckets[i].Value < buckets[j].Value
+		})
+		facets[field] = buckets[:min(len(buckets), req.FacetSize)]
+	}
+	return facets
+}
+
+// searchCursor is the decoded form of an opaque pagination cursor. It is
+// tied to the query, filters and sort it was issued for.
+type searchCursor struct {
+	Offset int    `json:"o"`
+	Search string `json:"s"`
+}
+
+func (req *searchRequest) encodeCursor(offset int) string {
+	raw, _ := json.Marshal(searchCursor{Offset: offset, Search: req.fingerprint()})
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func (req *searchRequest) decodeCursor(cursor string) (int, error) {
+	var decoded searchCursor
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err == nil {
+		err = json.Unmarshal(raw, &decoded)
+	}
+	if err != nil || decoded.Offset < 0 {
+		return 0, fmt.Errorf("invalid cursor")
+	}
+	if decoded.Search != req.fingerprint() {
+		return 0, fmt.Errorf("cursor belongs to a different search")
+	}
+	return decoded.Offset, nil
+}
+
+// fingerprint identifies the query, filters and sort, but not the page
+func (req *searchRequest) fingerprint() string {
+	raw, _ := json.Marshal([]any{req.Query, req.Filters, req.Sort, req.Desc})
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:8])
+}
+
+// splitFilterValues splits a comma-separated filter into its values
+func splitFilterValues(value string) []string {
+	var values []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+func matchesAny(values []string, field string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if strings.EqualFold(v, field) {
+			return true
+		}
+	}
+	return false
+}
+
+func optionalInt(c *gin.Context, name string) (*int, error) {
+	value := c.Query(name)
+	if value == "" {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return nil, fmt.Errorf("%s must be an integer", name)
+	}
+	return &n, nil
+}
+
+func optionalFloat(c *gin.Context, name string) (*float64, error) {
+	value := c.Query(name)
+	if value == "" {
+		return nil, nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%s must be a number", name)
+	}
+	return &f, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseSearchRequestSortOrder(t *testing.T) {
+	tests := []struct {
+		query    string
+		wantSort string
+		wantDesc bool
+		wantErr  bool
+	}{
+		{"q=sony", "relevance", false, false},
+		{"q=sony&order=asc", "relevance", false, false},
+		{"q=sony&order=desc", "", false, true},
+		{"q=sony&sort=relevance&order=desc", "", false, true},
+		{"q=sony&sort=name&order=desc", "name", true, false},
+		{"category=Pen", "id", false, false},
+		{"category=Pen&order=desc", "id", true, false},
+		{"category=Pen&sort=relevance", "", false, true},
+		{"q=sony&sort=price", "", false, true},
+		{"q=sony&order=up", "", false, true},
+		{"", "", false, true},
+		{"q=sony&facets=brand,color", "", false, true},
+		{"q=sony&facets=brand&facet_size=0", "", false, true},
+	}
+	for _, tt := range tests {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("GET", "/products/search?"+tt.query, nil)
+		req, err := parseSearchRequest(c)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: got sort %q, want an error", tt.query, req.Sort)
+			}
+			continue
+		}
+		if err != nil || req.Sort != tt.wantSort || req.Desc != tt.wantDesc {
+			t.Errorf("%s: got %+v, %v; want sort %q, desc %v", tt.query, req, err, tt.wantSort, tt.wantDesc)
+		}
+	}
+}
+
+func TestSearchPagination(t *testing.T) {
+	router := newTestRouter(t)
+
+	// Walk the whole catalog by ID, following next_cursor
+	var ids []int
+	path := "/products/search?weight_min=0&limit=7"
+	for page := 0; ; page++ {
+		if page > testProductCount {
+			t.Fatal("next_cursor never ran out")
+		}
+		var resp SearchResponse
+		w := mustServe(t, router, http.StatusOK, "GET", path, "")
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decoding response: %v: %s", err, w.Body)
+		}
+		if resp.TotalFound != testProductCount || resp.Sort != "id" || len(resp.Products) > 7 {
+			t.Fatalf("page %d = %d products of %d sorted by %q", page, len(resp.Products), resp.TotalFound, resp.Sort)
+		}
+		for _, item := range resp.Products {
+			ids = append(ids, item.ID)
+		}
+		if resp.NextCursor == "" {
+			break
+		}
+		path = "/products/search?weight_min=0&limit=7&cursor=" + url.QueryEscape(resp.NextCursor)
+	}
+	if len(ids) != testProductCount {
+		t.Fatalf("walked %d products, want %d", len(ids), testProductCount)
+	}
+	for i, id := range ids {
+		if id != i+1 {
+			t.Fatalf("products out of order: %v", ids)
+		}
+	}
+
+	// A cursor only continues the search it came from
+	var first SearchResponse
+	w := mustServe(t, router, http.StatusOK, "GET", "/products/search?weight_min=0&limit=7", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &first); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	mustServe(t, router, http.StatusBadRequest, "GET", "/products/search?weight_min=0&limit=7&order=desc&cursor="+url.QueryEscape(first.NextCursor), "")
+	mustServe(t, router, http.StatusBadRequest, "GET", "/products/search?weight_min=0&offset=7&cursor="+url.QueryEscape(first.NextCursor), "")
+	mustServe(t, router, http.StatusBadRequest, "GET", "/products/search?weight_min=0&limit=101", "")
+}
+
+func TestSearchFacets(t *testing.T) {
+	matches := []Item{
+		{ID: 1, Brand: "Sony", Category: "Electronics"},
+		{ID: 2, Brand: "Dell", Category: "Electronics"},
+		{ID: 3, Brand: "Sony", Category: "Computers"},
+		{ID: 4, Brand: "Acme", Category: "Electronics"},
+	}
+	req := &searchRequest{Facets: []string{"brand", "category"}, FacetSize: 2}
+	got := req.facets(matches)
+
+	// Most common first, ties broken by value, cut to FacetSize
+	wantBrand := []FacetBucket{{"Sony", 2}, {"Acme", 1}}
+	wantCategory := []FacetBucket{{"Electronics", 3}, {"Computers", 1}}
+	if !slices.Equal(got["brand"], wantBrand) || !slices.Equal(got["category"], wantCategory) || len(got) != 2 {
+		t.Errorf("facets = %v, want brand %v and category %v", got, wantBrand, wantCategory)
+	}
+
+	if got := (&searchRequest{FacetSize: 2}).facets(matches); got != nil {
+		t.Errorf("facets without fields = %v, want nil", got)
+	}
+}
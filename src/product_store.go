@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	// defaultProductCount is how many products the seeding step generates
+	defaultProductCount = 100000
+
+	// defaultProductSeed makes generated catalogs identical across tasks and
+	// restarts unless PRODUCT_SEED says otherwise
+	defaultProductSeed = 6650
+
+	// defaultProductRefreshInterval is how often a task picks up product
+	// changes made by other tasks, unless PRODUCT_REFRESH_INTERVAL says otherwise
+	defaultProductRefreshInterval = 5 * time.Second
+
+	// defaultCurrency prices generated products and products written
+	// without a currency
+	defaultCurrency = "USD"
+)
+
+// Errors returned by ProductStore implementations, besides ErrProductNotFound
+var (
+	// ErrDuplicateSKU means a product write would reuse another product's SKU
+	ErrDuplicateSKU = errors.New("sku already belongs to another product")
+	// ErrProductInCart means a product cannot be deleted because a cart holds it
+	ErrProductInCart = errors.New("product is in a shopping cart")
+)
+
+// ProductStore is the persistent source of the product catalog. Every task
+// loads its in-memory copy (syncProducts) from it at startup and keeps that
+// copy current with ChangedSince.
+type ProductStore interface {
+	// LoadProducts returns the whole catalog keyed by product ID, together
+	// with the watermark for the first ChangedSince call
+	LoadProducts(ctx context.Context) (map[int]Item, time.Time, error)
+
+	// UpdateProduct replaces the details of an existing product and returns
+	// the stored version. Price and currency are kept when the update omits
+	// them. It fails with ErrProductNotFound or ErrDuplicateSKU.
+	UpdateProduct(ctx context.Context, update ProductUpdate) (*Item, error)
+
+	// CreateProduct inserts a new product under a server-assigned ID and
+	// returns it. It fails with ErrDuplicateSKU.
+	CreateProduct(ctx context.Context, item Item) (*Item, error)
+
+	// DeleteProduct retires a product. A hard delete fails with
+	// ErrProductInCart while any cart holds the product; a soft delete only
+	// hides it from the catalog, so existing cart lines keep working.
+	// Both fail with ErrProductNotFound.
+	DeleteProduct(ctx context.Context, productID int, soft bool) error
+
+	// ChangedSince returns the products written and the product IDs deleted
+	// at or after since, together with the watermark to pass on the next
+	// call. The same change may be returned by consecutive calls.
+	ChangedSince(ctx context.Context, since time.Time) (changed []Item, deleted []int, next time.Time, err error)
+}
+
+// ProductUpdate is the body of a product details update. Price is optional,
+// unlike the rest of the details, so clients written before products had
+// prices cannot zero them; an empty currency likewise keeps the stored one.
+type ProductUpdate struct {
+	Item
+	Price *int64 `json:"price"`
+}
+
+// apply returns the product current becomes with the update
+func (u ProductUpdate) apply(current Item) Item {
+	item := u.Item
+	item.Price = current.Price
+	if u.Price != nil {
+		item.Price = *u.Price
+	}
+	if item.Currency == "" {
+		item.Currency = current.Currency
+	}
+	return item
+}
+
+// cartProductChecker reports whether any cart holds a product. Product
+// stores ask it before a hard delete when the carts live where fk_product
+// cannot see them. The check may keep new lines of the product out until the
+// delete is done; when it finds no line, the delete must call release if it
+// does not go through after all, so the product can be added again.
+type cartProductChecker func(ctx context.Context, productID int) (held bool, release func(), err error)
+
+// productStore is the backend selected in main by DATABASE_TYPE
+var productStore ProductStore
+
+// loadCatalog replaces the in-memory catalog with the contents of store.
+// The returned watermark is where refreshCatalog should start.
+func loadCatalog(ctx context.Context, store ProductStore) (map[int]Item, time.Time, error) {
+	products, since, err := store.LoadProducts(ctx)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	syncProducts.Clear()
+	for id, item := range products {
+		syncProducts.Store(id, item)
+	}
+	catalogIndex.Rebuild(products)
+	catalogRefreshedAt.Store(time.Now().UnixNano())
+	return products, since, nil
+}
+
+// cacheProduct stores a product in this task's catalog and search index
+func cacheProduct(item Item) {
+	syncProducts.Store(item.ID, item)
+	catalogIndex.Upsert(item)
+}
+
+// evictProduct drops a product from this task's catalog and search index
+func evictProduct(productID int) {
+	syncProducts.Delete(productID)
+	catalogIndex.Remove(productID)
+}
+
+// refreshCatalog copies product changes made through other tasks into this
+// task's catalog every interval, until ctx is cancelled
+func refreshCatalog(ctx context.Context, store ProductStore, since time.Time, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	catalogRefreshInterval.Store(int64(interval))
+	defer catalogRefreshInterval.Store(0)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		changed, deleted, next, err := store.ChangedSince(ctx, since)
+		if err != nil {
+			log.Printf("Error refreshing product catalog: %v", err)
+			continue
+		}
+		for _, item := range changed {
+			cacheProduct(item)
+		}
+		for _, id := range deleted {
+			evictProduct(id)
+		}
+		since = next
+		catalogRefreshedAt.Store(time.Now().UnixNano())
+	}
+}
+
+// validateProduct checks product details against the products table columns
+func validateProduct(item Item) error {
+	switch {
+	case item.SKU == "":
+		return fmt.Errorf("sku is required")
+	case len(item.SKU) > 100:
+		return fmt.Errorf("sku must be at most 100 characters")
+	case len(item.Manufacturer) > 200:
+		return fmt.Errorf("manufacturer must be at most 200 characters")
+	case len(item.Name) > 200:
+		return fmt.Errorf("name must be at most 200 characters")
+	case len(item.Category) > 100:
+		return fmt.Errorf("category must be at most 100 characters")
+	case len(item.Brand) > 100:
+		return fmt.Errorf("brand must be at most 100 characters")
+	case item.Weight < 0:
+		return fmt.Errorf("weight cannot be negative")
+	case item.Price < 0:
+		return fmt.Errorf("price cannot be negative")
+	case !isCurrencyCode(item.Currency):
+		return fmt.Errorf("currency must be a three-letter ISO 4217 code such as USD")
+	}
+	return nil
+}
+
+// isCurrencyCode reports whether code looks like an ISO 4217 code
+func isCurrencyCode(code string) bool {
+	if len(code) != 3 {
+		return false
+	}
+	for _, r := range code {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// seedProductsEnabled reports whether SEED_PRODUCTS asks this task to seed
+// an empty products table before loading the catalog
+func seedProductsEnabled() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv("SEED_PRODUCTS"))
+	return enabled
+}
+
+// productSeedFromEnv reads PRODUCT_SEED, the random seed for generated catalogs
+func productSeedFromEnv() int64 {
+	value := os.Getenv("PRODUCT_SEED")
+	if value == "" {
+		return defaultProductSeed
+	}
+	seed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		log.Printf("Warning: invalid PRODUCT_SEED %q, using %d", value, defaultProductSeed)
+		return defaultProductSeed
+	}
+	return seed
+}
+
+// productRefreshIntervalFromEnv reads PRODUCT_REFRESH_INTERVAL (a Go duration such as "5s")
+func productRefreshIntervalFromEnv() time.Duration {
+	value := os.Getenv("PRODUCT_REFRESH_INTERVAL")
+	if value == "" {
+		return defaultProductRefreshInterval
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval <= 0 {
+		log.Printf("Warning: invalid PRODUCT_REFRESH_INTERVAL %q, using %s", value, defaultProductRefreshInterval)
+		return defaultProductRefreshInterval
+	}
+	return interval
+}
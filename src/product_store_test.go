@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestGenerateProductsIsDeterministic(t *testing.T) {
+	first := GenerateProducts(50, 42)
+	if len(first) != 50 {
+		t.Fatalf("generated %d products, want 50", len(first))
+	}
+	if again := GenerateProducts(50, 42); !reflect.DeepEqual(first, again) {
+		t.Error("two catalogs from the same seed differ")
+	}
+	if other := GenerateProducts(50, 43); reflect.DeepEqual(first, other) {
+		t.Error("catalogs from different seeds are identical")
+	}
+}
+
+func TestProductSeedFromEnv(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int64
+	}{
+		{"", defaultProductSeed},
+		{"7", 7},
+		{"-3", -3},
+		{"seven", defaultProductSeed},
+	}
+	for _, tt := range tests {
+		t.Setenv("PRODUCT_SEED", tt.value)
+		if got := productSeedFromEnv(); got != tt.want {
+			t.Errorf("PRODUCT_SEED=%q: got %d, want %d", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestLoadCatalogReplacesProducts(t *testing.T) {
+	syncProducts.Store(999999, Item{ID: 999999})
+	products := GenerateProducts(5, 1)
+	if _, _, err := loadCatalog(context.Background(), NewMemoryProductStore(products, nil)); err != nil {
+		t.Fatalf("loadCatalog: %v", err)
+	}
+
+	loaded := 0
+	syncProducts.Range(func(key, value any) bool {
+		if !reflect.DeepEqual(value, products[key.(int)]) {
+			t.Errorf("product %v = %+v, want %+v", key, value, products[key.(int)])
+		}
+		loaded++
+		return true
+	})
+	if loaded != len(products) {
+		t.Errorf("catalog holds %d products, want %d", loaded, len(products))
+	}
+}
+
+func TestMemoryProductStoreChangedSince(t *testing.T) {
+	ctx := context.Background()
+	products := GenerateProducts(3, 1)
+	store := NewMemoryProductStore(products, nil)
+	_, since, err := store.LoadProducts(ctx)
+	if err != nil {
+		t.Fatalf("LoadProducts: %v", err)
+	}
+
+	updated := products[1]
+	updated.Name = "Renamed"
+	if _, err := store.UpdateProduct(ctx, ProductUpdate{Item: updated}); err != nil {
+		t.Fatalf("UpdateProduct: %v", err)
+	}
+	clash := products[2]
+	clash.SKU = updated.SKU
+	if _, err := store.UpdateProduct(ctx, ProductUpdate{Item: clash}); !errors.Is(err, ErrDuplicateSKU) {
+		t.Errorf("reusing a SKU: got %v, want ErrDuplicateSKU", err)
+	}
+
+	changed, deleted, next, err := store.ChangedSince(ctx, since)
+	if err != nil {
+		t.Fatalf("ChangedSince: %v", err)
+	}
+	if len(changed) != 1 || changed[0].Name != "Renamed" || len(deleted) != 0 {
+		t.Errorf("changed = %+v, deleted = %v; want only the renamed product", changed, deleted)
+	}
+
+	if err := store.DeleteProduct(ctx, 2, false); err != nil {
+		t.Fatalf("DeleteProduct: %v", err)
+	}
+	changed, deleted, _, err = store.ChangedSince(ctx, next)
+	if err != nil {
+		t.Fatalf("ChangedSince: %v", err)
+	}
+	if len(changed) != 0 || len(deleted) != 1 || deleted[0] != 2 {
+		t.Errorf("after delete: changed = %+v, deleted = %v; want product 2 deleted", changed, deleted)
+	}
+}
+
+func TestProductUpdateApply(t *testing.T) {
+	current := Item{ID: 1, SKU: "SKU-1", Price: 1099, Currency: "EUR"}
+	price := int64(500)
+
+	tests := []struct {
+		name   string
+		update ProductUpdate
+		want   Item
+	}{
+		{"price omitted", ProductUpdate{Item: Item{ID: 1, SKU: "SKU-2"}}, Item{ID: 1, SKU: "SKU-2", Price: 1099, Currency: "EUR"}},
+		{"price set", ProductUpdate{Item: Item{ID: 1, SKU: "SKU-1"}, Price: &price}, Item{ID: 1, SKU: "SKU-1", Price: 500, Currency: "EUR"}},
+		{"currency set", ProductUpdate{Item: Item{ID: 1, SKU: "SKU-1", Currency: "USD"}}, Item{ID: 1, SKU: "SKU-1", Price: 1099, Currency: "USD"}},
+	}
+	for _, tt := range tests {
+		if got := tt.update.apply(current); got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMySQLDeleteProductReleasesCartCheck(t *testing.T) {
+	// Nothing listens on port 1, so the delete fails after the check passed
+	db, err := sql.Open("mysql", "user@tcp(127.0.0.1:1)/shop?timeout=1s")
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	defer db.Close()
+
+	released := 0
+	store := NewMySQLProductStore(db, func(ctx context.Context, productID int) (bool, func(), error) {
+		return false, func() { released++ }, nil
+	})
+	if err := store.DeleteProduct(context.Background(), 1, false); err == nil {
+		t.Fatal("DeleteProduct without a database succeeded")
+	}
+	if released != 1 {
+		t.Errorf("cart check released %d times after the delete failed, want once", released)
+	}
+}
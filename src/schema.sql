@@ -12,19 +12,80 @@ CREATE TABLE IF NOT EXISTS products (
   category VARCHAR(100),
   description TEXT,
   brand VARCHAR(100),
+  -- Minor units of currency (cents for USD). NULL only on rows from before
+  -- prices existed, until backfillProductPrices prices them at startup.
+  price BIGINT NULL,
+  currency CHAR(3) NOT NULL DEFAULT 'USD',
   created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-  updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+  updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  deleted_at TIMESTAMP NULL DEFAULT NULL,
+
+  -- Catalog refreshes look for recently written products
+  INDEX idx_updated_at (updated_at)
+) ENGINE=InnoDB;
+
+-- Tables created before soft deletes and catalog refreshes existed
+ALTER TABLE products ADD COLUMN deleted_at TIMESTAMP NULL DEFAULT NULL;
+ALTER TABLE products ADD INDEX idx_updated_at (updated_at);
+
+-- Tables created before products had prices. Existing rows get NULL, not a
+-- price of 0, so the backfill can tell them apart from real prices.
+ALTER TABLE products ADD COLUMN price BIGINT NULL;
+ALTER TABLE products ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'USD';
+
+-- ============================================
+-- DELETED PRODUCTS TABLE
+-- ============================================
+-- Hard-deleted product IDs, so other tasks can drop them from their catalog
+CREATE TABLE IF NOT EXISTS deleted_products (
+  product_id INT NOT NULL PRIMARY KEY,
+  deleted_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+
+  INDEX idx_deleted_at (deleted_at)
 ) ENGINE=InnoDB;
 
 -- ============================================
 -- SHOPPING CARTS TABLE
 -- ============================================
+-- Every customer list: the cart, a wishlist or saved-for-later items
 CREATE TABLE IF NOT EXISTS shopping_carts (
   id INT AUTO_INCREMENT PRIMARY KEY,
-  customer_id INT NOT NULL UNIQUE,
+  customer_id INT NOT NULL,
+  list_type VARCHAR(20) NOT NULL DEFAULT 'cart',
   created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  -- Last write to the cart or its items, which expiry counts from
   updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
-  INDEX idx_customer_id (customer_id)
+  -- One list of each type per customer
+  UNIQUE KEY uq_customer_list (customer_id, list_type),
+  INDEX idx_customer_id (customer_id),
+  -- The idle cart sweeper deletes by updated_at
+  INDEX idx_updated_at (updated_at)
+) ENGINE=InnoDB;
+
+-- Tables created before carts expired
+ALTER TABLE shopping_carts ADD INDEX idx_updated_at (updated_at);
+
+-- Tables created when every customer had a single cart. The old UNIQUE
+-- constraint on customer_id is the index named customer_id.
+ALTER TABLE shopping_carts ADD COLUMN list_type VARCHAR(20) NOT NULL DEFAULT 'cart';
+ALTER TABLE shopping_carts ADD UNIQUE KEY uq_customer_list (customer_id, list_type);
+ALTER TABLE shopping_carts DROP INDEX customer_id;
+
+-- ============================================
+-- GUEST CARTS TABLE
+-- ============================================
+-- Carts of shoppers who are not logged in. A guest cart belongs to the
+-- negative customer ID -id and is reached only through its token.
+CREATE TABLE IF NOT EXISTS guest_carts (
+  id INT AUTO_INCREMENT PRIMARY KEY,
+  token CHAR(38) NOT NULL UNIQUE,
+  shopping_cart_id INT NULL UNIQUE,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+
+  -- The token goes with its cart, whether merged, deleted or expired
+  CONSTRAINT fk_guest_cart FOREIGN KEY (shopping_cart_id)
+    REFERENCES shopping_carts (id)
+    ON DELETE CASCADE
 ) ENGINE=InnoDB;
 
 -- ============================================
@@ -35,6 +96,8 @@ CREATE TABLE IF NOT EXISTS shopping_cart_items (
   shopping_cart_id INT NOT NULL,
   product_id INT NOT NULL,
   quantity INT NOT NULL CHECK (quantity > 0),
+  -- products.price when the line was last added; NULL on older lines
+  unit_price_at_add BIGINT NULL,
   created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
   updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
   
@@ -53,4 +116,90 @@ CREATE TABLE IF NOT EXISTS shopping_cart_items (
   -- Performance indexes
   INDEX idx_cart_id (shopping_cart_id),
   INDEX idx_product_id (product_id)
-) ENGINE=InnoDB;
\ No newline at end of file
+) ENGINE=InnoDB;
+
+-- Tables created before cart lines recorded their price
+ALTER TABLE shopping_cart_items ADD COLUMN unit_price_at_add BIGINT NULL;
+
+-- ============================================
+-- IDEMPOTENCY KEYS TABLE
+-- ============================================
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+  idempotency_key VARCHAR(255) NOT NULL PRIMARY KEY,
+  fingerprint CHAR(64) NOT NULL,
+  completed BOOLEAN NOT NULL DEFAULT FALSE,
+  status_code INT,
+  content_type VARCHAR(100),
+  response_body MEDIUMBLOB,
+  expires_at DATETIME(6) NOT NULL,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+
+  -- Expired keys are purged in batches
+  INDEX idx_expires_at (expires_at)
+) ENGINE=InnoDB;
+
+-- ============================================
+-- PRODUCT STOCK TABLE
+-- ============================================
+-- Products without a row here are not stock limited
+CREATE TABLE IF NOT EXISTS product_stock (
+  product_id INT NOT NULL PRIMARY KEY,
+  on_hand INT NOT NULL CHECK (on_hand >= 0),
+  updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+
+  CONSTRAINT fk_stock_product FOREIGN KEY (product_id)
+    REFERENCES products (id)
+    ON DELETE CASCADE
+) ENGINE=InnoDB;
+
+-- ============================================
+-- STOCK RESERVATIONS TABLE
+-- ============================================
+-- Units a customer's cart holds of a product until expires_at
+CREATE TABLE IF NOT EXISTS stock_reservations (
+  product_id INT NOT NULL,
+  customer_id INT NOT NULL,
+  quantity INT NOT NULL CHECK (quantity > 0),
+  expires_at DATETIME(6) NOT NULL,
+
+  PRIMARY KEY (product_id, customer_id),
+  INDEX idx_customer_id (customer_id)
+) ENGINE=InnoDB;
+
+-- ============================================
+-- ORDERS TABLE
+-- ============================================
+-- Written by checkout. Totals are fixed when the order is placed.
+CREATE TABLE IF NOT EXISTS orders (
+  id INT AUTO_INCREMENT PRIMARY KEY,
+  customer_id INT NOT NULL,
+  status VARCHAR(20) NOT NULL,
+  subtotal BIGINT NOT NULL,
+  currency CHAR(3) NOT NULL,
+  item_count INT NOT NULL,
+  total_weight DOUBLE NOT NULL,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+
+  -- A customer's orders, newest first
+  INDEX idx_customer_id (customer_id, id)
+) ENGINE=InnoDB;
+
+-- ============================================
+-- ORDER ITEMS TABLE
+-- ============================================
+-- Product details are copied, not referenced, so orders outlive deleted products
+CREATE TABLE IF NOT EXISTS order_items (
+  id INT AUTO_INCREMENT PRIMARY KEY,
+  order_id INT NOT NULL,
+  product_id INT NOT NULL,
+  manufacturer VARCHAR(200) NOT NULL,
+  category VARCHAR(100) NOT NULL,
+  quantity INT NOT NULL CHECK (quantity > 0),
+  unit_price BIGINT NOT NULL,
+  weight DOUBLE NOT NULL,
+
+  CONSTRAINT fk_order FOREIGN KEY (order_id)
+    REFERENCES orders (id)
+    ON DELETE CASCADE,
+  INDEX idx_order_id (order_id)
+) ENGINE=InnoDB;
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// searchFieldWeights ranks a match in a product's name above one in its
+// brand or category, and those above a match in the description
+var searchFieldWeights = []struct {
+	weight float64
+	value  func(Item) string
+}{
+	{3, func(item Item) string { return item.Name }},
+	{2, func(item Item) string { return item.Brand }},
+	{2, func(item Item) string { return item.Category }},
+	{1, func(item Item) string { return item.Description }},
+}
+
+// catalogIndex is the full-text index over syncProducts. cacheProduct and
+// evictProduct keep the two in step.
+var catalogIndex = newSearchIndex()
+
+// searchIndex is an in-memory inverted index from lowercase terms to the
+// products containing them. It also keeps what /products/suggest needs: a
+// trie over the terms, product names, and product counts per brand and
+// per category.
+type searchIndex struct {
+	mu       sync.RWMutex
+	postings map[string]map[int]float64 // term -> product ID -> field weight
+	terms    map[int][]string           // product ID -> indexed terms, for removal
+	trie     *trieNode                  // every term in postings
+	ranked   map[string][]uint64        // term -> suggestRank of its products, ascending
+	products map[int]indexedProduct     // product ID -> fields shown in suggestions
+	facets   map[string]*facetValue     // "brand:" or "category:" + lowercase value
+}
+
+// indexedProduct is what the index remembers about a product besides its terms
+type indexedProduct struct {
+	Name     string
+	Brand    string
+	Category string
+}
+
+// facetValue counts the products sharing a brand or category
+type facetValue struct {
+	Kind  string // brand or category
+	Text  string
+	Count int
+}
+
+// searchHit is one product matching a query, with its relevance score
+type searchHit struct {
+	ProductID int
+	Score     float64
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		postings: make(map[string]map[int]float64),
+		terms:    make(map[int][]string),
+		trie:     newTrieNode(),
+		ranked:   make(map[string][]uint64),
+		products: make(map[int]indexedProduct),
+		facets:   make(map[string]*facetValue),
+	}
+}
+
+// Rebuild replaces the index contents with products
+func (idx *searchIndex) Rebuild(products map[int]Item) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.postings = make(map[string]map[int]float64)
+	idx.terms = make(map[int][]string, len(products))
+	idx.trie = newTrieNode()
+	idx.ranked = make(map[string][]uint64)
+	idx.products = make(map[int]indexedProduct, len(products))
+	idx.facets = make(map[string]*facetValue)
+	for _, item := range products {
+		idx.add(item, false)
+	}
+	for _, list := range idx.ranked {
+		slices.Sort(list)
+	}
+}
+
+// Upsert indexes item, replacing any earlier version of it
+func (idx *searchIndex) Upsert(item Item) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.remove(item.ID)
+	idx.add(item, true)
+}
+
+// Remove drops a product from the index
+func (idx *searchIndex) Remove(productID int) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.remove(productID)
+}
+
+// Len returns the number of indexed products
+func (idx *searchIndex) Len() int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	return len(idx.terms)
+}
+
+// Search returns every product containing all terms of query, best match
+// first. The last term may still be being typed, so it also matches the
+// terms it starts ("electr" finds "electronic"). Scores add up each term's
+// field weight times its inverse document frequency, so rare terms and name
+// matches count the most; ties are broken by product ID to keep results
+// stable.
+func (idx *searchIndex) Search(query string) []searchHit {
+	queryTerms := uniqueStrings(searchTokens(query))
+	if len(queryTerms) == 0 {
+		return nil
+	}
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	// Walk the shortest posting list and probe the others
+	lists := make([]map[int]float64, len(queryTerms))
+	for i, term := range queryTerms {
+		if i == len(queryTerms)-1 {
+			lists[i] = idx.prefixPostings(term)
+		} else {
+			lists[i] = idx.postings[term]
+		}
+		if len(lists[i]) == 0 {
+			return nil
+		}
+	}
+	sort.Slice(lists, func(i, j int) bool { return len(lists[i]) < len(lists[j]) })
+
+	total := float64(len(idx.terms))
+	idfs := make([]float64, len(lists))
+	for i, list := range lists {
+		idfs[i] = math.Log(1 + total/float64(len(list)))
+	}
+
+	hits := make([]searchHit, 0, len(lists[0]))
+	for productID, weight := range lists[0] {
+		score := weight * idfs[0]
+		matched := true
+		for i := 1; i < len(lists); i++ {
+			w, ok := lists[i][productID]
+			if !ok {
+				matched = false
+				break
+			}
+			score += w * idfs[i]
+		}
+		if matched {
+			hits = append(hits, searchHit{ProductID: productID, Score: score})
+		}
+	}
+
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].ProductID < hits[j].ProductID
+	})
+	return hits
+}
+
+// prefixPostings returns the products of every term starting with prefix,
+// each with its best field weight; the caller holds the read lock
+func (idx *searchIndex) prefixPostings(prefix string) map[int]float64 {
+	var terms []string
+	idx.trie.walkPrefix(prefix, func(term string) {
+		terms = append(terms, term)
+	})
+	if len(terms) == 1 {
+		return idx.postings[terms[0]]
+	}
+
+	merged := make(map[int]float64)
+	for _, term := range terms {
+		for productID, weight := range idx.postings[term] {
+			merged[productID] = max(merged[productID], weight)
+		}
+	}
+	return merged
+}
+
+// add indexes item; the caller holds the write lock. Unless keepSorted is
+// set, the caller sorts the ranked lists afterwards.
+func (idx *searchIndex) add(item Item, keepSorted bool) {
+	weights := make(map[string]float64)
+	for _, field := range searchFieldWeights {
+		for _, term := range searchTokens(field.value(item)) {
+			weights[term] = max(weights[term], field.weight)
+		}
+	}
+
+	terms := make([]string, 0, len(weights))
+	for term, weight := range weights {
+		list, ok := idx.postings[term]
+		if !ok {
+			list = make(map[int]float64)
+			idx.postings[term] = list
+			idx.trie.insert(term)
+		}
+		list[item.ID] = weight
+		terms = append(terms, term)
+
+		rank := suggestRank(item.Name, item.ID)
+		ranked := idx.ranked[term]
+		if keepSorted {
+			pos, _ := slices.BinarySearch(ranked, rank)
+			idx.ranked[term] = slices.Insert(ranked, pos, rank)
+		} else {
+			idx.ranked[term] = append(ranked, rank)
+		}
+	}
+	idx.terms[item.ID] = terms
+
+	idx.products[item.ID] = indexedProduct{Name: item.Name, Brand: item.Brand, Category: item.Category}
+	idx.countFacet("brand", item.Brand, 1)
+	idx.countFacet("category", item.Category, 1)
+}
+
+// countFacet adjusts the product count of a brand or category value
+func (idx *searchIndex) countFacet(kind, text string, delta int) {
+	if text == "" {
+		return
+	}
+	key := kind + ":" + strings.ToLower(text)
+	value, ok := idx.facets[key]
+	if !ok {
+		value = &facetValue{Kind: kind, Text: text}
+		idx.facets[key] = value
+	}
+	value.Count += delta
+	if value.Count <= 0 {
+		delete(idx.facets, key)
+	}
+}
+
+// remove unindexes a product; the caller holds the write lock
+func (idx *searchIndex) remove(productID int) {
+	product, indexed := idx.products[productID]
+	rank := suggestRank(product.Name, productID)
+	for _, term := range idx.terms[productID] {
+		list := idx.postings[term]
+		delete(list, productID)
+		if len(list) == 0 {
+			delete(idx.postings, term)
+			delete(idx.ranked, term)
+			idx.trie.remove(term)
+			continue
+		}
+		if pos, found := slices.BinarySearch(idx.ranked[term], rank); found {
+			idx.ranked[term] = slices.Delete(idx.ranked[term], pos, pos+1)
+		}
+	}
+	delete(idx.terms, productID)
+
+	if indexed {
+		idx.countFacet("brand", product.Brand, -1)
+		idx.countFacet("category", product.Category, -1)
+		delete(idx.products, productID)
+	}
+}
+
+// suggestRank orders products for suggestions: shorter names first, then
+// lower IDs. The product ID is in the low 32 bits.
+func suggestRank(name string, productID int) uint64 {
+	return uint64(len(name))<<32 | uint64(uint32(productID))
+}
+
+// searchTokens splits text into lowercase letter/digit runs
+func searchTokens(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	unique := values[:0]
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			unique = append(unique, v)
+		}
+	}
+	return unique
+}
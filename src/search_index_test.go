@@ -0,0 +1,67 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSearchIndexSearch(t *testing.T) {
+	idx := newSearchIndex()
+	idx.Rebuild(map[int]Item{
+		1: {ID: 1, Name: "Sony Headphones", Brand: "Sony", Category: "Electronic"},
+		2: {ID: 2, Name: "Dell Laptop", Brand: "Dell", Category: "Computer"},
+		3: {ID: 3, Name: "Sony Laptop", Brand: "Sony", Category: "Computer"},
+		4: {ID: 4, Name: "Pilot Pen", Brand: "Pilot", Category: "Pen", Description: "Electric blue ink"},
+	})
+
+	tests := []struct {
+		query string
+		want  []int
+	}{
+		{"sony", []int{1, 3}},
+		{"sony laptop", []int{3}},
+		{"laptop sony", []int{3}},
+		// The last term matches as a prefix
+		{"electr", []int{1, 4}},
+		{"Electr", []int{1, 4}},
+		{"sony lap", []int{3}},
+		{"pen", []int{4}},
+		// Earlier terms must match whole words
+		{"lap sony", nil},
+		{"ony", nil},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		var got []int
+		for _, hit := range idx.Search(tt.query) {
+			got = append(got, hit.ProductID)
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("Search(%q) = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+
+	// A category match outranks a description match
+	if hits := idx.Search("electr"); len(hits) != 2 || hits[0].ProductID != 1 {
+		t.Errorf(`Search("electr") = %v, want product 1 first`, hits)
+	}
+}
+
+func TestSearchIndexUpsertAndRemove(t *testing.T) {
+	idx := newSearchIndex()
+	idx.Rebuild(map[int]Item{1: {ID: 1, Name: "Sony Headphones"}})
+
+	idx.Upsert(Item{ID: 1, Name: "Bose Headphones"})
+	if hits := idx.Search("sony"); len(hits) != 0 {
+		t.Errorf("old name still indexed: %v", hits)
+	}
+	if hits := idx.Search("bose"); len(hits) != 1 {
+		t.Errorf(`Search("bose") = %v, want product 1`, hits)
+	}
+
+	idx.Remove(1)
+	if hits := idx.Search("headphones"); len(hits) != 0 || idx.Len() != 0 {
+		t.Errorf("removed product still indexed: %v, %d products", hits, idx.Len())
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// On SIGTERM (ECS stopping the task) or SIGINT the server drains: for
+// DRAIN_DELAY it keeps serving with /health answering 503, so the load
+// balancer stops routing to the task, then it stops accepting connections
+// and gives in-flight requests up to DRAIN_TIMEOUT to finish. main closes
+// the database pools only once the server has stopped.
+const (
+	defaultDrainDelay   = 5 * time.Second
+	defaultDrainTimeout = 20 * time.Second
+)
+
+// draining is set once shutdown has started
+var draining atomic.Bool
+
+// drainDurationFromEnv reads DRAIN_DELAY or DRAIN_TIMEOUT (a Go duration such as "20s")
+func drainDurationFromEnv(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		log.Printf("Warning: invalid %s %q, using %s", name, value, fallback)
+		return fallback
+	}
+	return d
+}
+
+// serveUntilSignal runs server until SIGTERM or SIGINT and then drains it.
+// A second signal during the drain stops the process at once. Requests still
+// running after timeout are cut off and reported as an error.
+func serveUntilSignal(server *http.Server, delay, timeout time.Duration) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	served := make(chan error, 1)
+	go func() { served <- server.ListenAndServe() }()
+
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+	// Let a second signal through to the default handler
+	stop()
+
+	draining.Store(true)
+	log.Printf("Shutting down: draining for %s, then waiting up to %s for in-flight requests", delay, timeout)
+	time.Sleep(delay)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		server.Close()
+		return fmt.Errorf("draining requests: %w", err)
+	}
+	if err := <-served; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	log.Println("All requests drained")
+	return nil
+}
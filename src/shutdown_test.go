@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDrainDurationFromEnv(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 7 * time.Second},
+		{"0s", 0},
+		{"1m", time.Minute},
+		{"-1s", 7 * time.Second},
+		{"soon", 7 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Setenv("DRAIN_TIMEOUT", tt.value)
+		if got := drainDurationFromEnv("DRAIN_TIMEOUT", 7*time.Second); got != tt.want {
+			t.Errorf("DRAIN_TIMEOUT=%q: got %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestServeUntilSignalDrainsInFlightRequests(t *testing.T) {
+	// Keep SIGTERM from killing the test binary before serveUntilSignal
+	// starts listening for it
+	sigterm := make(chan os.Signal, 1)
+	signal.Notify(sigterm, syscall.SIGTERM)
+	defer signal.Stop(sigterm)
+	defer draining.Store(false)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("finding a free port: %v", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	started := make(chan struct{})
+	server := &http.Server{Addr: addr, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		w.WriteHeader(http.StatusNoContent)
+	})}
+	stopped := make(chan error, 1)
+	go func() { stopped <- serveUntilSignal(server, 0, 5*time.Second) }()
+
+	// Start a slow request, then stop the server while it runs
+	responses := make(chan int, 1)
+	go func() {
+		for {
+			resp, err := http.Get("http://" + addr)
+			if err == nil {
+				resp.Body.Close()
+				responses <- resp.StatusCode
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	<-started
+	for !draining.Load() {
+		syscall.Kill(os.Getpid(), syscall.SIGTERM)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := <-stopped; err != nil {
+		t.Errorf("serveUntilSignal: %v", err)
+	}
+	select {
+	case code := <-responses:
+		if code != http.StatusNoContent {
+			t.Errorf("in-flight request: status %d, want %d", code, http.StatusNoContent)
+		}
+	default:
+		t.Error("server stopped before the in-flight request finished")
+	}
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"sort"
+	"unicode/utf8"
+)
+
+const (
+	defaultSuggestLimit = 10
+	maxSuggestLimit     = 25
+
+	// maxSuggestExpansions bounds how many indexed terms one query word may
+	// expand to (see fuzzyMatch)
+	maxSuggestExpansions = 1000
+)
+
+// Suggestion is one autocomplete entry for /products/suggest. Distance is
+// the number of typos corrected to reach it; Count is how many products a
+// brand or category suggestion covers.
+type Suggestion struct {
+	Text      string `json:"text"`
+	Type      string `json:"type"` // brand, category or product
+	ProductID int    `json:"product_id,omitempty"`
+	Count     int    `json:"count,omitempty"`
+	Distance  int    `json:"distance"`
+}
+
+// suggestTypeRank puts brand and category suggestions ahead of single products
+var suggestTypeRank = map[string]int{"brand": 0, "category": 1, "product": 2}
+
+// maxEditDistance is how many typos a query word of this length may contain.
+// Short words must match exactly, or nearly every term would qualify.
+func maxEditDistance(word []rune) int {
+	switch n := len(word); {
+	case n <= 3:
+		return 0
+	case n <= 6:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// Suggest completes query against brands, categories and products. Every
+// word but the last must match a word of the suggestion; the last word only
+// has to match the start of one, so "athl" finds "Athletic Apparel". Words
+// may contain a few typos. Suggestions with fewer corrections rank first,
+// then brands and categories before products, then more popular brands and
+// categories and shorter product names.
+func (idx *searchIndex) Suggest(query string, limit int) []Suggestion {
+	words := searchTokens(query)
+	if len(words) == 0 {
+		return nil
+	}
+	queryWords := make([][]rune, len(words))
+	for i, w := range words {
+		queryWords[i] = []rune(w)
+	}
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	var suggestions []Suggestion
+
+	// Brands and categories are few, so compare them one by one
+	for _, value := range idx.facets {
+		if dist, ok := matchWords(queryWords, searchTokens(value.Text)); ok {
+			suggestions = append(suggestions, Suggestion{
+				Text:     value.Text,
+				Type:     value.Kind,
+				Count:    value.Count,
+				Distance: dist,
+			})
+		}
+	}
+
+	// Products go through the term trie and posting lists
+	for _, hit := range idx.suggestProducts(queryWords, limit) {
+		suggestions = append(suggestions, Suggestion{
+			Text:      idx.products[hit.ProductID].Name,
+			Type:      "product",
+			ProductID: hit.ProductID,
+			Distance:  hit.distance,
+		})
+	}
+
+	sort.Slice(suggestions, func(i, j int) bool {
+		a, b := suggestions[i], suggestions[j]
+		switch {
+		case a.Distance != b.Distance:
+			return a.Distance < b.Distance
+		case a.Type != b.Type:
+			return suggestTypeRank[a.Type] < suggestTypeRank[b.Type]
+		case a.Count != b.Count:
+			return a.Count > b.Count
+		case len(a.Text) != len(b.Text):
+			return len(a.Text) < len(b.Text)
+		case a.Text != b.Text:
+			return a.Text < b.Text
+		}
+		return a.ProductID < b.ProductID
+	})
+	return suggestions[:min(len(suggestions), limit)]
+}
+
+// productSuggestion is a product candidate with its total number of typos
+type productSuggestion struct {
+	ProductID int
+	distance  int
+	nameLen   int
+}
+
+// suggestProducts returns the best limit products whose terms match every
+// query word; the caller holds the read lock
+func (idx *searchIndex) suggestProducts(queryWords [][]rune, limit int) []productSuggestion {
+	// Expand each query word into the indexed terms it may stand for
+	expansions := make([]map[string]int, len(queryWords))
+	sizes := make([]int, len(queryWords))
+	closest := make([]int, len(queryWords))
+	lowerBound := 0
+	for i, word := range queryWords {
+		prefix := i == len(queryWords)-1
+		expansions[i] = make(map[string]int)
+		closest[i] = maxEditDistance(word)
+		idx.trie.fuzzyMatch(word, closest[i], prefix, maxSuggestExpansions, func(term string, dist int) {
+			expansions[i][term] = dist
+			sizes[i] += len(idx.ranked[term])
+			closest[i] = min(closest[i], dist)
+		})
+		if len(expansions[i]) == 0 {
+			return nil
+		}
+		lowerBound += closest[i]
+	}
+
+	// Candidates come from the word with the fewest postings
+	rarest := 0
+	for i := range sizes {
+		if sizes[i] < sizes[rarest] {
+			rarest = i
+		}
+	}
+
+	better := func(a, b productSuggestion) bool {
+		switch {
+		case a.distance != b.distance:
+			return a.distance < b.distance
+		case a.nameLen != b.nameLen:
+			return a.nameLen < b.nameLen
+		}
+		return a.ProductID < b.ProductID
+	}
+
+	// Keep the best limit candidates in a small sorted slice. Each term's
+	// products are walked in (name length, ID) order, so the walk can stop
+	// as soon as a product could not beat the worst one kept, even with no
+	// more typos than the lower bound.
+	// Terms are visited best first candidate first, so once a term's first
+	// product cannot make it, no later term's can either.
+	type termStart struct {
+		term  string
+		bound int
+		first uint64
+	}
+	starts := make([]termStart, 0, len(expansions[rarest]))
+	for term, termDist := range expansions[rarest] {
+		starts = append(starts, termStart{term, lowerBound - closest[rarest] + termDist, idx.ranked[term][0]})
+	}
+	sort.Slice(starts, func(i, j int) bool {
+		if starts[i].bound != starts[j].bound {
+			return starts[i].bound < starts[j].bound
+		}
+		return starts[i].first < starts[j].first
+	})
+
+	top := make([]productSuggestion, 0, limit+1)
+	for _, start := range starts {
+		bound := start.bound
+		if len(top) == limit && !better(productSuggestion{
+			ProductID: int(uint32(start.first)),
+			distance:  bound,
+			nameLen:   int(start.first >> 32),
+		}, top[limit-1]) {
+			break
+		}
+		for _, rank := range idx.ranked[start.term] {
+			candidate := productSuggestion{
+				ProductID: int(uint32(rank)),
+				distance:  bound,
+				nameLen:   int(rank >> 32),
+			}
+			if len(top) == limit && !better(candidate, top[limit-1]) {
+				break
+			}
+			dist, ok := idx.productDistance(candidate.ProductID, expansions)
+			if !ok || containsProduct(top, candidate.ProductID) {
+				continue
+			}
+			candidate.distance = dist
+			if len(top) == limit && !better(candidate, top[limit-1]) {
+				continue
+			}
+			pos := sort.Search(len(top), func(k int) bool { return better(candidate, top[k]) })
+			top = append(top, productSuggestion{})
+			copy(top[pos+1:], top[pos:])
+			top[pos] = candidate
+			if len(top) > limit {
+				top = top[:limit]
+			}
+		}
+	}
+	return top
+}
+
+// productDistance sums, over the query words, the fewest typos between the
+// word and one of the product's terms. ok is false if a word matches none.
+func (idx *searchIndex) productDistance(productID int, expansions []map[string]int) (int, bool) {
+	total := 0
+	for _, expansion := range expansions {
+		best := -1
+		for _, term := range idx.terms[productID] {
+			if d, ok := expansion[term]; ok && (best < 0 || d < best) {
+				best = d
+			}
+		}
+		if best < 0 {
+			return 0, false
+		}
+		total += best
+	}
+	return total, true
+}
+
+func containsProduct(top []productSuggestion, productID int) bool {
+	for _, s := range top {
+		if s.ProductID == productID {
+			return true
+		}
+	}
+	return false
+}
+
+// matchWords reports whether every query word matches a word of text (the
+// last query word as a prefix) and the total typos needed
+func matchWords(queryWords [][]rune, textWords []string) (int, bool) {
+	total := 0
+	for i, word := range queryWords {
+		prefix := i == len(queryWords)-1
+		limit := maxEditDistance(word)
+		best := -1
+		for _, tw := range textWords {
+			d := editDistance(word, []rune(tw), prefix)
+			if d <= limit && (best < 0 || d < best) {
+				best = d
+			}
+		}
+		if best < 0 {
+			return 0, false
+		}
+		total += best
+	}
+	return total, true
+}
+
+// editDistance is the Levenshtein distance between word and term, or with
+// prefix set, between word and the closest prefix of term
+func editDistance(word, term []rune, prefix bool) int {
+	row := make([]int, len(word)+1)
+	for j := range row {
+		row[j] = j
+	}
+	best := row[len(word)]
+	for _, r := range term {
+		row = nextEditRow(row, word, r)
+		best = min(best, row[len(word)])
+	}
+	if prefix {
+		return best
+	}
+	return row[len(word)]
+}
+
+// nextEditRow extends a Levenshtein row for word by one more term rune
+func nextEditRow(prev []int, word []rune, r rune) []int {
+	row := make([]int, len(prev))
+	row[0] = prev[0] + 1
+	for j := 1; j < len(row); j++ {
+		cost := 1
+		if word[j-1] == r {
+			cost = 0
+		}
+		row[j] = min(prev[j]+1, row[j-1]+1, prev[j-1]+cost)
+	}
+	return row
+}
+
+// trieNode is a node of the term trie. term is set on nodes that end a term.
+type trieNode struct {
+	children map[rune]*trieNode
+	term     string
+}
+
+func newTrieNode() *trieNode {
+	return &trieNode{children: make(map[rune]*trieNode)}
+}
+
+func (t *trieNode) insert(term string) {
+	node := t
+	for _, r := range term {
+		child, ok := node.children[r]
+		if !ok {
+			child = newTrieNode()
+			node.children[r] = child
+		}
+		node = child
+	}
+	node.term = term
+}
+
+// remove deletes term and prunes the branches it leaves empty
+func (t *trieNode) remove(term string) {
+	path := make([]*trieNode, 0, utf8.RuneCountInString(term)+1)
+	runes := []rune(term)
+	node := t
+	path = append(path, node)
+	for _, r := range runes {
+		child, ok := node.children[r]
+		if !ok {
+			return
+		}
+		node = child
+		path = append(path, node)
+	}
+	node.term = ""
+	for i := len(runes) - 1; i >= 0; i-- {
+		n := path[i+1]
+		if n.term != "" || len(n.children) > 0 {
+			break
+		}
+		delete(path[i].children, runes[i])
+	}
+}
+
+// walkPrefix calls fn for every term starting with prefix, prefix included
+func (t *trieNode) walkPrefix(prefix string, fn func(term string)) {
+	node := t
+	for _, r := range prefix {
+		if node = node.children[r]; node == nil {
+			return
+		}
+	}
+	node.walk(fn)
+}
+
+// walk calls fn for every term at or below t
+func (t *trieNode) walk(fn func(term string)) {
+	if t.term != "" {
+		fn(t.term)
+	}
+	for _, child := range t.children {
+		child.walk(fn)
+	}
+}
+
+// fuzzyMatch calls fn for terms within maxDist edits of word. With prefix
+// set, a term matches when one of its prefixes is within maxDist, and dist
+// is that prefix's distance. The trie is walked breadth first, shortest
+// terms first, and the walk ends after the level on which maxTerms terms
+// have been found, so a one-letter prefix does not expand into the whole
+// vocabulary. Branches that can no longer come within maxDist are skipped.
+func (t *trieNode) fuzzyMatch(word []rune, maxDist int, prefix bool, maxTerms int, fn func(term string, dist int)) {
+	type step struct {
+		node *trieNode
+		row  []int
+		best int // smallest distance of any prefix so far
+	}
+
+	row := make([]int, len(word)+1)
+	for j := range row {
+		row[j] = j
+	}
+	level := []step{{t, row, len(word)}}
+	found := 0
+	for len(level) > 0 && found < maxTerms {
+		var next []step
+		for _, s := range level {
+			if s.node.term != "" {
+				dist := s.row[len(word)]
+				if prefix {
+					dist = s.best
+				}
+				if dist <= maxDist {
+					fn(s.node.term, dist)
+					found++
+				}
+			}
+			for r, child := range s.node.children {
+				childRow := nextEditRow(s.row, word, r)
+				childBest := min(s.best, childRow[len(word)])
+				// Once a prefix has matched, every term below matches too;
+				// otherwise stop when no cell can get back under maxDist
+				if !(prefix && childBest <= maxDist) && minInts(childRow) > maxDist {
+					continue
+				}
+				next = append(next, step{child, childRow, childBest})
+			}
+		}
+		level = next
+	}
+}
+
+func minInts(values []int) int {
+	m := values[0]
+	for _, v := range values[1:] {
+		m = min(m, v)
+	}
+	return m
+}
@@ -0,0 +1,114 @@
+package main
+
+import "testing"
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		word, term string
+		prefix     bool
+		want       int
+	}{
+		{"sony", "sony", false, 0},
+		{"sonny", "sony", false, 1},
+		{"snoy", "sony", false, 2},
+		{"kitten", "sitting", false, 3},
+		{"", "sony", false, 4},
+		{"sony", "", false, 4},
+		// With prefix set the word is compared to the closest prefix of term
+		{"elect", "electronics", true, 0},
+		{"elct", "electronics", true, 1},
+		{"elect", "electronics", false, 6},
+		{"xyz", "electronics", true, 3},
+	}
+	for _, tt := range tests {
+		if got := editDistance([]rune(tt.word), []rune(tt.term), tt.prefix); got != tt.want {
+			t.Errorf("editDistance(%q, %q, %v) = %d, want %d", tt.word, tt.term, tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestMaxEditDistance(t *testing.T) {
+	tests := []struct {
+		word string
+		want int
+	}{
+		{"tv", 0},
+		{"pen", 0},
+		{"sony", 1},
+		{"laptop", 1},
+		{"samsung", 2},
+	}
+	for _, tt := range tests {
+		if got := maxEditDistance([]rune(tt.word)); got != tt.want {
+			t.Errorf("maxEditDistance(%q) = %d, want %d", tt.word, got, tt.want)
+		}
+	}
+}
+
+func TestSearchIndexSuggest(t *testing.T) {
+	idx := newSearchIndex()
+	idx.Rebuild(map[int]Item{
+		1: {ID: 1, Name: "Running Shoes", Brand: "Athletic Apparel", Category: "Footwear"},
+		2: {ID: 2, Name: "Trail Shoes", Brand: "Athletic Apparel", Category: "Footwear"},
+		3: {ID: 3, Name: "Sony Headphones", Brand: "Sony", Category: "Electronics"},
+	})
+
+	tests := []struct {
+		query    string
+		wantText string
+		wantType string
+		wantDist int
+	}{
+		// The last word matches as a prefix
+		{"athl", "Athletic Apparel", "brand", 0},
+		{"foot", "Footwear", "category", 0},
+		{"trail sh", "Trail Shoes", "product", 0},
+		// Typos are corrected, but cost rank
+		{"atheltic", "Athletic Apparel", "brand", 2},
+		{"sonny head", "Sony Headphones", "product", 1},
+	}
+	for _, tt := range tests {
+		got := idx.Suggest(tt.query, 5)
+		if len(got) == 0 || got[0].Text != tt.wantText || got[0].Type != tt.wantType || got[0].Distance != tt.wantDist {
+			t.Errorf("Suggest(%q) = %+v, want %s %q first with distance %d", tt.query, got, tt.wantType, tt.wantText, tt.wantDist)
+		}
+	}
+
+	if got := idx.Suggest("shoes", 1); len(got) != 1 {
+		t.Errorf(`Suggest("shoes", 1) returned %d suggestions, want 1`, len(got))
+	}
+	if got := idx.Suggest("xyz", 5); len(got) != 0 {
+		t.Errorf(`Suggest("xyz") = %+v, want none`, got)
+	}
+}
+
+// BenchmarkSuggest measures suggestions against the full generated catalog,
+// which should answer in single-digit milliseconds
+func BenchmarkSuggest(b *testing.B) {
+	idx := newSearchIndex()
+	idx.Rebuild(GenerateProducts(defaultProductCount, defaultProductSeed))
+
+	queries := []struct {
+		name, query string
+		matches     bool
+	}{
+		{"short prefix", "a", true},
+		{"prefix", "athl", true},
+		{"typo", "samsng", true},
+		{"typo prefix", "elctro", true},
+		{"multi word", "product sony", true},
+		{"multi word typo", "atheltic appar", true},
+		{"no match", "zzzzzz", false},
+	}
+	for _, q := range queries {
+		b.Run(q.name, func(b *testing.B) {
+			if got := idx.Suggest(q.query, defaultSuggestLimit); (len(got) > 0) != q.matches {
+				b.Fatalf("Suggest(%q) = %d suggestions, want matches %v", q.query, len(got), q.matches)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				idx.Suggest(q.query, defaultSuggestLimit)
+			}
+		})
+	}
+}
@@ -23,11 +23,19 @@ type Item struct {
 	Category     string	 `json:"category"`
 	Description  string  `json:"description"`
 	Brand		 string  `json:"brand"`
+	// Price is in minor units of Currency (cents for USD), never a float
+	Price        int64   `json:"price"`
+	Currency     string  `json:"currency"`
 }
 
 
-func GenerateProducts(count int) map[int]Item {
-	// rand.Seed(time.Now().UnixNano())
+// GenerateProducts builds a catalog of count products. The same seed always
+// produces the same catalog, so every task that generates one agrees on it.
+func GenerateProducts(count int, seed int64) map[int]Item {
+	rng := rand.New(rand.NewSource(seed))
+	// Prices draw from their own source, so adding them left the rest of a
+	// seed's catalog unchanged
+	priceRng := rand.New(rand.NewSource(seed + 1))
 	
 	products := make(map[int]Item)
 	usedSKUs := make(map[string]bool)
@@ -70,25 +78,28 @@ func GenerateProducts(count int) map[int]Item {
 	
 	for i := 1; i <= count; i++ {
 		// Generate unique SKU
-		sku := GenerateUniqueSKU(usedSKUs)
+		sku := GenerateUniqueSKU(rng, usedSKUs)
 		usedSKUs[sku] = true
 		
 		// Random manufacturer
-		random_index := rand.Intn(len(manufacturers))
+		random_index := rng.Intn(len(manufacturers))
 		manufacturer := manufacturers[random_index]
 		
 		// Random category ID (100-999)
-		categoryID := rand.Intn(900) + 100
+		categoryID := rng.Intn(900) + 100
 		category := categories[random_index]
 		
 		// Random weight (0.1 to 50.0)
-		weight := rand.Float64()*49.9 + 0.1
+		weight := rng.Float64()*49.9 + 0.1
 		weight = float64(int(weight*10)) / 10 // Round to 1 decimal place
 		
 		// Random some other ID (100-9999)
-		someOtherID := rand.Intn(9900) + 100
+		someOtherID := rng.Intn(9900) + 100
 		name := fmt.Sprintf("Product %s %d", manufacturer, i)
 		description := fmt.Sprintf("%s %s %d", manufacturer, category, i)
+
+		// Random price ($0.99 to $999.99), in cents
+		price := int64(priceRng.Intn(1000))*100 + 99
 		
 		item := Item{
 			ID:           i,
@@ -101,6 +112,8 @@ func GenerateProducts(count int) map[int]Item {
 			Category:     category,
 			Description:  description,
 			Brand:        manufacturer,
+			Price:        price,
+			Currency:     defaultCurrency,
 		}
 		
 		products[i] = item
@@ -109,20 +122,20 @@ func GenerateProducts(count int) map[int]Item {
 	return products
 }
 
-func GenerateUniqueSKU(usedSKUs map[string]bool) string {
+func GenerateUniqueSKU(rng *rand.Rand, usedSKUs map[string]bool) string {
 	const letters = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
 	
 	for {
 		// Generate first part (4 characters)
 		part1 := make([]byte, 4)
 		for i := 0; i < 4; i++ {
-			part1[i] = letters[rand.Intn(len(letters))]
+			part1[i] = letters[rng.Intn(len(letters))]
 		}
 		
 		// Generate second part (3 characters)
 		part2 := make([]byte, 3)
 		for i := 0; i < 3; i++ {
-			part2[i] = letters[rand.Intn(len(letters))]
+			part2[i] = letters[rng.Intn(len(letters))]
 		}
 		
 		sku := string(part1) + "-" + string(part2)
@@ -18,6 +18,11 @@ module "alb" {
   vpc_id         = module.network.vpc_id
   subnet_ids     = module.network.subnet_ids
   container_port = var.container_port
+
+  # Route only to tasks whose dependencies answer
+  health_check_path                = var.health_check_path
+  health_check_interval            = var.health_check_interval
+  health_check_unhealthy_threshold = var.health_check_unhealthy_threshold
 }
 
 module "logging" {
@@ -40,8 +45,9 @@ module "rds" {
 
 # DynamoDB Table for Shopping Carts
 module "dynamodb" {
-  source       = "./modules/dynamodb"
-  service_name = var.service_name
+  source               = "./modules/dynamodb"
+  service_name         = var.service_name
+  legacy_table_enabled = var.dynamodb_legacy_table_enabled
 }
 
 # Reuse an existing IAM role for ECS tasks
@@ -76,9 +82,30 @@ module "ecs" {
   db_username = var.database_username
   db_password = var.database_password
 
+  # Product catalog
+  seed_products = var.seed_products
+  product_seed  = var.product_seed
+
+  # Inventory
+  stock_reservations    = var.stock_reservations
+  stock_reservation_ttl = var.stock_reservation_ttl
+
+  # Cart expiry
+  cart_ttl_days       = var.cart_ttl_days
+  cart_sweep_interval = var.cart_sweep_interval
+
+  # Guest carts
+  cart_merge_strategy = var.cart_merge_strategy
+
+  # Graceful shutdown. Unless set, the drain delay lasts as long as the ALB
+  # can take to see a draining task fail its health checks.
+  drain_delay_seconds   = coalesce(var.drain_delay_seconds, var.health_check_interval * var.health_check_unhealthy_threshold)
+  drain_timeout_seconds = var.drain_timeout_seconds
+
   # DynamoDB configuration
-  database_type = var.database_type
-  aws_region    = var.aws_region
+  database_type         = var.database_type
+  aws_region            = var.aws_region
+  dynamodb_legacy_table = module.dynamodb.legacy_table_name
 }
 
 
@@ -24,10 +24,10 @@ resource "aws_lb_target_group" "this" {
   health_check {
     enabled             = true
     healthy_threshold   = 2
-    unhealthy_threshold = 2
+    unhealthy_threshold = var.health_check_unhealthy_threshold
     timeout             = 5
-    interval            = 30
-    path                = "/health"
+    interval            = var.health_check_interval
+    path                = var.health_check_path
     protocol            = "HTTP"
     matcher             = "200"
   }
@@ -16,4 +16,22 @@ variable "subnet_ids" {
 variable "container_port" {
   type        = number
   description = "Port the container listens on"
+}
+
+variable "health_check_path" {
+  type        = string
+  description = "Path the target group health check requests"
+  default     = "/healthz/ready"
+}
+
+variable "health_check_interval" {
+  type        = number
+  description = "Seconds between target group health checks; more than the 5 second timeout"
+  default     = 10
+}
+
+variable "health_check_unhealthy_threshold" {
+  type        = number
+  description = "Failed health checks before the ALB stops routing to a target"
+  default     = 2
 }
\ No newline at end of file
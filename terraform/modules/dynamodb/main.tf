@@ -1,5 +1,71 @@
-# DynamoDB Table for Shopping Carts
+# DynamoDB Table for Shopping Carts (single-table, one item per cart line)
+resource "aws_dynamodb_table" "carts" {
+  name         = "${var.service_name}-carts"
+  billing_mode = "PAY_PER_REQUEST" # On-demand billing
+
+  # Partition key: CART#<cart_id> groups a cart's header and lines together
+  # Sort key: META for the cart header, ITEM#<product_id> for each line
+  hash_key  = "pk"
+  range_key = "sk"
+
+  # Attributes
+  attribute {
+    name = "pk"
+    type = "S" # String
+  }
+
+  attribute {
+    name = "sk"
+    type = "S" # String
+  }
+
+  attribute {
+    name = "customer_id"
+    type = "N" # Number (to match MySQL customer_id as integer)
+  }
+
+  attribute {
+    name = "product_id"
+    type = "N" # Number (to match MySQL product_id as integer)
+  }
+
+  # Global Secondary Index for customer_id lookups
+  # Required because API uses customer_id as {id} path parameter.
+  # Only META rows carry customer_id, so the index holds one entry per cart.
+  global_secondary_index {
+    name            = "customer_id-index"
+    hash_key        = "customer_id"
+    projection_type = "ALL"
+  }
+
+  # Global Secondary Index for finding the cart lines of a product, checked
+  # before a hard product delete. Only ITEM# rows carry product_id, so the
+  # index is sparse and needs no more than the keys.
+  global_secondary_index {
+    name            = "product_id-index"
+    hash_key        = "product_id"
+    projection_type = "KEYS_ONLY"
+  }
+
+  # Rows with an expires_at (epoch seconds) in the past get deleted: carts
+  # idle for longer than CART_TTL_DAYS, and expired idempotency keys.
+  # Rows without it, such as stock, orders and counters, are kept.
+  ttl {
+    attribute_name = "expires_at"
+    enabled        = true
+  }
+
+  tags = {
+    Name        = "${var.service_name}-carts-dynamodb"
+    Description = "Shopping carts table for DynamoDB implementation"
+  }
+}
+
+# Legacy table: one item per cart with lines in the cart_items list.
+# Kept while the application migrates carts out of it (DYNAMODB_LEGACY_TABLE);
+# set legacy_table_enabled = false once migration is done to drop it.
 resource "aws_dynamodb_table" "shopping_carts" {
+  count        = var.legacy_table_enabled ? 1 : 0
   name         = "${var.service_name}-shopping-carts"
   billing_mode = "PAY_PER_REQUEST" # On-demand billing
 
@@ -18,7 +84,6 @@ resource "aws_dynamodb_table" "shopping_carts" {
   }
 
   # Global Secondary Index for customer_id lookups
-  # Required because API uses customer_id as {id} path parameter
   global_secondary_index {
     name            = "customer_id-index"
     hash_key        = "customer_id"
@@ -27,7 +92,12 @@ resource "aws_dynamodb_table" "shopping_carts" {
 
   tags = {
     Name        = "${var.service_name}-shopping-carts-dynamodb"
-    Description = "Shopping carts table for DynamoDB implementation"
+    Description = "Legacy list-shaped shopping carts table"
   }
 }
 
+# The legacy table used to be a single resource; keep its state when it became counted
+moved {
+  from = aws_dynamodb_table.shopping_carts
+  to   = aws_dynamodb_table.shopping_carts[0]
+}
@@ -1,11 +1,11 @@
 output "table_name" {
   description = "DynamoDB table name"
-  value       = aws_dynamodb_table.shopping_carts.name
+  value       = aws_dynamodb_table.carts.name
 }
 
 output "table_arn" {
   description = "DynamoDB table ARN"
-  value       = aws_dynamodb_table.shopping_carts.arn
+  value       = aws_dynamodb_table.carts.arn
 }
 
 output "gsi_name" {
@@ -13,3 +13,7 @@ output "gsi_name" {
   value       = "customer_id-index"
 }
 
+output "legacy_table_name" {
+  description = "Legacy list-shaped table to migrate carts from (empty once removed)"
+  value       = var.legacy_table_enabled ? aws_dynamodb_table.shopping_carts[0].name : ""
+}
@@ -3,3 +3,9 @@ variable "service_name" {
   description = "Base name for DynamoDB resources"
 }
 
+
+variable "legacy_table_enabled" {
+  type        = bool
+  description = "Keep the legacy list-shaped shopping carts table for migration"
+  default     = true
+}
@@ -19,10 +19,24 @@ resource "aws_ecs_task_definition" "this" {
     image     = var.image
     essential = true
 
+    # Time to drain before ECS kills the container, with a few seconds to
+    # close the database pools
+    stopTimeout = var.drain_delay_seconds + var.drain_timeout_seconds + 5
+
     portMappings = [{
       containerPort = var.container_port
     }]
 
+    # Liveness only: a dependency outage takes the task out of the ALB
+    # through readiness but must not get it replaced
+    healthCheck = {
+      command     = ["CMD-SHELL", "wget -q -O /dev/null http://localhost:${var.container_port}${var.liveness_check_path} || exit 1"]
+      interval    = 30
+      timeout     = 5
+      retries     = 3
+      startPeriod = 60
+    }
+
     environment = [
       {
         name  = "DB_HOST"
@@ -44,6 +58,42 @@ resource "aws_ecs_task_definition" "this" {
         name  = "DB_PASSWORD"
         value = var.db_password
       },
+      {
+        name  = "SEED_PRODUCTS"
+        value = tostring(var.seed_products)
+      },
+      {
+        name  = "PRODUCT_SEED"
+        value = tostring(var.product_seed)
+      },
+      {
+        name  = "STOCK_RESERVATIONS"
+        value = tostring(var.stock_reservations)
+      },
+      {
+        name  = "STOCK_RESERVATION_TTL"
+        value = var.stock_reservation_ttl
+      },
+      {
+        name  = "CART_TTL_DAYS"
+        value = tostring(var.cart_ttl_days)
+      },
+      {
+        name  = "CART_SWEEP_INTERVAL"
+        value = var.cart_sweep_interval
+      },
+      {
+        name  = "CART_MERGE_STRATEGY"
+        value = var.cart_merge_strategy
+      },
+      {
+        name  = "DRAIN_DELAY"
+        value = "${var.drain_delay_seconds}s"
+      },
+      {
+        name  = "DRAIN_TIMEOUT"
+        value = "${var.drain_timeout_seconds}s"
+      },
       {
         name  = "DATABASE_TYPE"
         value = var.database_type
@@ -55,6 +105,10 @@ resource "aws_ecs_task_definition" "this" {
       {
         name  = "SERVICE_NAME"
         value = var.service_name
+      },
+      {
+        name  = "DYNAMODB_LEGACY_TABLE"
+        value = var.dynamodb_legacy_table
       }
     ]
     
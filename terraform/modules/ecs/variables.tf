@@ -112,6 +112,72 @@ variable "max_capacity" {
   description = "Maximum number of tasks"
 }
 
+# Product catalog
+variable "seed_products" {
+  type        = bool
+  description = "Seed an empty products table on startup"
+  default     = false
+}
+
+variable "product_seed" {
+  type        = number
+  description = "Random seed for the generated product catalog"
+  default     = 6650
+}
+
+# Inventory
+variable "stock_reservations" {
+  type        = bool
+  description = "Reserve stock of tracked products when items are added to carts"
+  default     = false
+}
+
+variable "stock_reservation_ttl" {
+  type        = string
+  description = "How long a cart holds reserved stock, as a Go duration"
+  default     = "30m"
+}
+
+# Cart expiry
+variable "cart_ttl_days" {
+  type        = number
+  description = "Delete carts not written for this many days (0 keeps carts forever)"
+  default     = 0
+}
+
+variable "cart_sweep_interval" {
+  type        = string
+  description = "How often MySQL tasks sweep for expired carts, as a Go duration"
+  default     = "1h"
+}
+
+# Guest carts
+variable "cart_merge_strategy" {
+  type        = string
+  description = "How merging a guest cart combines products in both carts: sum, max or prefer_latest"
+  default     = "sum"
+}
+
+# Health checks
+variable "liveness_check_path" {
+  type        = string
+  description = "Path the container health check requests; ECS replaces the task when it fails"
+  default     = "/healthz/live"
+}
+
+# Graceful shutdown
+variable "drain_delay_seconds" {
+  type        = number
+  description = "Seconds a stopping task keeps serving with /health and /healthz/ready failing; at least the ALB health check interval times its unhealthy threshold"
+  default     = 20
+}
+
+variable "drain_timeout_seconds" {
+  type        = number
+  description = "Seconds a stopping task gives in-flight requests to finish"
+  default     = 20
+}
+
 # DynamoDB configuration
 variable "database_type" {
   type        = string
@@ -123,4 +189,10 @@ variable "aws_region" {
   type        = string
   description = "AWS region for DynamoDB client"
   default     = "us-west-2"
-}
\ No newline at end of file
+}
+
+variable "dynamodb_legacy_table" {
+  type        = string
+  description = "Legacy DynamoDB carts table to migrate from on startup (empty to skip)"
+  default     = ""
+}
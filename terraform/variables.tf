@@ -69,4 +69,89 @@ variable "database_type" {
   type        = string
   description = "Database type: 'mysql' or 'dynamodb'"
   default     = "mysql"
-}
\ No newline at end of file
+}
+
+# Product catalog seeding
+variable "seed_products" {
+  type        = bool
+  description = "Let tasks generate and insert the product catalog when the products table is empty"
+  default     = true
+}
+
+variable "product_seed" {
+  type        = number
+  description = "Random seed for the generated product catalog"
+  default     = 6650
+}
+
+# Stock reservations on add-to-cart
+variable "stock_reservations" {
+  type        = bool
+  description = "Reserve stock of tracked products when items are added to carts"
+  default     = false
+}
+
+variable "stock_reservation_ttl" {
+  type        = string
+  description = "How long a cart holds reserved stock, as a Go duration such as 30m"
+  default     = "30m"
+}
+
+# Abandoned cart expiry
+variable "cart_ttl_days" {
+  type        = number
+  description = "Delete carts not written for this many days (0 keeps carts forever)"
+  default     = 0
+}
+
+variable "cart_sweep_interval" {
+  type        = string
+  description = "How often MySQL tasks sweep for expired carts, as a Go duration such as 1h"
+  default     = "1h"
+}
+
+# Guest carts
+variable "cart_merge_strategy" {
+  type        = string
+  description = "How merging a guest cart into a customer's cart combines products in both: sum, max or prefer_latest"
+  default     = "sum"
+}
+
+# Health checks
+variable "health_check_path" {
+  type        = string
+  description = "Path the ALB health check requests: /healthz/ready probes the databases, /health is the old check"
+  default     = "/healthz/ready"
+}
+
+variable "health_check_interval" {
+  type        = number
+  description = "Seconds between ALB health checks; more than the 5 second timeout"
+  default     = 10
+}
+
+variable "health_check_unhealthy_threshold" {
+  type        = number
+  description = "Failed ALB health checks before a task stops getting requests"
+  default     = 2
+}
+
+# Graceful shutdown
+variable "drain_delay_seconds" {
+  type        = number
+  description = "Seconds a stopping task keeps serving with /health and /healthz/ready failing, so the ALB stops routing to it; null for health_check_interval * health_check_unhealthy_threshold"
+  default     = null
+}
+
+variable "drain_timeout_seconds" {
+  type        = number
+  description = "Seconds a stopping task gives in-flight requests to finish"
+  default     = 20
+}
+
+# Keep the old list-shaped DynamoDB carts table so tasks can migrate from it
+variable "dynamodb_legacy_table_enabled" {
+  type        = bool
+  description = "Keep the legacy DynamoDB shopping carts table and migrate carts from it on startup"
+  default     = true
+}